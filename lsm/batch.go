@@ -0,0 +1,120 @@
+package lsm
+
+import (
+	"time"
+
+	"github.com/s-ilyin/lsm-distributed/lsm/encoder"
+	"github.com/s-ilyin/lsm-distributed/lsm/wal"
+)
+
+// WriteBatch accumulates updates that are applied to the tree atomically
+// by LSMTree.Write: the batch is written to the WAL as a single record
+// and applied to the MemTables at once. The updates may belong
+// to different column families, the plain methods update the default family.
+type WriteBatch struct {
+	encoder *encoder.Encoder
+	elems   []wal.Entry
+}
+
+func NewWriteBatch() *WriteBatch {
+	return &WriteBatch{
+		encoder: encoder.NewEncoder(),
+	}
+}
+
+func (b *WriteBatch) add(cf *ColumnFamily, key, val []byte) {
+	var family uint32
+	if cf != nil {
+		family = cf.id
+	}
+	b.elems = append(b.elems, wal.Entry{Family: family, Key: key, Val: val})
+}
+
+// Put adds the key to the batch.
+func (b *WriteBatch) Put(key, value []byte) {
+	b.PutCF(nil, key, value)
+}
+
+// PutCF adds the key of the column family to the batch.
+func (b *WriteBatch) PutCF(cf *ColumnFamily, key, value []byte) {
+	b.add(cf, key, b.encoder.Encode(encoder.OpKindSet, value))
+}
+
+// PutWithTTL adds the key expiring after the ttl to the batch.
+// The expiry time is counted from the call.
+func (b *WriteBatch) PutWithTTL(key, value []byte, ttl time.Duration) {
+	expireAt := time.Now().Add(ttl).UnixNano()
+	b.add(nil, key, b.encoder.EncodeWithExpiry(encoder.OpKindSet, value, expireAt))
+}
+
+// Delete adds the deletion of the key to the batch.
+func (b *WriteBatch) Delete(key []byte) {
+	b.DeleteCF(nil, key)
+}
+
+// DeleteCF adds the deletion of the key of the column family to the batch.
+func (b *WriteBatch) DeleteCF(cf *ColumnFamily, key []byte) {
+	b.add(cf, key, b.encoder.Encode(encoder.OpKindDelete, nil))
+}
+
+// Merge adds the merge operand of the key to the batch.
+func (b *WriteBatch) Merge(key, operand []byte) {
+	b.MergeCF(nil, key, operand)
+}
+
+// MergeCF adds the merge operand of the key of the column family to the batch.
+func (b *WriteBatch) MergeCF(cf *ColumnFamily, key, operand []byte) {
+	b.add(cf, key, b.encoder.Encode(encoder.OpKindMerge, operand))
+}
+
+// DeleteRange adds the deletion of all keys in [start, end) to the batch.
+// The range tombstone is stored with the start key and the end key as the value.
+func (b *WriteBatch) DeleteRange(start, end []byte) {
+	b.DeleteRangeCF(nil, start, end)
+}
+
+// DeleteRangeCF adds the deletion of all keys in [start, end) of the column family to the batch.
+func (b *WriteBatch) DeleteRangeCF(cf *ColumnFamily, start, end []byte) {
+	b.add(cf, start, b.encoder.Encode(encoder.OpKindRangeDelete, end))
+}
+
+// Len returns the number of updates in the batch.
+func (b *WriteBatch) Len() int {
+	return len(b.elems)
+}
+
+// Reset clears the batch, so it can be reused.
+func (b *WriteBatch) Reset() {
+	b.elems = b.elems[:0]
+}
+
+func (b *WriteBatch) validate() error {
+	decoder := encoder.NewDecoder()
+	for idx := range b.elems {
+		e := b.elems[idx]
+		if len(e.Key) == 0 {
+			return ErrKeyRequired
+		} else if len(e.Key) > MaxKeySize {
+			return ErrKeyTooLarge
+		}
+
+		// the encoded value has the header of the op kind and the expiry
+		val := decoder.Decode(e.Val)
+		if val.Kind() == encoder.OpKindRangeDelete {
+			// the value is the end key of the range
+			if len(val.Value()) == 0 {
+				return ErrKeyRequired
+			} else if len(val.Value()) > MaxKeySize {
+				return ErrKeyTooLarge
+			}
+			continue
+		}
+		if val.Kind() != encoder.OpKindDelete && len(val.Value()) == 0 {
+			return ErrValueRequired
+		} else if uint64(len(val.Value())) > MaxValueSize {
+			return ErrValueTooLarge
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,112 @@
+package lsm
+
+import (
+	"bytes"
+	"os"
+	"testing"
+)
+
+func TestWriteBatch(t *testing.T) {
+	var dir = "tmp-test-write-batch"
+	l, err := Open(dir, MemTableThreshold(1<<20))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer l.Shutdown()
+
+	for _, k := range []string{"a", "k1", "k2", "k3"} {
+		if err := l.Put([]byte(k), []byte(k)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	b := NewWriteBatch()
+	b.Put([]byte("b"), []byte("b"))
+	b.Put([]byte("k25"), []byte("k25"))
+	b.Delete([]byte("a"))
+	b.DeleteRange([]byte("k1"), []byte("k3"))
+	b.Put([]byte("k2"), []byte("new"))
+	if err := l.Write(b); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		key string
+		val string
+		ok  bool
+	}{
+		{key: "a", ok: false},
+		{key: "b", val: "b", ok: true},
+		{key: "k1", ok: false},
+		{key: "k2", val: "new", ok: true},
+		{key: "k25", ok: false},
+		{key: "k3", val: "k3", ok: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.key, func(t *testing.T) {
+			v, ok, _ := l.Get([]byte(tt.key))
+			if ok != tt.ok {
+				t.Fatalf("[ok] want %v expect %v", tt.ok, ok)
+			}
+			if ok && !bytes.Equal([]byte(tt.val), v) {
+				t.Fatalf("[val] want %s expect %s", tt.val, v)
+			}
+		})
+	}
+}
+
+func TestWriteBatchReplay(t *testing.T) {
+	var dir = "tmp-test-write-batch-replay"
+	l, err := Open(dir, MemTableThreshold(1<<20))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	b := NewWriteBatch()
+	b.Put([]byte("a"), []byte("a"))
+	b.Put([]byte("b"), []byte("b"))
+	if err := l.Write(b); err != nil {
+		t.Fatal(err)
+	}
+
+	b.Reset()
+	b.Put([]byte("c"), []byte("c"))
+	b.Put([]byte("d"), []byte("d"))
+	if err := l.Write(b); err != nil {
+		t.Fatal(err)
+	}
+	walpath := l.wal.Name()
+	l.Shutdown()
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// tear the last record
+
+	stat, err := os.Stat(walpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(walpath, stat.Size()-2); err != nil {
+		t.Fatal(err)
+	}
+
+	l, err = Open(dir, MemTableThreshold(1<<20))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Shutdown()
+
+	for _, k := range []string{"a", "b"} {
+		if _, ok, _ := l.Get([]byte(k)); !ok {
+			t.Fatalf("key %s not found", k)
+		}
+	}
+	for _, k := range []string{"c", "d"} {
+		if _, ok, _ := l.Get([]byte(k)); ok {
+			t.Fatalf("key %s of the torn batch found", k)
+		}
+	}
+}
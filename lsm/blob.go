@@ -0,0 +1,349 @@
+package lsm
+
+import (
+	"bufio"
+	"fmt"
+	"log/slog"
+	"maps"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/s-ilyin/lsm-distributed/lsm/blob"
+	"github.com/s-ilyin/lsm-distributed/lsm/encoder"
+	"github.com/s-ilyin/lsm-distributed/lsm/sst"
+)
+
+const (
+	// Default share of the oldest blob files collected by the compaction.
+	defaultBlobGCAgeCutoff = 0.25
+
+	blobDir      = "blob"
+	blobRefsFile = "blobs.db"
+)
+
+// BlobThreshold sets the size of the value starting from which the values
+// of the default column family are kept in the blob files.
+func BlobThreshold(size uint32) func(*LSMTree) {
+	return func(t *LSMTree) {
+		t.defaultFamily.config.BlobThreshold = size
+	}
+}
+
+// BlobGCAgeCutoff sets the share of the oldest blob files of the default column family
+// whose live values are relocated by the compaction.
+func BlobGCAgeCutoff(cutoff float64) func(*LSMTree) {
+	return func(t *LSMTree) {
+		t.defaultFamily.config.BlobGCAgeCutoff = cutoff
+	}
+}
+
+// readBlob returns the value the encoded pointer refers to.
+func readBlob(blobs *blob.Store, ptr []byte) ([]byte, error) {
+	p, err := blob.DecodePointer(ptr)
+	if err != nil {
+		return nil, err
+	}
+
+	return blobs.Get(p)
+}
+
+// blobRewriter separates the large values to the new blob file and relocates
+// the values of the old blob files to it, while the values are written to the SST files.
+// It implements sst.BlobValues.
+type blobRewriter struct {
+	cf        *ColumnFamily
+	threshold uint32
+	// the values of the blob files with the smaller numbers are relocated
+	gcBefore uint64
+
+	w *blob.Writer
+	// the blob files the written values refer to
+	refs map[uint64]struct{}
+}
+
+// newBlobRewriter returns the rewriter with the settings of the family.
+// Called under the lock of the tree.
+func (cf *ColumnFamily) newBlobRewriter(gcBefore uint64) *blobRewriter {
+	return &blobRewriter{
+		cf:        cf,
+		threshold: cf.config.BlobThreshold,
+		gcBefore:  gcBefore,
+		refs:      make(map[uint64]struct{}),
+	}
+}
+
+func (r *blobRewriter) Resolve(ptr []byte) ([]byte, error) {
+	return readBlob(r.cf.blobs, ptr)
+}
+
+func (r *blobRewriter) Rewrite(val []byte) ([]byte, error) {
+	if encoder.KindOf(val) != encoder.OpKindSet {
+		return val, nil
+	}
+
+	if !encoder.IsBlob(val) {
+		if r.threshold == 0 || encoder.ValueSize(val) < int(r.threshold) {
+			return val, nil
+		}
+
+		return r.add(val, r.cf.t.decoder.Decode(val).Value())
+	}
+
+	p, err := blob.DecodePointer(r.cf.t.decoder.Decode(val).Value())
+	if err != nil {
+		return nil, err
+	}
+	if p.File >= r.gcBefore {
+		r.refs[p.File] = struct{}{}
+		return val, nil
+	}
+
+	value, err := r.cf.blobs.Get(p)
+	if err != nil {
+		return nil, err
+	}
+
+	return r.add(val, value)
+}
+
+func (r *blobRewriter) add(val, value []byte) ([]byte, error) {
+	if r.w == nil {
+		// the file is not removed by the compaction until the rewriter is released
+		r.cf.gcLock.Lock()
+		w, err := r.cf.blobs.NewWriter()
+		if err == nil {
+			if r.cf.writing == nil {
+				r.cf.writing = make(map[uint64]struct{})
+			}
+			r.cf.writing[w.Number()] = struct{}{}
+		}
+		r.cf.gcLock.Unlock()
+		if err != nil {
+			return nil, err
+		}
+		r.w = w
+		r.refs[w.Number()] = struct{}{}
+	}
+
+	p, err := r.w.Add(value)
+	if err != nil {
+		return nil, err
+	}
+
+	return r.cf.t.encoder.EncodeBlob(val, p.Encode()), nil
+}
+
+// close syncs the written values to the disk.
+func (r *blobRewriter) close() error {
+	if r.w == nil {
+		return nil
+	}
+
+	return r.w.Close()
+}
+
+// release allows the compaction to remove the blob file of the rewriter
+// when no level refers to it.
+func (r *blobRewriter) release() {
+	if r.w == nil {
+		return
+	}
+
+	r.cf.gcLock.Lock()
+	delete(r.cf.writing, r.w.Number())
+	r.cf.gcLock.Unlock()
+}
+
+// blobGCBefore returns the number of the blob file, the live values of the older files
+// are relocated by the compaction, so the files can be removed.
+func (cf *ColumnFamily) blobGCBefore() (uint64, error) {
+	files, err := cf.blobs.Files()
+	if err != nil {
+		return 0, err
+	}
+
+	n := int(float64(len(files)) * cf.config.BlobGCAgeCutoff)
+	if n <= 0 {
+		return 0, nil
+	}
+	if n >= len(files) {
+		return files[len(files)-1] + 1, nil
+	}
+
+	return files[n], nil
+}
+
+// setBlobRefs records the blob files the SST files of the level refer to.
+// The refs are kept in the directory of the level, so they are replaced
+// together with the level by the compaction.
+func (cf *ColumnFamily) setBlobRefs(dir string, level sst.Level, refs map[uint64]struct{}) error {
+	if err := writeBlobRefs(dir, refs); err != nil {
+		return err
+	}
+	cf.blobRefs[level] = refs
+
+	return nil
+}
+
+// addBlobRefs adds the blob files the new file of level 0 refers to.
+// Called under the lock of the tree.
+func (cf *ColumnFamily) addBlobRefs(refs map[uint64]struct{}) error {
+	if len(refs) == 0 {
+		return nil
+	}
+
+	levelRefs := maps.Clone(cf.blobRefs[sst.BaseLevel])
+	if levelRefs == nil {
+		levelRefs = make(map[uint64]struct{})
+	}
+	maps.Copy(levelRefs, refs)
+
+	return cf.setBlobRefs(sst.PathForLevel(cf.root, sst.BaseLevel), sst.BaseLevel, levelRefs)
+}
+
+// loadBlobRefs reads the blob files the levels refer to.
+func (cf *ColumnFamily) loadBlobRefs() error {
+	cf.blobRefs = make(map[sst.Level]map[uint64]struct{})
+
+	files, err := cf.blobs.Files()
+	if err != nil || len(files) == 0 {
+		return err
+	}
+	for lvl := sst.Level(0); lvl < cf.fobserver.Levels(); lvl++ {
+		refs, err := readBlobRefs(sst.PathForLevel(cf.root, lvl))
+		if err != nil {
+			return err
+		}
+		if len(refs) > 0 {
+			cf.blobRefs[lvl] = refs
+		}
+	}
+
+	return nil
+}
+
+// retire marks the files replaced by the compaction obsolete. The blob files
+// no level refers to are removed after all obsolete files are removed,
+// as the versions still being read may refer to them.
+// Called under the lock of the tree.
+func (cf *ColumnFamily) retire(files []sst.File) error {
+	cf.gcLock.Lock()
+	blobs, err := cf.blobs.Files()
+	if err != nil {
+		cf.gcLock.Unlock()
+		return err
+	}
+	for _, num := range blobs {
+		_, live := cf.writing[num]
+		for _, refs := range cf.blobRefs {
+			if live {
+				break
+			}
+			_, live = refs[num]
+		}
+		if !live {
+			if cf.garbage == nil {
+				cf.garbage = make(map[uint64]struct{})
+			}
+			cf.garbage[num] = struct{}{}
+		}
+	}
+	cf.obsolete += len(files)
+	cf.gcLock.Unlock()
+
+	for _, f := range files {
+		f.Reader.MarkObsolete(cf.obsoleteRemoved)
+		if err := f.Reader.Unref(); err != nil {
+			return err
+		}
+	}
+
+	return cf.removeBlobs()
+}
+
+// obsoleteRemoved is called when the obsolete file is removed.
+func (cf *ColumnFamily) obsoleteRemoved() {
+	cf.gcLock.Lock()
+	cf.obsolete--
+	cf.gcLock.Unlock()
+
+	if err := cf.removeBlobs(); err != nil {
+		logger.Error(err.Error(), slog.String("family", cf.name))
+	}
+}
+
+// removeBlobs removes the blob files no level refers to
+// when no obsolete file is left.
+func (cf *ColumnFamily) removeBlobs() error {
+	cf.gcLock.Lock()
+	if cf.obsolete > 0 {
+		cf.gcLock.Unlock()
+		return nil
+	}
+	garbage := cf.garbage
+	cf.garbage = nil
+	cf.gcLock.Unlock()
+
+	for num := range garbage {
+		if err := cf.blobs.Remove(num); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func readBlobRefs(dir string) (map[uint64]struct{}, error) {
+	f, err := os.Open(path.Join(dir, blobRefsFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	refs := make(map[uint64]struct{})
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		num, err := strconv.ParseUint(strings.TrimSpace(scanner.Text()), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("malformed blob file number %q: %w", scanner.Text(), err)
+		}
+		refs[num] = struct{}{}
+	}
+
+	return refs, scanner.Err()
+}
+
+func writeBlobRefs(dir string, refs map[uint64]struct{}) error {
+	filename := path.Join(dir, blobRefsFile)
+	if len(refs) == 0 {
+		if err := os.Remove(filename); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+
+	tmp := filename + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(f)
+	for num := range refs {
+		fmt.Fprintf(w, "%d\n", num)
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, filename)
+}
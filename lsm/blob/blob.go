@@ -0,0 +1,272 @@
+package blob
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// Blob files keep the values separated from the SST files, the SST files
+// keep only the pointers to the values. The files are append-only:
+// the values are never changed, the file is removed when no SST file refers to it.
+//
+// record format: [crc32 of value][value length uvarint][value]
+// pointer format: [file number uvarint][record offset uvarint][value length uvarint]
+
+const recordHeaderSize = 4 + binary.MaxVarintLen64
+
+var (
+	// ErrCorrupted is returned when the record does not match its checksum.
+	ErrCorrupted = errors.New("blob record is corrupted")
+	// ErrPointer is returned when decoding a malformed pointer.
+	ErrPointer = errors.New("malformed blob pointer")
+)
+
+var fileName = regexp.MustCompile(`^(\d+)\.blob$`)
+
+// Pointer refers to the value in the blob file.
+type Pointer struct {
+	File   uint64
+	Offset uint64
+	Size   uint64
+}
+
+// Encode encodes the pointer, it must be compatible with DecodePointer.
+func (p Pointer) Encode() []byte {
+	buf := make([]byte, 3*binary.MaxVarintLen64)
+	n := binary.PutUvarint(buf, p.File)
+	n += binary.PutUvarint(buf[n:], p.Offset)
+	n += binary.PutUvarint(buf[n:], p.Size)
+
+	return buf[:n]
+}
+
+// DecodePointer decodes the pointer encoded by Pointer.Encode.
+func DecodePointer(buf []byte) (Pointer, error) {
+	var (
+		p   Pointer
+		n   int
+		off int
+	)
+	for _, x := range []*uint64{&p.File, &p.Offset, &p.Size} {
+		if *x, n = binary.Uvarint(buf[off:]); n <= 0 {
+			return Pointer{}, ErrPointer
+		}
+		off += n
+	}
+
+	return p, nil
+}
+
+// Store is the directory of the blob files.
+type Store struct {
+	dir string
+
+	lock  sync.Mutex
+	next  uint64
+	files map[uint64]*os.File
+}
+
+// Open opens the blob files of the directory, the directory is created by the first writer.
+func Open(dir string) (*Store, error) {
+	s := &Store{
+		dir:   dir,
+		files: make(map[uint64]*os.File),
+		next:  1,
+	}
+
+	nums, err := s.Files()
+	if err != nil {
+		return nil, err
+	}
+	if len(nums) > 0 {
+		s.next = nums[len(nums)-1] + 1
+	}
+
+	return s, nil
+}
+
+func (s *Store) filename(num uint64) string {
+	return path.Join(s.dir, fmt.Sprintf("%06d.blob", num))
+}
+
+// Path returns the name of the blob file with the number.
+func (s *Store) Path(num uint64) string {
+	return s.filename(num)
+}
+
+// Files returns the numbers of the blob files in ascending order, the older files go first.
+func (s *Store) Files() ([]uint64, error) {
+	entries, err := os.ReadDir(s.dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var nums []uint64
+	for _, e := range entries {
+		m := fileName.FindStringSubmatch(e.Name())
+		if m == nil || e.IsDir() {
+			continue
+		}
+		num, err := strconv.ParseUint(m[1], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		nums = append(nums, num)
+	}
+	sort.Slice(nums, func(i, j int) bool { return nums[i] < nums[j] })
+
+	return nums, nil
+}
+
+// Get reads the value the pointer refers to.
+func (s *Store) Get(p Pointer) ([]byte, error) {
+	f, err := s.open(p.File)
+	if err != nil {
+		return nil, err
+	}
+
+	var varint [binary.MaxVarintLen64]byte
+	header := 4 + binary.PutUvarint(varint[:], p.Size)
+
+	buf := make([]byte, header+int(p.Size))
+	if _, err := f.ReadAt(buf, int64(p.Offset)); err != nil {
+		return nil, fmt.Errorf("failed to read blob %d at %d: %w", p.File, p.Offset, err)
+	}
+
+	sum := binary.LittleEndian.Uint32(buf[:4])
+	if size, m := binary.Uvarint(buf[4:header]); m != header-4 || size != p.Size {
+		return nil, fmt.Errorf("%w: blob %d at %d", ErrCorrupted, p.File, p.Offset)
+	}
+	val := buf[header:]
+	if crc32.ChecksumIEEE(val) != sum {
+		return nil, fmt.Errorf("%w: blob %d at %d", ErrCorrupted, p.File, p.Offset)
+	}
+
+	return val, nil
+}
+
+func (s *Store) open(num uint64) (*os.File, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if f, ok := s.files[num]; ok {
+		return f, nil
+	}
+	f, err := os.Open(s.filename(num))
+	if err != nil {
+		return nil, err
+	}
+	s.files[num] = f
+
+	return f, nil
+}
+
+// Remove removes the blob file.
+func (s *Store) Remove(num uint64) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if f, ok := s.files[num]; ok {
+		f.Close()
+		delete(s.files, num)
+	}
+
+	return os.Remove(s.filename(num))
+}
+
+// Close closes the opened blob files.
+func (s *Store) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	var err error
+	for num, f := range s.files {
+		if cerr := f.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+		delete(s.files, num)
+	}
+
+	return err
+}
+
+// NewWriter creates the next blob file.
+func (s *Store) NewWriter() (*Writer, error) {
+	if err := os.MkdirAll(s.dir, os.FileMode(0700)); err != nil {
+		return nil, err
+	}
+
+	s.lock.Lock()
+	num := s.next
+	s.next++
+	s.lock.Unlock()
+
+	f, err := os.OpenFile(s.filename(num), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Writer{
+		f:   f,
+		w:   bufio.NewWriter(f),
+		num: num,
+	}, nil
+}
+
+// Writer appends the values to the blob file.
+type Writer struct {
+	f   *os.File
+	w   *bufio.Writer
+	num uint64
+	off uint64
+}
+
+// Number returns the number of the blob file.
+func (w *Writer) Number() uint64 {
+	return w.num
+}
+
+// Add appends the value and returns the pointer to it.
+func (w *Writer) Add(val []byte) (Pointer, error) {
+	var header [recordHeaderSize]byte
+	binary.LittleEndian.PutUint32(header[:4], crc32.ChecksumIEEE(val))
+	n := 4 + binary.PutUvarint(header[4:], uint64(len(val)))
+
+	if _, err := w.w.Write(header[:n]); err != nil {
+		return Pointer{}, err
+	}
+	if _, err := w.w.Write(val); err != nil {
+		return Pointer{}, err
+	}
+
+	p := Pointer{File: w.num, Offset: w.off, Size: uint64(len(val))}
+	w.off += uint64(n + len(val))
+
+	return p, nil
+}
+
+// Close syncs the values to the disk and closes the file.
+func (w *Writer) Close() error {
+	if err := w.w.Flush(); err != nil {
+		w.f.Close()
+		return err
+	}
+	if err := w.f.Sync(); err != nil {
+		w.f.Close()
+		return err
+	}
+
+	return w.f.Close()
+}
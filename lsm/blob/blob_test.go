@@ -0,0 +1,82 @@
+package blob
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"testing"
+)
+
+func TestStore(t *testing.T) {
+	var dir = "tmp-test-blob"
+	defer os.RemoveAll(dir)
+
+	s, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := s.NewWriter()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	values := [][]byte{[]byte("first"), bytes.Repeat([]byte("x"), 1<<16), []byte("last")}
+	ptrs := make([]Pointer, len(values))
+	for idx := range values {
+		if ptrs[idx], err = w.Add(values[idx]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for idx := range ptrs {
+		p, err := DecodePointer(ptrs[idx].Encode())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p != ptrs[idx] {
+			t.Fatalf("want %v expect %v", ptrs[idx], p)
+		}
+		v, err := s.Get(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(v, values[idx]) {
+			t.Fatalf("want %s expect %s", values[idx], v)
+		}
+	}
+	s.Close()
+
+	// corrupt the value of the first record
+	f, err := os.OpenFile(s.filename(ptrs[0].File), os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteAt([]byte("F"), int64(ptrs[0].Offset)+5)
+	f.Close()
+
+	s, err = Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	// the numbers of the files are not reused after reopening
+	if w, err = s.NewWriter(); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	if w.Number() != ptrs[0].File+1 {
+		t.Fatalf("want %d expect %d", ptrs[0].File+1, w.Number())
+	}
+
+	// the corrupted record is detected
+	if _, err := s.Get(ptrs[0]); !errors.Is(err, ErrCorrupted) {
+		t.Fatalf("want %v expect %v", ErrCorrupted, err)
+	}
+	if _, err := s.Get(ptrs[2]); err != nil {
+		t.Fatal(err)
+	}
+}
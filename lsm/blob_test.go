@@ -0,0 +1,106 @@
+package lsm
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	"github.com/s-ilyin/lsm-distributed/lsm/sst"
+)
+
+func TestBlobValues(t *testing.T) {
+	var dir = "tmp-test-blob-values"
+	l, err := Open(dir, MemTableThreshold(8<<20), BlobThreshold(1<<10), BlobGCAgeCutoff(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var (
+		a  = bytes.Repeat([]byte("a"), 2<<10)
+		b1 = bytes.Repeat([]byte("b"), 2<<10)
+		b2 = bytes.Repeat([]byte("c"), 3<<20)
+	)
+
+	check := func(want map[string][]byte) {
+		t.Helper()
+		for k, v := range want {
+			if got, ok, err := l.Get([]byte(k)); err != nil || !ok || !bytes.Equal(got, v) {
+				t.Fatalf("[get] want %d bytes of %s expect %d (%v)", len(v), k, len(got), err)
+			}
+		}
+
+		it, err := l.NewIterator(nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer it.Close()
+		var n int
+		for ; it.Valid(); it.Next() {
+			if !bytes.Equal(it.Value(), want[string(it.Key())]) {
+				t.Fatalf("[iterator] want %d bytes of %s expect %d", len(want[string(it.Key())]), it.Key(), len(it.Value()))
+			}
+			n++
+		}
+		if err := it.Error(); err != nil {
+			t.Fatal(err)
+		}
+		if n != len(want) {
+			t.Fatalf("[iterator] want %d keys expect %d", len(want), n)
+		}
+	}
+	blobFiles := func(want int) {
+		t.Helper()
+		files, err := l.defaultFamily.blobs.Files()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(files) != want {
+			t.Fatalf("want %d blob files expect %d", want, len(files))
+		}
+	}
+
+	l.Put([]byte("a"), a)
+	l.Put([]byte("b"), b1)
+	l.Put([]byte("s"), []byte("s"))
+	if err := l.defaultFamily.flushMemTable(); err != nil {
+		t.Fatal(err)
+	}
+	blobFiles(1)
+	check(map[string][]byte{"a": a, "b": b1, "s": []byte("s")})
+
+	// the file keeps only the pointers
+	files := l.defaultFamily.fobserver.Level(sst.BaseLevel)
+	stat, err := os.Stat(files[0].Reader.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stat.Size() > 1<<10 {
+		t.Fatalf("the values are kept in the file: %d bytes", stat.Size())
+	}
+
+	l.Put([]byte("b"), b2)
+	if err := l.defaultFamily.flushMemTable(); err != nil {
+		t.Fatal(err)
+	}
+	blobFiles(2)
+	check(map[string][]byte{"a": a, "b": b2, "s": []byte("s")})
+
+	// the live values are relocated and the old blob files are removed
+	if err := l.defaultFamily.compact(sst.BaseLevel); err != nil {
+		t.Fatal(err)
+	}
+	blobFiles(1)
+	check(map[string][]byte{"a": a, "b": b2, "s": []byte("s")})
+
+	l.Shutdown()
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	l, err = Open(dir, MemTableThreshold(8<<20), BlobThreshold(1<<10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Shutdown()
+	check(map[string][]byte{"a": a, "b": b2, "s": []byte("s")})
+}
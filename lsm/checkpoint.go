@@ -0,0 +1,263 @@
+package lsm
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"path"
+	"time"
+
+	"github.com/s-ilyin/lsm-distributed/lsm/encoder"
+	"github.com/s-ilyin/lsm-distributed/lsm/sst"
+	"github.com/s-ilyin/lsm-distributed/lsm/wal"
+)
+
+// ErrCheckpointExists is returned when the directory of the checkpoint already exists.
+var ErrCheckpointExists = errors.New("checkpoint directory already exists")
+
+// Checkpoint writes the copy of the tree to the directory, which must not exist.
+// The MemTables of the families are flushed first, the SST and the blob files are linked
+// to the copy or copied if the directory is on another file system. The copy keeps
+// the last flushed sequence number, so RestoreToPointInTime replays the archived WAL after it.
+// The copy is opened by Open as a separate tree.
+func (t *LSMTree) Checkpoint(dir string) error {
+	if _, err := os.Stat(dir); err == nil {
+		return fmt.Errorf("%w: %s", ErrCheckpointExists, dir)
+	}
+	if err := t.flushFamilies(); err != nil {
+		return err
+	}
+
+	// the copy is written aside and renamed when complete
+	tmp := dir + ".tmp"
+	if err := os.RemoveAll(tmp); err != nil {
+		return err
+	}
+
+	type familyFiles struct {
+		root     string
+		cf       *ColumnFamily
+		files    *sst.Version
+		blobRefs map[sst.Level]map[uint64]struct{}
+	}
+	var families []familyFiles
+	defer func() {
+		for _, f := range families {
+			if err := f.files.Release(); err != nil {
+				logger.Error(err.Error())
+			}
+		}
+	}()
+
+	// the files of the levels are taken together with the flushed sequence number,
+	// the taken files are not removed by the compaction until they are released
+	t.lock.RLock()
+	for _, cf := range t.families {
+		root := tmp
+		if cf != t.defaultFamily {
+			root = path.Join(tmp, familiesDir, cf.name)
+		}
+		families = append(families, familyFiles{
+			root:     root,
+			cf:       cf,
+			files:    cf.fobserver.Version(),
+			blobRefs: maps.Clone(cf.blobRefs),
+		})
+	}
+	_, err := t.wal.Checkpoint(tmp)
+	t.lock.RUnlock()
+	if err != nil {
+		return fmt.Errorf("failed to write the WAL index: %w", err)
+	}
+
+	for _, name := range []string{keyFormatFile, comparatorFile, familiesFile} {
+		if err := linkFile(path.Join(t.root, name), path.Join(tmp, name)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	for _, f := range families {
+		for _, file := range f.files.Files() {
+			name := file.Reader.Name()
+			level := path.Join(f.root, path.Base(path.Dir(name)))
+			if err := os.MkdirAll(level, os.FileMode(0700)); err != nil {
+				return err
+			}
+			if err := linkFile(name, path.Join(level, path.Base(name))); err != nil {
+				return err
+			}
+		}
+
+		blobs := path.Join(f.root, blobDir)
+		for lvl, refs := range f.blobRefs {
+			level := sst.PathForLevel(f.root, lvl)
+			if err := os.MkdirAll(level, os.FileMode(0700)); err != nil {
+				return err
+			}
+			if err := writeBlobRefs(level, refs); err != nil {
+				return err
+			}
+			if err := os.MkdirAll(blobs, os.FileMode(0700)); err != nil {
+				return err
+			}
+			for num := range refs {
+				name := f.cf.blobs.Path(num)
+				if err := linkFile(name, path.Join(blobs, path.Base(name))); err != nil && !os.IsExist(err) {
+					return err
+				}
+			}
+		}
+	}
+
+	return os.Rename(tmp, dir)
+}
+
+// linkFile links the immutable file to the new name or copies it
+// if the names are on different file systems.
+func linkFile(src, dst string) error {
+	err := os.Link(src, dst)
+	if err == nil || os.IsNotExist(err) || os.IsExist(err) {
+		return err
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+
+	return out.Close()
+}
+
+// flushFamilies flushes the MemTables of all families.
+func (t *LSMTree) flushFamilies() error {
+	t.lock.RLock()
+	families := make([]*ColumnFamily, 0, len(t.families))
+	for _, cf := range t.families {
+		families = append(families, cf)
+	}
+	t.lock.RUnlock()
+
+	for _, cf := range families {
+		if err := cf.flushMemTable(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// RestoreTarget is the point in time the tree is restored to.
+type RestoreTarget struct {
+	// The last sequence number of the restored writes, zero for no limit.
+	Sequence uint64
+	// The time of the last restored write, zero for no limit.
+	Time time.Time
+}
+
+// TargetSequence restores the writes up to the sequence number.
+func TargetSequence(seq uint64) RestoreTarget {
+	return RestoreTarget{Sequence: seq}
+}
+
+// TargetTime restores the writes done not after the time.
+func TargetTime(tm time.Time) RestoreTarget {
+	return RestoreTarget{Time: tm}
+}
+
+// after reports whether the batch is written after the target.
+func (rt RestoreTarget) after(b wal.Batch) bool {
+	if rt.Sequence != 0 && b.Seq+uint64(len(b.Elems)) > rt.Sequence+1 {
+		return true
+	}
+
+	return !rt.Time.IsZero() && b.Time > rt.Time.UnixNano()
+}
+
+// RestoreToPointInTime restores the checkpoint in backupDir to the target by replaying
+// the batches of the WAL segments archived in archiveDir (see WALArchive) written after
+// the checkpoint. The checkpoint is restored in place, so it has to be copied to be restored
+// again. The batches are replayed in the order they were written up to the first batch after
+// the target and flushed, the zero target replays all archived batches. The options are
+// the options of Open, the checkpoint must be opened with the comparator of the tree.
+// The column families created after the checkpoint are not restored, the batches
+// updating them fail the restore with ErrUnknownColumnFamily.
+// Returns the last sequence number of the restored tree.
+func RestoreToPointInTime(backupDir, archiveDir string, target RestoreTarget, options ...func(*LSMTree)) (uint64, error) {
+	if _, err := os.Stat(backupDir); err != nil {
+		return 0, err
+	}
+
+	t, err := Open(backupDir, options...)
+	if err != nil {
+		return 0, err
+	}
+
+	flushed := t.wal.Flushed()
+	err = wal.ReplayArchive(archiveDir, flushed+1, func(b wal.Batch) (bool, error) {
+		if target.after(b) {
+			return false, nil
+		}
+
+		return true, t.restore(b, flushed)
+	})
+	if err == nil {
+		err = t.flushFamilies()
+	}
+	seq := t.wal.Sequence()
+
+	t.Shutdown()
+	if cerr := t.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to restore %s: %w", backupDir, err)
+	}
+
+	return seq, nil
+}
+
+// restore appends the archived batch to the WAL and applies its entries
+// after the flushed sequence number with their sequence numbers.
+func (t *LSMTree) restore(b wal.Batch, flushed uint64) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	for idx := range b.Elems {
+		if _, ok := t.families[b.Elems[idx].Family]; !ok {
+			return ErrUnknownColumnFamily
+		}
+	}
+	if _, err := t.makeRoom(b.Elems); err != nil {
+		return err
+	}
+	if err := t.wal.AppendGroup([]wal.Batch{b}, false); err != nil {
+		return err
+	}
+
+	for idx := range b.Elems {
+		seq := b.Seq + uint64(idx)
+		if seq <= flushed {
+			continue
+		}
+		kind := encoder.KindOf(b.Elems[idx].Val)
+		t.families[b.Elems[idx].Family].mem.Put(encoder.MakeInternalKey(b.Elems[idx].Key, seq, kind), b.Elems[idx].Val)
+	}
+	t.wal.SetSequence(b.Seq + uint64(len(b.Elems)) - 1)
+
+	return nil
+}
@@ -0,0 +1,105 @@
+package lsm
+
+import (
+	"errors"
+	"os"
+	"path"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRestoreToPointInTime(t *testing.T) {
+	var (
+		dir     = "tmp-test-restore"
+		archive = path.Join(dir, "wal", "archive")
+		backups = []string{dir + "-seq", dir + "-time", dir + "-all"}
+	)
+	l, err := Open(dir, MemTableThreshold(1<<20), WALArchive("", 0, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, backup := range backups {
+		defer os.RemoveAll(backup)
+	}
+
+	l.Put([]byte("a"), []byte("a"))
+	l.Put([]byte("b"), []byte("b"))
+	for _, backup := range backups {
+		if err := l.Checkpoint(backup); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := l.Checkpoint(backups[0]); !errors.Is(err, ErrCheckpointExists) {
+		t.Fatalf("want %v expect %v", ErrCheckpointExists, err)
+	}
+
+	l.Put([]byte("c"), []byte("c"))
+	seq := l.wal.Sequence()
+	time.Sleep(10 * time.Millisecond)
+	moment := time.Now()
+	time.Sleep(10 * time.Millisecond)
+	l.Put([]byte("d"), []byte("d"))
+	// the segment of c and d is archived when the next one is started
+	if err := l.Flush(true); err != nil {
+		t.Fatal(err)
+	}
+	l.Put([]byte("e"), []byte("e"))
+	l.Shutdown()
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if segments, _ := filepath.Glob(path.Join(archive, "*.log")); len(segments) == 0 {
+		t.Fatalf("the segments are not archived")
+	}
+
+	for idx, target := range []RestoreTarget{TargetSequence(seq), TargetTime(moment), {}} {
+		restored, err := RestoreToPointInTime(backups[idx], archive, target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the last write is not archived yet
+		want := map[string]bool{"a": true, "b": true, "c": true, "d": idx == 2, "e": false}
+		if idx < 2 && restored != seq {
+			t.Fatalf("want %d expect %d", seq, restored)
+		}
+
+		r, err := Open(backups[idx])
+		if err != nil {
+			t.Fatal(err)
+		}
+		for key, ok := range want {
+			if _, found, _ := r.Get([]byte(key)); found != ok {
+				t.Fatalf("%s: want %s %v expect %v", backups[idx], key, ok, found)
+			}
+		}
+		r.Shutdown()
+		r.Close()
+	}
+}
+
+func TestWALArchiveLimit(t *testing.T) {
+	var dir = "tmp-test-wal-archive-limit"
+	l, err := Open(dir, MemTableThreshold(1<<20), WALArchive("", 0, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer l.Shutdown()
+
+	l.Put([]byte("a"), []byte("a"))
+	if err := l.Flush(true); err != nil {
+		t.Fatal(err)
+	}
+	l.Put([]byte("b"), []byte("b"))
+
+	// the archived segment is larger than the limit
+	if segments, _ := filepath.Glob(path.Join(l.wal.ArchivePath(), "*.log")); len(segments) != 0 {
+		t.Fatalf("want no archived segments expect %v", segments)
+	}
+	if _, err := os.Stat(l.wal.ArchivePath()); err != nil {
+		t.Fatal(err)
+	}
+}
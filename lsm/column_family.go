@@ -0,0 +1,333 @@
+package lsm
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/s-ilyin/lsm-distributed/lsm/blob"
+	"github.com/s-ilyin/lsm-distributed/lsm/memtable"
+	"github.com/s-ilyin/lsm-distributed/lsm/sst"
+)
+
+const (
+	// DefaultColumnFamily is the name of the family used by the methods of the tree.
+	DefaultColumnFamily = "default"
+
+	familiesDir  = "families"
+	familiesFile = "families.db"
+)
+
+var (
+	// ErrColumnFamilyName is returned when creating a column family with an invalid name.
+	ErrColumnFamilyName = errors.New("invalid column family name")
+	// ErrColumnFamilyExists is returned when creating a column family with the name of an existing one.
+	ErrColumnFamilyExists = errors.New("column family already exists")
+	// ErrUnknownColumnFamily is returned when writing to a column family not of the tree.
+	ErrUnknownColumnFamily = errors.New("unknown column family")
+)
+
+// ColumnFamily is a logical dataset of the tree with its own MemTable,
+// levels of SST files and settings. All families share the WAL of the tree,
+// so a WriteBatch can update several families atomically.
+type ColumnFamily struct {
+	t    *LSMTree
+	id   uint32
+	name string
+	// Каталог уровней SST-файлов семейства.
+	root string
+
+	mem       *memtable.Memtable
+	fobserver *sst.ObserverFiles
+	config    *Config
+	// Запускает проверку уровней без ожидания интервала слияния.
+	cMerge chan struct{}
+	// Число завершенных уплотнений и ошибка последнего из них,
+	// с которой завершаются остановленные до уплотнения записи.
+	compactions uint64
+	compactErr  error
+	// Оценка размера файлов, ожидающих уплотнения, пересчитывается при установке версии.
+	pendingBytes uint64
+	// Уплотнения семейства выполняются по одному, так как пишут в общий каталог слияния.
+	compactLock sync.Mutex
+
+	// Неизменяемые MemTable от новой к старой, которые ждут сброса на диск,
+	// и текущая версия семейства, которую читатели берут вместо обращения
+	// к MemTable и уровням напрямую.
+	imm       []*memtable.Memtable
+	flushLock sync.Mutex
+	vlock     sync.Mutex
+	current   *version
+
+	// Blob-файлы больших значений и blob-файлы, на которые ссылаются уровни.
+	blobs    *blob.Store
+	blobRefs map[sst.Level]map[uint64]struct{}
+
+	// Blob-файлы, на которые ссылаются только замененные уплотнением файлы,
+	// удаляются после того, как все замененные файлы будут удалены.
+	// Записываемые сбросом blob-файлы не удаляются до его завершения.
+	gcLock   sync.Mutex
+	obsolete int
+	garbage  map[uint64]struct{}
+	writing  map[uint64]struct{}
+}
+
+func (t *LSMTree) newColumnFamily(id uint32, name, root string, config *Config) (*ColumnFamily, error) {
+	cf := &ColumnFamily{
+		t:      t,
+		id:     id,
+		name:   name,
+		root:   root,
+		config: config,
+	}
+	if err := cf.open(); err != nil {
+		return nil, err
+	}
+
+	return cf, nil
+}
+
+// open creates the directory of the family and loads its files.
+func (cf *ColumnFamily) open() error {
+	if _, err := os.Stat(cf.root); os.IsNotExist(err) {
+		if err := os.MkdirAll(cf.root, os.FileMode(0700)); err != nil {
+			return err
+		}
+	}
+
+	observer, err := sst.NewFilesObserver(cf.root, cf.t.readerOptions()...)
+	if err != nil {
+		return fmt.Errorf("file observer %s", err)
+	}
+	cf.t.wal.SetSequence(observer.MaxSequence())
+
+	cf.fobserver = observer
+	cf.cMerge = make(chan struct{}, 1)
+	cf.mem = memtable.NewMem(memtable.Comparator(cf.t.cmp))
+
+	if cf.blobs, err = blob.Open(path.Join(cf.root, blobDir)); err != nil {
+		return fmt.Errorf("blob files %s", err)
+	}
+	if err := cf.loadBlobRefs(); err != nil {
+		return err
+	}
+	cf.install()
+
+	return nil
+}
+
+// scheduleMerge wakes up the merge job of the family.
+func (cf *ColumnFamily) scheduleMerge() {
+	select {
+	case cf.cMerge <- struct{}{}:
+	default:
+	}
+}
+
+// Name returns the name of the column family.
+func (cf *ColumnFamily) Name() string {
+	return cf.name
+}
+
+// Get the value for the key from the column family.
+func (cf *ColumnFamily) Get(key []byte, options ...ReadOption) ([]byte, bool, error) {
+	return cf.get(key, cf.t.readSequence(options))
+}
+
+// Put puts the key into the column family.
+func (cf *ColumnFamily) Put(key, value []byte, options ...WriteOptions) error {
+	b := NewWriteBatch()
+	b.PutCF(cf, key, value)
+
+	return cf.t.Write(b, options...)
+}
+
+// Delete deletes the key from the column family.
+func (cf *ColumnFamily) Delete(key []byte, options ...WriteOptions) error {
+	b := NewWriteBatch()
+	b.DeleteCF(cf, key)
+
+	return cf.t.Write(b, options...)
+}
+
+// Flush makes the MemTable of the column family immutable and schedules its flush,
+// it waits for the flush of all immutable MemTables if wait is set.
+func (cf *ColumnFamily) Flush(wait bool) error {
+	if wait {
+		return cf.flushMemTable()
+	}
+
+	cf.t.lock.Lock()
+	cf.switchMemTable()
+	cf.t.lock.Unlock()
+
+	return nil
+}
+
+// CreateColumnFamily creates the column family with its own settings, the files of the family
+// are kept in a separate directory under the root of the tree. The families are restored
+// by Open with their settings, the existing family is returned by GetColumnFamily.
+func (t *LSMTree) CreateColumnFamily(name string, config Config) (*ColumnFamily, error) {
+	if name == "" || strings.ContainsAny(name, "/\\ \t\r\n") || name == "." || name == ".." {
+		return nil, ErrColumnFamilyName
+	}
+
+	defaults := defaultMergeConfig()
+	if config.MemtblDataSize == 0 {
+		config.MemtblDataSize = defaults.MemtblDataSize
+	}
+	if config.Merge == (MergeSettings{}) {
+		config.Merge = defaults.Merge
+	}
+	if config.BlobGCAgeCutoff == 0 {
+		config.BlobGCAgeCutoff = defaults.BlobGCAgeCutoff
+	}
+	if config.MaxWriteBufferNumber == 0 {
+		config.MaxWriteBufferNumber = defaults.MaxWriteBufferNumber
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.familyByName(name) != nil {
+		return nil, fmt.Errorf("%w: %s", ErrColumnFamilyExists, name)
+	}
+
+	var id uint32
+	for fid := range t.families {
+		if fid >= id {
+			id = fid + 1
+		}
+	}
+
+	cf, err := t.newColumnFamily(id, name, path.Join(t.root, familiesDir, name), &config)
+	if err != nil {
+		return nil, err
+	}
+	t.families[id] = cf
+	if err := t.saveFamilies(); err != nil {
+		delete(t.families, id)
+		return nil, fmt.Errorf("failed to save column families: %w", err)
+	}
+
+	t.wg.Add(1)
+	go cf.mergeJob()
+
+	return cf, nil
+}
+
+// GetColumnFamily returns the column family by the name.
+func (t *LSMTree) GetColumnFamily(name string) (*ColumnFamily, bool) {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	cf := t.familyByName(name)
+
+	return cf, cf != nil
+}
+
+func (t *LSMTree) familyByName(name string) *ColumnFamily {
+	for _, cf := range t.families {
+		if cf.name == name {
+			return cf
+		}
+	}
+
+	return nil
+}
+
+// saveFamilies writes the ids, the names and the settings of the families except the default one.
+func (t *LSMTree) saveFamilies() error {
+	filename := path.Join(t.root, familiesFile)
+	tmp := filename + ".tmp"
+
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(f)
+	for id, cf := range t.families {
+		if cf == t.defaultFamily {
+			continue
+		}
+		config, err := json.Marshal(cf.config)
+		if err != nil {
+			f.Close()
+			return err
+		}
+		fmt.Fprintf(w, "%d %s %s\n", id, cf.name, config)
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, filename)
+}
+
+// loadFamilies restores the families created before with their settings,
+// the families saved without the settings get the default ones.
+func (t *LSMTree) loadFamilies() error {
+	f, err := os.Open(path.Join(t.root, familiesFile))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.SplitN(scanner.Text(), " ", 3)
+		if len(fields) < 2 {
+			return fmt.Errorf("malformed column family %q", scanner.Text())
+		}
+		id, err := strconv.ParseUint(fields[0], 10, 32)
+		if err != nil {
+			return fmt.Errorf("malformed column family id %q: %w", fields[0], err)
+		}
+
+		config := defaultMergeConfig()
+		if len(fields) == 3 {
+			config = &Config{}
+			if err := json.Unmarshal([]byte(fields[2]), config); err != nil {
+				return fmt.Errorf("malformed column family settings %q: %w", fields[2], err)
+			}
+		}
+
+		name := fields[1]
+		cf, err := t.newColumnFamily(uint32(id), name, path.Join(t.root, familiesDir, name), config)
+		if err != nil {
+			return err
+		}
+		t.families[uint32(id)] = cf
+	}
+
+	return scanner.Err()
+}
+
+// flushedSequence returns the last sequence number persisted by all families
+// after the entries up to seq were flushed: the entries still in the MemTables
+// of the families are not persisted.
+func (t *LSMTree) flushedSequence(seq uint64) uint64 {
+	for _, cf := range t.families {
+		for _, mem := range append([]*memtable.Memtable{cf.mem}, cf.imm...) {
+			if min := mem.MinSequence(); min != 0 && min <= seq {
+				seq = min - 1
+			}
+		}
+	}
+
+	return seq
+}
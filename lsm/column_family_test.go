@@ -0,0 +1,126 @@
+package lsm
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"testing"
+)
+
+func TestColumnFamily(t *testing.T) {
+	var dir = "tmp-test-column-family"
+	l, err := Open(dir, MemTableThreshold(1<<20))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if _, err := l.CreateColumnFamily("a/b", Config{}); !errors.Is(err, ErrColumnFamilyName) {
+		t.Fatalf("want %v expect %v", ErrColumnFamilyName, err)
+	}
+	hot, err := l.CreateColumnFamily("hot", Config{MemtblDataSize: 1 << 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cold, err := l.CreateColumnFamily("cold", Config{MemtblDataSize: 1 << 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hot.config.MemtblDataSize == cold.config.MemtblDataSize {
+		t.Fatalf("families share the settings")
+	}
+	if _, err := l.CreateColumnFamily("hot", Config{MemtblDataSize: 1 << 20}); !errors.Is(err, ErrColumnFamilyExists) {
+		t.Fatalf("want %v expect %v", ErrColumnFamilyExists, err)
+	}
+
+	// the families are isolated
+	l.Put([]byte("k"), []byte("default"))
+	hot.Put([]byte("k"), []byte("hot"))
+	if _, ok, _ := cold.Get([]byte("k")); ok {
+		t.Fatalf("key of another family found")
+	}
+	if v, _, _ := hot.Get([]byte("k")); !bytes.Equal(v, []byte("hot")) {
+		t.Fatalf("want %s expect %s", "hot", v)
+	}
+	if v, _, _ := l.Get([]byte("k")); !bytes.Equal(v, []byte("default")) {
+		t.Fatalf("want %s expect %s", "default", v)
+	}
+
+	// the batch spans the families
+	b := NewWriteBatch()
+	b.Put([]byte("x"), []byte("1"))
+	b.PutCF(hot, []byte("x"), []byte("2"))
+	b.PutCF(cold, []byte("x"), []byte("3"))
+	b.DeleteCF(hot, []byte("k"))
+	if err := l.Write(b); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		get  func([]byte, ...ReadOption) ([]byte, bool, error)
+		want string
+	}{{l.Get, "1"}, {hot.Get, "2"}, {cold.Get, "3"}} {
+		if v, _, _ := c.get([]byte("x")); !bytes.Equal(v, []byte(c.want)) {
+			t.Fatalf("want %s expect %s", c.want, v)
+		}
+	}
+	if _, ok, _ := hot.Get([]byte("k")); ok {
+		t.Fatalf("deleted key found")
+	}
+
+	// the files of the family are kept apart
+	if err := cold.flushMemTable(); err != nil {
+		t.Fatal(err)
+	}
+	if cold.fobserver.MaxSequence() == 0 || l.defaultFamily.fobserver.MaxSequence() != 0 {
+		t.Fatalf("the flush is not limited by the family")
+	}
+	cold.Put([]byte("y"), []byte("4"))
+
+	it, err := cold.NewIterator(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got string
+	for ; it.Valid(); it.Next() {
+		got += string(it.Key()) + string(it.Value())
+	}
+	it.Close()
+	if got != "x3y4" {
+		t.Fatalf("want %s expect %s", "x3y4", got)
+	}
+
+	// the families and the data are restored from the shared WAL
+	l.Shutdown()
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	l, err = Open(dir, MemTableThreshold(1<<20))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Shutdown()
+
+	hot, ok := l.GetColumnFamily("hot")
+	if !ok {
+		t.Fatalf("column family %s not found", "hot")
+	}
+	cold, ok = l.GetColumnFamily("cold")
+	if !ok {
+		t.Fatalf("column family %s not found", "cold")
+	}
+	if hot.config.MemtblDataSize != 1<<10 || cold.config.MemtblDataSize != 1<<20 {
+		t.Fatalf("want %d, %d expect %d, %d", 1<<10, 1<<20, hot.config.MemtblDataSize, cold.config.MemtblDataSize)
+	}
+	if hot.config.Merge != defaultMergeConfig().Merge {
+		t.Fatalf("want %v expect %v", defaultMergeConfig().Merge, hot.config.Merge)
+	}
+	for _, c := range []struct {
+		cf   *ColumnFamily
+		key  string
+		want string
+	}{{l.defaultFamily, "k", "default"}, {hot, "x", "2"}, {cold, "x", "3"}, {cold, "y", "4"}} {
+		if v, _, _ := c.cf.Get([]byte(c.key)); !bytes.Equal(v, []byte(c.want)) {
+			t.Fatalf("want %s expect %s", c.want, v)
+		}
+	}
+}
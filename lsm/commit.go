@@ -0,0 +1,189 @@
+package lsm
+
+import (
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/s-ilyin/lsm-distributed/lsm/encoder"
+	"github.com/s-ilyin/lsm-distributed/lsm/wal"
+)
+
+// Maximum size of the keys and the values the leader commits for the writers queued behind it.
+const maxGroupSize = 1 << 20
+
+// ErrSyncWithoutWAL is returned when the write is asked to be synced without the WAL.
+var ErrSyncWithoutWAL = errors.New("sync write requires the WAL")
+
+// WriteOptions are the durability options of the write.
+type WriteOptions struct {
+	// The write returns after the WAL file is synced to the disk.
+	Sync bool
+	// The write is not appended to the WAL, so it is lost on the crash
+	// until the MemTable is flushed.
+	DisableWAL bool
+}
+
+// mergeWriteOptions combines the options passed to the write.
+func mergeWriteOptions(options []WriteOptions) WriteOptions {
+	var wo WriteOptions
+	for _, opt := range options {
+		wo.Sync = wo.Sync || opt.Sync
+		wo.DisableWAL = wo.DisableWAL || opt.DisableWAL
+	}
+
+	return wo
+}
+
+// writer is the write queued for the group commit. The first writer of the queue
+// is the leader: it appends its batch and the batches of the writers queued behind it
+// to the WAL with one write and one sync, applies them to the MemTables and wakes up
+// the followers with their results.
+type writer struct {
+	elems []wal.Entry
+	// called by the leader under the lock of the tree before the batch is applied,
+	// the batch is not applied on error. The writer with the check is not grouped
+	// behind the other writers, so the check sees their batches applied
+	check   func() error
+	options WriteOptions
+
+	// the sequence number of the first entry of the batch
+	seq  uint64
+	err  error
+	done bool
+	cond *sync.Cond
+}
+
+// group returns the leader and the writers queued behind it to be committed together.
+// Called under the lock of the tree by the leader.
+func (t *LSMTree) group() []*writer {
+	var (
+		group []*writer
+		size  int
+	)
+	for _, w := range t.writers {
+		if len(group) > 0 && w.check != nil {
+			break
+		}
+		for idx := range w.elems {
+			size += len(w.elems[idx].Key) + len(w.elems[idx].Val)
+		}
+		if len(group) > 0 && size > maxGroupSize {
+			break
+		}
+		group = append(group, w)
+	}
+
+	return group
+}
+
+// commit appends the batches of the group to the WAL and applies them to the MemTables.
+// The lock is released while the WAL is written, the writers queued in the meantime
+// wait for the next leader. Called under the lock of the tree by the leader.
+func (t *LSMTree) commit(group []*writer) {
+	var (
+		applied []*writer
+		batches []wal.Batch
+		sync    bool
+		seq     = t.wal.Sequence() + 1
+	)
+	for _, w := range group {
+		if w.check != nil {
+			if w.err = w.check(); w.err != nil {
+				continue
+			}
+		}
+		if len(w.elems) == 0 {
+			continue
+		}
+
+		w.seq = seq
+		seq += uint64(len(w.elems))
+		applied = append(applied, w)
+		if !w.options.DisableWAL {
+			batches = append(batches, wal.Batch{Seq: w.seq, Elems: w.elems})
+			sync = sync || w.options.Sync
+		}
+	}
+	if len(applied) == 0 {
+		t.finish(group)
+		return
+	}
+
+	if len(batches) > 0 {
+		// the other writers wait in the queue, so the sequence numbers are not taken
+		t.lock.Unlock()
+		err := t.wal.AppendGroup(batches, sync)
+		t.lock.Lock()
+		if err != nil {
+			for _, w := range applied {
+				w.err = err
+			}
+			t.finish(group)
+			return
+		}
+	}
+
+	for _, w := range applied {
+		for idx := range w.elems {
+			kind := encoder.KindOf(w.elems[idx].Val)
+			t.families[w.elems[idx].Family].mem.Put(encoder.MakeInternalKey(w.elems[idx].Key, w.seq+uint64(idx), kind), w.elems[idx].Val)
+		}
+	}
+	t.wal.SetSequence(seq - 1)
+	for _, w := range applied {
+		for idx := range w.elems {
+			if cf := t.families[w.elems[idx].Family]; cf.full() && cf.hasRoom() {
+				cf.switchMemTable()
+			}
+		}
+	}
+	t.finish(group)
+}
+
+// finish removes the group from the queue, wakes up the followers with their results
+// and the next leader. Called under the lock of the tree by the leader.
+func (t *LSMTree) finish(group []*writer) {
+	n := copy(t.writers, t.writers[len(group):])
+	clear(t.writers[n:])
+	t.writers = t.writers[:n]
+
+	for _, w := range group {
+		w.done = true
+		w.cond.Signal()
+	}
+	if len(t.writers) > 0 {
+		t.writers[0].cond.Signal()
+	}
+}
+
+// SyncWAL syncs the WAL file to the disk, so the writes returned before it
+// survive the crash of the machine.
+func (t *LSMTree) SyncWAL() error {
+	return t.wal.Sync()
+}
+
+// RecoveryStats returns the damaged WAL records dropped when the tree was opened.
+func (t *LSMTree) RecoveryStats() wal.RecoveryStats {
+	return t.recovery
+}
+
+// walSyncJob syncs the WAL file to the disk with the interval.
+func (t *LSMTree) walSyncJob(interval time.Duration) {
+	defer t.wg.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := t.wal.Sync(); err != nil {
+				logger.Error(err.Error(), slog.String("call", "wal sync job"))
+			}
+
+		case <-t.ctx.Done():
+			return
+		}
+	}
+}
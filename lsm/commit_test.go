@@ -0,0 +1,146 @@
+package lsm
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/s-ilyin/lsm-distributed/lsm/sst"
+)
+
+func TestGroupCommit(t *testing.T) {
+	var dir = "tmp-test-group-commit"
+	l, err := Open(dir, MemTableThreshold(1<<20), WALSync(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	const writers, n = 8, 100
+	key := func(w, i int) []byte { return []byte(fmt.Sprintf("w%d-%03d", w, i)) }
+
+	var wg sync.WaitGroup
+	errs := make(chan error, writers)
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			b := NewWriteBatch()
+			for i := 0; i < n; i++ {
+				// the batch is reused, since the write returns after the commit
+				b.Reset()
+				b.Put(key(w, i), key(w, i))
+				if err := l.Write(b); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+	if seq := l.wal.Sequence(); seq != writers*n {
+		t.Fatalf("want sequence %d expect %d", writers*n, seq)
+	}
+
+	// every committed write is in the WAL
+	l.Shutdown()
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if l, err = Open(dir, MemTableThreshold(1<<20)); err != nil {
+		t.Fatal(err)
+	}
+	defer l.Shutdown()
+
+	for w := 0; w < writers; w++ {
+		for i := 0; i < n; i++ {
+			if v, ok, _ := l.Get(key(w, i)); !ok || !bytes.Equal(v, key(w, i)) {
+				t.Fatalf("want %s expect %s", key(w, i), v)
+			}
+		}
+	}
+}
+
+func TestWriteOptions(t *testing.T) {
+	var dir = "tmp-test-write-options"
+	l, err := Open(dir, MemTableThreshold(1<<20), WALSyncInterval(time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := l.Put([]byte("a"), []byte("a"), WriteOptions{Sync: true, DisableWAL: true}); err != ErrSyncWithoutWAL {
+		t.Fatalf("want %v expect %v", ErrSyncWithoutWAL, err)
+	}
+	if err := l.Put([]byte("a"), []byte("a"), WriteOptions{Sync: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Put([]byte("b"), []byte("b"), WriteOptions{DisableWAL: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Put([]byte("c"), []byte("c")); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.SyncWAL(); err != nil {
+		t.Fatal(err)
+	}
+	if v, ok, _ := l.Get([]byte("b")); !ok || string(v) != "b" {
+		t.Fatalf("want %s expect %s", "b", v)
+	}
+
+	reopen := func() {
+		l.Shutdown()
+		if err := l.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if l, err = Open(dir, MemTableThreshold(1<<20)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the write without the WAL is lost until the MemTable is flushed
+	reopen()
+	for _, tt := range []struct {
+		key string
+		ok  bool
+	}{{"a", true}, {"b", false}, {"c", true}} {
+		if _, ok, _ := l.Get([]byte(tt.key)); ok != tt.ok {
+			t.Fatalf("key %s: want %v expect %v", tt.key, tt.ok, ok)
+		}
+	}
+
+	if err := l.Put([]byte("b"), []byte("b"), WriteOptions{DisableWAL: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Flush(true); err != nil {
+		t.Fatal(err)
+	}
+	if n := l.defaultFamily.fobserver.Len(sst.BaseLevel); n != 1 {
+		t.Fatalf("want %d files expect %d", 1, n)
+	}
+	reopen()
+	defer l.Shutdown()
+	if v, ok, _ := l.Get([]byte("b")); !ok || string(v) != "b" {
+		t.Fatalf("want %s expect %s", "b", v)
+	}
+
+	// the flush without waiting is done by the flush job
+	l.Put([]byte("d"), []byte("d"))
+	if err := l.Flush(false); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for l.defaultFamily.fobserver.Len(sst.BaseLevel) != 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("the MemTable is not flushed")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
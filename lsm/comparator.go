@@ -0,0 +1,66 @@
+package lsm
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+
+	"github.com/s-ilyin/lsm-distributed/lsm/encoder"
+)
+
+const comparatorFile = "comparator.db"
+
+// ErrComparatorMismatch is returned when opening the tree with a comparator
+// other than the one the tree was created with.
+var ErrComparatorMismatch = errors.New("comparator mismatch")
+
+// Comparator defines the order of the keys of the tree.
+type Comparator = encoder.Comparator
+
+// KeyComparator sets the order of the keys of the tree, the keys are ordered
+// by bytes.Compare by default. The name of the comparator is recorded
+// with the tree, the tree can't be opened with a comparator of another name.
+func KeyComparator(cmp Comparator) func(*LSMTree) {
+	return func(t *LSMTree) {
+		t.cmp = cmp
+	}
+}
+
+// checkComparator compares the comparator of the tree with the recorded one
+// and records the comparator of the new tree.
+func (t *LSMTree) checkComparator() error {
+	filename := path.Join(t.root, comparatorFile)
+
+	name, err := os.ReadFile(filename)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if os.IsNotExist(err) {
+		// the trees written before the comparator was recorded are ordered bytewise
+		empty, err := t.wal.Empty()
+		if err != nil {
+			return err
+		}
+		if t.wal.Sequence() != 0 || !empty {
+			name = []byte(encoder.BytewiseComparator.Name())
+		} else {
+			name = []byte(t.cmp.Name())
+		}
+		if string(name) == t.cmp.Name() {
+			tmp := filename + ".tmp"
+			if err := os.WriteFile(tmp, name, 0600); err != nil {
+				return err
+			}
+			if err := os.Rename(tmp, filename); err != nil {
+				return err
+			}
+		}
+	}
+
+	if string(name) != t.cmp.Name() {
+		return fmt.Errorf("%w: the tree is ordered by %s, not %s", ErrComparatorMismatch, name, t.cmp.Name())
+	}
+
+	return nil
+}
@@ -0,0 +1,92 @@
+package lsm
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/s-ilyin/lsm-distributed/lsm/sst"
+)
+
+type reverseComparator struct{}
+
+func (reverseComparator) Compare(a, b []byte) int { return bytes.Compare(b, a) }
+func (reverseComparator) Name() string            { return "test.ReverseComparator" }
+
+func TestKeyComparator(t *testing.T) {
+	var dir = "tmp-test-key-comparator"
+	l, err := Open(dir, MemTableThreshold(1<<20), KeyComparator(reverseComparator{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	check := func(want string) {
+		t.Helper()
+		it, err := l.NewIterator(nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer it.Close()
+
+		var got string
+		for ; it.Valid(); it.Next() {
+			got += string(it.Key())
+		}
+		if got != want {
+			t.Fatalf("want %s expect %s", want, got)
+		}
+	}
+
+	for _, k := range []string{"a", "c", "e"} {
+		l.Put([]byte(k), []byte(k))
+	}
+	if err := l.defaultFamily.flushMemTable(); err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []string{"b", "d", "f"} {
+		l.Put([]byte(k), []byte(k))
+	}
+	if err := l.defaultFamily.flushMemTable(); err != nil {
+		t.Fatal(err)
+	}
+	l.Put([]byte("g"), []byte("g"))
+	check("gfedcba")
+
+	// the range is ordered by the comparator too
+	if err := l.DeleteRange([]byte("e"), []byte("b")); err != nil {
+		t.Fatal(err)
+	}
+	check("gfba")
+
+	if err := l.defaultFamily.flushMemTable(); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.defaultFamily.compact(sst.BaseLevel); err != nil {
+		t.Fatal(err)
+	}
+	check("gfba")
+	for _, k := range []string{"a", "f"} {
+		if v, ok, _ := l.Get([]byte(k)); !ok || !bytes.Equal(v, []byte(k)) {
+			t.Fatalf("want %s expect %s", k, v)
+		}
+	}
+
+	l.Shutdown()
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the tree can't be opened with another order
+	if _, err := Open(dir, MemTableThreshold(1<<20)); !errors.Is(err, ErrComparatorMismatch) {
+		t.Fatalf("want %v expect %v", ErrComparatorMismatch, err)
+	}
+
+	l, err = Open(dir, MemTableThreshold(1<<20), KeyComparator(reverseComparator{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Shutdown()
+	check("gfba")
+}
@@ -0,0 +1,37 @@
+package encoder
+
+import "bytes"
+
+// Comparator defines the order of the user keys. The name of the comparator
+// is recorded on disk, the data ordered by one comparator can't be read with another.
+type Comparator interface {
+	// Compare returns -1, 0 or 1 if a is less than, equal to or greater than b.
+	Compare(a, b []byte) int
+	// Name identifies the order, it must change whenever the order changes.
+	Name() string
+}
+
+// BytewiseComparator orders the keys lexicographically by bytes.Compare.
+var BytewiseComparator Comparator = bytewiseComparator{}
+
+type bytewiseComparator struct{}
+
+func (bytewiseComparator) Compare(a, b []byte) int {
+	return bytes.Compare(a, b)
+}
+
+func (bytewiseComparator) Name() string {
+	return "lsm.BytewiseComparator"
+}
+
+// InternalCompare returns the function ordering the internal keys as CompareInternal,
+// but with the user keys ordered by the comparator.
+func InternalCompare(cmp Comparator) func(a, b []byte) int {
+	return func(a, b []byte) int {
+		if c := cmp.Compare(UserKey(a), UserKey(b)); c != 0 {
+			return c
+		}
+
+		return compareTrailers(a, b)
+	}
+}
@@ -1,12 +1,50 @@
 package encoder
 
+import (
+	"encoding/binary"
+	"time"
+)
+
 type OpKind uint8
 
 const (
 	OpKindDelete OpKind = iota
 	OpKindSet
+	OpKindMerge
+	OpKindRangeDelete
+)
+
+const (
+	// flagExpiry marks the value followed by the expiry timestamp after the op kind.
+	flagExpiry = 0x80
+	// flagBlob marks the value kept in the blob file, the encoded value holds the pointer to it.
+	flagBlob   = 0x40
+	expirySize = 8
 )
 
+// KindOf returns the op kind of the encoded value.
+func KindOf(val []byte) OpKind {
+	return OpKind(val[0] &^ (flagExpiry | flagBlob))
+}
+
+// IsBlob reports whether the encoded value holds the pointer to the blob file.
+func IsBlob(val []byte) bool {
+	return val[0]&flagBlob != 0
+}
+
+// ValueSize returns the size of the value without the header.
+func ValueSize(val []byte) int {
+	return len(val) - headerSize(val)
+}
+
+func headerSize(val []byte) int {
+	if val[0]&flagExpiry != 0 {
+		return 1 + expirySize
+	}
+
+	return 1
+}
+
 type Encoder struct{}
 
 func NewEncoder() *Encoder {
@@ -28,24 +66,75 @@ func (e *Encoder) Encode(opKind OpKind, val []byte) []byte {
 	return buf
 }
 
+// EncodeWithExpiry encodes the value expiring at the given time
+// in Unix nanoseconds: [op kind | flag][expiry u64][value].
+func (e *Encoder) EncodeWithExpiry(opKind OpKind, val []byte, expireAt int64) []byte {
+	buf := make([]byte, len(val)+1+expirySize)
+	buf[0] = byte(opKind) | flagExpiry
+	binary.LittleEndian.PutUint64(buf[1:], uint64(expireAt))
+	copy(buf[1+expirySize:], val)
+
+	return buf
+}
+
+// EncodeBlob replaces the value of the encoded value by the pointer to the blob file
+// keeping the op kind and the expiry.
+func (e *Encoder) EncodeBlob(val, ptr []byte) []byte {
+	header := headerSize(val)
+	buf := make([]byte, header+len(ptr))
+	copy(buf, val[:header])
+	buf[0] |= flagBlob
+	copy(buf[header:], ptr)
+
+	return buf
+}
+
 func (e *Decoder) Decode(val []byte) *EncodedValue {
-	n := len(val)
-	buf := make([]byte, n-1)
-	opKind := val[0]
-	copy(buf, val[1:])
+	var (
+		expireAt int64
+		header   = 1
+	)
+	if val[0]&flagExpiry != 0 {
+		expireAt = int64(binary.LittleEndian.Uint64(val[1:]))
+		header += expirySize
+	}
+
+	buf := make([]byte, len(val)-header)
+	copy(buf, val[header:])
 
-	return &EncodedValue{val: buf, opKind: OpKind(opKind)}
+	return &EncodedValue{val: buf, opKind: KindOf(val), expireAt: expireAt, blob: IsBlob(val)}
 }
 
 type EncodedValue struct {
-	val    []byte
-	opKind OpKind
+	val      []byte
+	opKind   OpKind
+	expireAt int64
+	blob     bool
 }
 
 func (ev *EncodedValue) Value() []byte {
 	return ev.val
 }
 
+// IsBlob reports whether the value is the pointer to the blob file.
+func (ev *EncodedValue) IsBlob() bool {
+	return ev.blob
+}
+
 func (ev *EncodedValue) IsTombstone() bool {
 	return ev.opKind == OpKindDelete
 }
+
+func (ev *EncodedValue) Kind() OpKind {
+	return ev.opKind
+}
+
+// ExpireAt returns the expiry time of the value in Unix nanoseconds, zero if the value never expires.
+func (ev *EncodedValue) ExpireAt() int64 {
+	return ev.expireAt
+}
+
+// Expired reports whether the value is expired at the given time.
+func (ev *EncodedValue) Expired(now time.Time) bool {
+	return ev.expireAt != 0 && now.UnixNano() >= ev.expireAt
+}
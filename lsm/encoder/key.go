@@ -0,0 +1,88 @@
+package encoder
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+)
+
+const (
+	// MaxSequence is the largest sequence number of the internal key.
+	MaxSequence = 1<<56 - 1
+
+	// OpKindSeek is used to build the internal key for lookups. Kinds are ordered
+	// in descending order, so the seek key precedes all entries of its sequence.
+	OpKindSeek OpKind = math.MaxUint8
+
+	trailerSize = 8
+)
+
+// MakeInternalKey builds the internal key of the entry:
+// [user key][trailer: 56-bit sequence and op kind].
+func MakeInternalKey(ukey []byte, seq uint64, kind OpKind) []byte {
+	ikey := make([]byte, len(ukey)+trailerSize)
+	copy(ikey, ukey)
+	binary.LittleEndian.PutUint64(ikey[len(ukey):], seq<<8|uint64(kind))
+
+	return ikey
+}
+
+// ParseInternalKey splits the internal key to the user key, sequence and op kind.
+func ParseInternalKey(ikey []byte) ([]byte, uint64, OpKind) {
+	if len(ikey) < trailerSize {
+		return ikey, 0, OpKindDelete
+	}
+
+	n := len(ikey) - trailerSize
+	trailer := binary.LittleEndian.Uint64(ikey[n:])
+
+	return ikey[:n], trailer >> 8, OpKind(trailer & 0xff)
+}
+
+// UserKey returns the user key of the internal key.
+func UserKey(ikey []byte) []byte {
+	if len(ikey) < trailerSize {
+		return ikey
+	}
+
+	return ikey[:len(ikey)-trailerSize]
+}
+
+// Sequence returns the sequence number of the internal key.
+func Sequence(ikey []byte) uint64 {
+	_, seq, _ := ParseInternalKey(ikey)
+
+	return seq
+}
+
+// CompareInternal orders internal keys by the user key in ascending order
+// and then by the sequence and op kind in descending order,
+// so the newest version of a key goes first.
+func CompareInternal(a, b []byte) int {
+	if cmp := bytes.Compare(UserKey(a), UserKey(b)); cmp != 0 {
+		return cmp
+	}
+
+	return compareTrailers(a, b)
+}
+
+// compareTrailers orders the internal keys of the same user key, the newest first.
+func compareTrailers(a, b []byte) int {
+	ta, tb := trailer(a), trailer(b)
+	switch {
+	case ta > tb:
+		return -1
+	case ta < tb:
+		return 1
+	}
+
+	return 0
+}
+
+func trailer(ikey []byte) uint64 {
+	if len(ikey) < trailerSize {
+		return 0
+	}
+
+	return binary.LittleEndian.Uint64(ikey[len(ikey)-trailerSize:])
+}
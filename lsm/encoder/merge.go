@@ -0,0 +1,15 @@
+package encoder
+
+// MergeOperator combines the merge operands written by LSMTree.Merge
+// with the value of the key, so read-modify-write needs no read.
+type MergeOperator interface {
+	// FullMerge applies the operands, from the oldest to the newest,
+	// to the existing value of the key. The existing value is nil
+	// if the key has no value.
+	FullMerge(key, existing []byte, operands [][]byte) ([]byte, error)
+
+	// PartialMerge combines two adjacent operands of the key into one,
+	// the left operand is the older one. It returns false if the operands
+	// can not be combined without the existing value.
+	PartialMerge(key, left, right []byte) ([]byte, bool)
+}
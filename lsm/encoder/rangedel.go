@@ -0,0 +1,33 @@
+package encoder
+
+// RangeTombstone deletes all versions of the keys in [Start, End)
+// with the sequence number less than Seq.
+type RangeTombstone struct {
+	Start, End []byte
+	Seq        uint64
+}
+
+// Contains reports whether the user key is in the range of the tombstone.
+func (t RangeTombstone) Contains(cmp Comparator, ukey []byte) bool {
+	return cmp.Compare(t.Start, ukey) <= 0 && cmp.Compare(ukey, t.End) < 0
+}
+
+// Covers reports whether the tombstone deletes the version of the user key.
+func (t RangeTombstone) Covers(cmp Comparator, ukey []byte, seq uint64) bool {
+	return seq < t.Seq && t.Contains(cmp, ukey)
+}
+
+// CoveringSequence returns the largest sequence number of the tombstones
+// not newer than readSeq that contain the user key, or zero if there is no such tombstone.
+// Versions of the key with the smaller sequence number are deleted.
+func CoveringSequence(cmp Comparator, tombstones []RangeTombstone, ukey []byte, readSeq uint64) uint64 {
+	var seq uint64
+	for idx := range tombstones {
+		t := tombstones[idx]
+		if t.Seq <= readSeq && t.Seq > seq && t.Contains(cmp, ukey) {
+			seq = t.Seq
+		}
+	}
+
+	return seq
+}
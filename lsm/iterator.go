@@ -0,0 +1,272 @@
+package lsm
+
+import (
+	"bytes"
+	"io"
+	"time"
+
+	"github.com/s-ilyin/lsm-distributed/lsm/blob"
+	"github.com/s-ilyin/lsm-distributed/lsm/encoder"
+	"github.com/s-ilyin/lsm-distributed/lsm/memtable"
+	"github.com/s-ilyin/lsm-distributed/lsm/sst"
+)
+
+// memIterator adapts the MemTable iterator to sst.KVIterator.
+type memIterator struct {
+	it *memtable.MemTableIterator
+}
+
+func (mi memIterator) HasNext() bool {
+	return mi.it.HasNext()
+}
+
+func (mi memIterator) Next() ([]byte, []byte, error) {
+	k, v := mi.it.Next()
+
+	return k, v, nil
+}
+
+// Iterator walks over the keys of the tree in ascending order.
+// The MemTable and all SST files are merged lazily: newer values shadow
+// older ones and deleted (also by the range tombstones) and expired keys are skipped. Only the entries written
+// before the iterator was created are visible. The iterator keeps the version
+// of the column family it was created with until it is closed, so the files
+// replaced by the compaction are not removed while it is used.
+//
+// Keys are limited by [lower, upper), nil bound means no limit.
+type Iterator struct {
+	version *version
+	files   []sst.File
+	decoder *encoder.Decoder
+	merger  MergeOperator
+	cmp     Comparator
+	blobs   *blob.Store
+	seq     uint64
+	// range tombstones of the MemTable and the files
+	rangeDels []encoder.RangeTombstone
+
+	lower, upper []byte
+
+	it    *sst.MergeIterator
+	key   []byte
+	val   []byte
+	valid bool
+	err   error
+	// the user key whose older versions are skipped
+	skip []byte
+	// the entry read ahead while merging the operands
+	pk, pv []byte
+}
+
+// NewIterator returns the iterator over the default column family
+// positioned at the first key that is greater than or equal to lower.
+func (t *LSMTree) NewIterator(lower, upper []byte, options ...ReadOption) (*Iterator, error) {
+	return t.defaultFamily.NewIterator(lower, upper, options...)
+}
+
+// NewIterator returns the iterator over the column family
+// positioned at the first key that is greater than or equal to lower.
+func (cf *ColumnFamily) NewIterator(lower, upper []byte, options ...ReadOption) (*Iterator, error) {
+	v := cf.ref()
+	it := &Iterator{
+		version: v,
+		files:   v.files.Files(),
+		decoder: cf.t.decoder,
+		merger:  cf.t.merger,
+		cmp:     cf.t.cmp,
+		blobs:   cf.blobs,
+		seq:     cf.t.readSequence(options),
+		lower:   lower,
+		upper:   upper,
+	}
+	it.rangeDels = v.rangeTombstones()
+	it.Seek(lower)
+
+	return it, it.err
+}
+
+// Seek moves the iterator to the first key that is greater than or equal to key.
+func (it *Iterator) Seek(key []byte) bool {
+	if it.version == nil {
+		it.valid = false
+		return false
+	}
+	if it.lower != nil && it.cmp.Compare(key, it.lower) < 0 {
+		key = it.lower
+	}
+
+	// every source is positioned right before the first version of the first key
+	// not less than key
+	var ikey []byte
+	if key != nil {
+		ikey = encoder.MakeInternalKey(key, encoder.MaxSequence, encoder.OpKindSeek)
+	}
+
+	mems := it.version.memtables()
+	sources := make([]sst.KVIterator, 0, len(it.files)+len(mems))
+	for _, mem := range mems {
+		memit := mem.Iterator()
+		if ikey != nil {
+			memit.SeekLT(ikey)
+		}
+		sources = append(sources, memIterator{it: memit})
+	}
+	for idx := range it.files {
+		fit, err := it.files[idx].Reader.Iterator()
+		if err != nil {
+			return it.fail(err)
+		}
+		if ikey != nil {
+			if _, _, err := fit.SeekLT(ikey); err != nil && err != io.EOF {
+				return it.fail(err)
+			}
+		}
+		sources = append(sources, fit)
+	}
+
+	mi, err := sst.NewMergeIterator(encoder.InternalCompare(it.cmp), sources...)
+	if err != nil {
+		return it.fail(err)
+	}
+	it.it = mi
+	it.skip, it.pk, it.pv = nil, nil, nil
+
+	return it.Next()
+}
+
+// Next moves the iterator to the next live key.
+func (it *Iterator) Next() bool {
+	it.valid = false
+	if it.err != nil || it.it == nil {
+		return false
+	}
+
+	for {
+		k, v, ok, err := it.next()
+		if err != nil {
+			return it.fail(err)
+		}
+		if !ok {
+			return false
+		}
+
+		ukey, seq, _ := encoder.ParseInternalKey(k)
+		if it.upper != nil && it.cmp.Compare(ukey, it.upper) >= 0 {
+			return false
+		}
+		if seq > it.seq || (it.skip != nil && bytes.Equal(ukey, it.skip)) {
+			continue
+		}
+		// the newest visible version of the key, the rest are skipped
+		it.skip = ukey
+
+		rseq := encoder.CoveringSequence(it.cmp, it.rangeDels, ukey, it.seq)
+		if seq < rseq {
+			continue
+		}
+
+		val := it.decoder.Decode(v)
+		if val.IsTombstone() || val.Expired(time.Now()) {
+			continue
+		}
+
+		value := val.Value()
+		if val.Kind() == encoder.OpKindMerge {
+			if value, err = it.merge(ukey, k, val, rseq); err != nil {
+				return it.fail(err)
+			}
+		} else if val.IsBlob() {
+			if value, err = readBlob(it.blobs, value); err != nil {
+				return it.fail(err)
+			}
+		}
+
+		it.key, it.val, it.valid = ukey, value, true
+
+		return true
+	}
+}
+
+// next returns the next entry of the merged sources.
+func (it *Iterator) next() ([]byte, []byte, bool, error) {
+	if it.pk != nil {
+		k, v := it.pk, it.pv
+		it.pk, it.pv = nil, nil
+
+		return k, v, true, nil
+	}
+
+	if !it.it.HasNext() {
+		return nil, nil, false, nil
+	}
+	k, v, err := it.it.Next()
+
+	return k, v, err == nil, err
+}
+
+// merge folds the older versions of the key into the newest merge operand.
+func (it *Iterator) merge(ukey, ikey []byte, val *encoder.EncodedValue, rseq uint64) ([]byte, error) {
+	st := mergeState{rangeSeq: rseq, blobs: it.blobs}
+	st.add(ikey, val)
+
+	for {
+		k, v, ok, err := it.next()
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			break
+		}
+		if !bytes.Equal(encoder.UserKey(k), ukey) {
+			it.pk, it.pv = k, v
+			break
+		}
+		if encoder.Sequence(k) > it.seq {
+			continue
+		}
+		if st.add(k, it.decoder.Decode(v)) {
+			break
+		}
+	}
+
+	value, _, err := st.value(it.merger, ukey)
+
+	return value, err
+}
+
+// Valid reports whether the iterator is positioned at a key.
+func (it *Iterator) Valid() bool {
+	return it.valid
+}
+
+func (it *Iterator) Key() []byte {
+	return it.key
+}
+
+func (it *Iterator) Value() []byte {
+	return it.val
+}
+
+// Error returns the error that stopped the iteration, if any.
+func (it *Iterator) Error() error {
+	return it.err
+}
+
+// Close releases the iterator and the version of the column family it reads.
+func (it *Iterator) Close() error {
+	it.it = nil
+	it.valid = false
+	if it.version != nil {
+		it.version.unref()
+		it.version = nil
+	}
+
+	return nil
+}
+
+func (it *Iterator) fail(err error) bool {
+	it.err = err
+	it.valid = false
+
+	return false
+}
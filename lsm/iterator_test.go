@@ -0,0 +1,99 @@
+package lsm
+
+import (
+	"bytes"
+	"os"
+	"testing"
+)
+
+func TestIterator(t *testing.T) {
+	var dir = "tmp-test-iterator"
+	l, err := Open(dir, MemTableThreshold(1<<20))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer l.Shutdown()
+
+	for _, k := range []string{"a", "b", "c", "d", "e", "f"} {
+		if err := l.Put([]byte(k), []byte(k+k)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := l.defaultFamily.flushMemTable(); err != nil {
+		t.Fatal(err)
+	}
+
+	l.Put([]byte("c"), []byte("cnew"))
+	l.Delete([]byte("d"))
+	if err := l.defaultFamily.flushMemTable(); err != nil {
+		t.Fatal(err)
+	}
+
+	l.Put([]byte("g"), []byte("gg"))
+	l.Delete([]byte("b"))
+
+	tests := []struct {
+		name         string
+		lower, upper []byte
+		want         []kv
+	}{
+		{
+			name: "all",
+			want: []kv{
+				{k: []byte("a"), v: []byte("aa")},
+				{k: []byte("c"), v: []byte("cnew")},
+				{k: []byte("e"), v: []byte("ee")},
+				{k: []byte("f"), v: []byte("ff")},
+				{k: []byte("g"), v: []byte("gg")},
+			},
+		},
+		{
+			name:  "range",
+			lower: []byte("b"),
+			upper: []byte("f"),
+			want: []kv{
+				{k: []byte("c"), v: []byte("cnew")},
+				{k: []byte("e"), v: []byte("ee")},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			it, err := l.NewIterator(tt.lower, tt.upper)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer it.Close()
+
+			var i int
+			for ; it.Valid(); it.Next() {
+				if i >= len(tt.want) {
+					t.Fatalf("unexpected key %s", it.Key())
+				}
+				if !bytes.Equal(tt.want[i].k, it.Key()) {
+					t.Fatalf("[key] want %s expect %s", tt.want[i].k, it.Key())
+				}
+				if !bytes.Equal(tt.want[i].v, it.Value()) {
+					t.Fatalf("[val] want %s expect %s", tt.want[i].v, it.Value())
+				}
+				i++
+			}
+			if it.Error() != nil {
+				t.Fatal(it.Error())
+			}
+			if i != len(tt.want) {
+				t.Fatalf("want %d keys expect %d", len(tt.want), i)
+			}
+		})
+	}
+
+	it, err := l.NewIterator(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !it.Seek([]byte("d")) || !bytes.Equal(it.Key(), []byte("e")) {
+		t.Fatalf("want key e expect %s", it.Key())
+	}
+}
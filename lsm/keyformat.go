@@ -0,0 +1,128 @@
+package lsm
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+
+	"github.com/s-ilyin/lsm-distributed/lsm/encoder"
+	"github.com/s-ilyin/lsm-distributed/lsm/sst"
+)
+
+const (
+	keyFormatFile = "format.db"
+	// The keys of the SST files and the WAL are the internal keys:
+	// the user key with the sequence number and the kind of the operation.
+	keyFormatInternal = 1
+)
+
+// ErrKeyFormat is returned when opening the tree with the key format recorded
+// by the newer version of the tree.
+var ErrKeyFormat = errors.New("unsupported key format")
+
+// checkKeyFormat compares the key format of the tree with the recorded one and records
+// the key format of the new tree. The trees written before the format was recorded
+// may keep the plain user keys in the WAL and the SST files, they are rewritten
+// to the internal keys before the format is recorded.
+func (t *LSMTree) checkKeyFormat() error {
+	filename := path.Join(t.root, keyFormatFile)
+
+	data, err := os.ReadFile(filename)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil {
+		if format, err := strconv.Atoi(string(data)); err != nil || format != keyFormatInternal {
+			return fmt.Errorf("%w: %q", ErrKeyFormat, data)
+		}
+		return nil
+	}
+
+	if err := t.migratePlainKeys(); err != nil {
+		return fmt.Errorf("failed to rewrite the plain user keys: %w", err)
+	}
+
+	tmp := filename + ".tmp"
+	if err := os.WriteFile(tmp, []byte(strconv.Itoa(keyFormatInternal)), 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, filename)
+}
+
+// migratePlainKeys rewrites the SST files and the WAL of the plain user keys to the internal keys.
+// The first format resolves the same key of the SST files by the sequence numbers of the files
+// and replays the whole WAL over them, so the entries of the SST file get the sequence number
+// of the file incremented by one and the WAL records get the sequence numbers after all files.
+// The numbers do not depend on the files rewritten before, so the migration interrupted
+// by the crash is repeated by the next open.
+func (t *LSMTree) migratePlainKeys() error {
+	var files []string
+	for _, pattern := range []string{
+		path.Join(t.root, "level-*", "*.sst"),
+		path.Join(t.root, familiesDir, "*", "level-*", "*.sst"),
+	} {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return err
+		}
+		files = append(files, matches...)
+	}
+
+	seq := t.wal.Flushed()
+	for _, name := range files {
+		last, err := t.migratePlainKeyFile(name)
+		if err != nil {
+			return err
+		}
+		seq = max(seq, last)
+	}
+
+	return t.wal.MigratePlainKeys(seq + 1)
+}
+
+// migratePlainKeyFile replaces the SST file of the plain user keys by the file of the internal keys.
+// Returns the last sequence number of the file.
+func (t *LSMTree) migratePlainKeyFile(name string) (uint64, error) {
+	rd, err := sst.NewReader(name)
+	if err != nil {
+		return 0, err
+	}
+	defer rd.Close()
+
+	if !rd.PlainKeys() {
+		return rd.Sequence(), nil
+	}
+	seq := rd.Sequence() + 1
+
+	it, err := rd.Iterator()
+	if err != nil {
+		return 0, err
+	}
+	// the name of the new file is not listed by the level until the rename
+	tmp := path.Join(path.Dir(name), "migrate-"+path.Base(name))
+	wr, err := sst.NewWriter(tmp, sst.SparseKeyDistance(t.sparseKeyDistance), sst.FileSync(true))
+	if err != nil {
+		return 0, err
+	}
+	for it.HasNext() {
+		k, v, err := it.Next()
+		if err != nil {
+			return 0, err
+		}
+		if err := wr.Write(encoder.MakeInternalKey(k, seq, encoder.KindOf(v)), v); err != nil {
+			return 0, err
+		}
+	}
+	if err := wr.AddIdxBlock(seq); err != nil {
+		return 0, err
+	}
+	if err := wr.Close(); err != nil {
+		return 0, err
+	}
+
+	return seq, os.Rename(tmp, name)
+}
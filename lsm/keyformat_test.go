@@ -0,0 +1,146 @@
+package lsm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/s-ilyin/lsm-distributed/lsm/encoder"
+	"github.com/s-ilyin/lsm-distributed/lsm/sst"
+)
+
+func TestKeyFormat(t *testing.T) {
+	var dir = "tmp-test-key-format"
+	defer os.RemoveAll(dir)
+
+	l, err := Open(dir, MemTableThreshold(1<<20))
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Put([]byte("a"), []byte("a"))
+	if err := l.defaultFamily.flushMemTable(); err != nil {
+		t.Fatal(err)
+	}
+	l.Put([]byte("b"), []byte("b"))
+	l.Shutdown()
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if format, _ := os.ReadFile(path.Join(dir, keyFormatFile)); string(format) != "1" {
+		t.Fatalf("want %s expect %s", "1", format)
+	}
+
+	// the tree written before the format was recorded has the internal keys
+	if err := os.Remove(path.Join(dir, keyFormatFile)); err != nil {
+		t.Fatal(err)
+	}
+	l, err = Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []string{"a", "b"} {
+		if v, ok, _ := l.Get([]byte(k)); !ok || string(v) != k {
+			t.Fatalf("want %s expect %s", k, v)
+		}
+	}
+	l.Shutdown()
+	l.Close()
+
+	if err := os.WriteFile(path.Join(dir, keyFormatFile), []byte("2"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(dir); !errors.Is(err, ErrKeyFormat) {
+		t.Fatalf("want %v expect %v", ErrKeyFormat, err)
+	}
+}
+
+func TestKeyFormatPlainKeys(t *testing.T) {
+	var (
+		dir = "tmp-test-key-format-plain"
+		enc = encoder.NewEncoder()
+	)
+	defer os.RemoveAll(dir)
+
+	// the tree of the first format: the SST file of the first flush with the plain user keys,
+	// the WAL of all writes and the number of the flushes in the WAL index
+	var buf, idx, offsets bytes.Buffer
+	for _, k := range []string{"a", "c", "e"} {
+		offsets.Write(binary.LittleEndian.AppendUint32(nil, uint32(idx.Len())))
+		sst.Encode(&idx, []byte(k), binary.LittleEndian.AppendUint32(nil, uint32(buf.Len())))
+		sst.Encode(&buf, []byte(k), enc.Encode(encoder.OpKindSet, []byte("sst-"+k)))
+	}
+	idx.Write(offsets.Bytes())
+	idx.Write(binary.LittleEndian.AppendUint64(nil, 0))
+	idx.Write(binary.LittleEndian.AppendUint32(nil, 3))
+	idx.Write(binary.LittleEndian.AppendUint32(nil, uint32(idx.Len()+4)))
+	buf.Write(idx.Bytes())
+	level := sst.PathForLevel(dir, sst.BaseLevel)
+	os.MkdirAll(level, os.FileMode(0700))
+	if err := os.WriteFile(path.Join(level, "data_0000-1.sst"), buf.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	buf.Reset()
+	sst.Encode(&buf, []byte("a"), enc.Encode(encoder.OpKindSet, []byte("sst-a")))
+	sst.Encode(&buf, []byte("a"), enc.Encode(encoder.OpKindSet, []byte("wal-a")))
+	sst.Encode(&buf, []byte("b"), enc.Encode(encoder.OpKindSet, []byte("wal-b")))
+	sst.Encode(&buf, []byte("c"), enc.Encode(encoder.OpKindDelete, nil))
+	os.MkdirAll(path.Join(dir, "wal"), os.FileMode(0700))
+	if err := os.WriteFile(path.Join(dir, "wal", "wal.db"), buf.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path.Join(dir, "wal", "wal.index.db"), binary.LittleEndian.AppendUint64(nil, 1), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(l *LSMTree) {
+		for k, want := range map[string]string{"a": "wal-a", "b": "wal-b", "e": "sst-e"} {
+			if v, ok, _ := l.Get([]byte(k)); !ok || string(v) != want {
+				t.Fatalf("want %s expect %s", want, v)
+			}
+		}
+		if _, ok, _ := l.Get([]byte("c")); ok {
+			t.Fatalf("deleted key found")
+		}
+	}
+
+	l, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(l)
+	if format, _ := os.ReadFile(path.Join(dir, keyFormatFile)); string(format) != "1" {
+		t.Fatalf("want %s expect %s", "1", format)
+	}
+	if _, err := os.Stat(path.Join(dir, "wal", "wal.db")); !os.IsNotExist(err) {
+		t.Fatalf("the legacy WAL file is not removed")
+	}
+	for _, file := range l.defaultFamily.fobserver.Level(sst.BaseLevel) {
+		if file.Reader.PlainKeys() {
+			t.Fatalf("the SST file %s keeps the plain user keys", file.Reader.Name())
+		}
+	}
+
+	// the rewritten WAL is flushed over the rewritten SST file
+	l.Put([]byte("d"), []byte("d"))
+	if err := l.defaultFamily.flushMemTable(); err != nil {
+		t.Fatal(err)
+	}
+	l.Shutdown()
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	l, err = Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Shutdown()
+	check(l)
+	if v, ok, _ := l.Get([]byte("d")); !ok || string(v) != "d" {
+		t.Fatalf("want %s expect %s", "d", v)
+	}
+}
@@ -0,0 +1,178 @@
+package lsm
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrLockTimeout is returned when the lock of the key was not acquired in time.
+	ErrLockTimeout = errors.New("lock timeout")
+	// ErrDeadlock is returned when waiting for the lock of the key would deadlock.
+	ErrDeadlock = errors.New("deadlock detected")
+)
+
+type lockMode uint8
+
+const (
+	lockShared lockMode = iota + 1
+	lockExclusive
+)
+
+// keyLock is the lock of a single key held by one or more transactions.
+type keyLock struct {
+	holders map[uint64]lockMode
+	// closed and replaced on every release to wake up the waiters
+	released chan struct{}
+	waiters  int
+}
+
+// lockManager keeps the per-key locks of pessimistic transactions
+// and the wait-for graph used to detect deadlocks.
+type lockManager struct {
+	mu    sync.Mutex
+	locks map[string]*keyLock
+	// waits[a][b] means transaction a waits for transaction b
+	waits map[uint64]map[uint64]struct{}
+	ids   uint64
+}
+
+// nextID returns the id of a new transaction.
+func (m *lockManager) nextID() uint64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.ids++
+
+	return m.ids
+}
+
+// lock acquires the lock of the key for the transaction.
+// A shared lock held by the transaction is upgraded to the exclusive one.
+func (m *lockManager) lock(id uint64, key string, mode lockMode, timeout time.Duration) error {
+	var timer <-chan time.Time
+
+	m.mu.Lock()
+	if m.locks == nil {
+		m.locks = make(map[string]*keyLock)
+		m.waits = make(map[uint64]map[uint64]struct{})
+	}
+
+	kl, ok := m.locks[key]
+	if !ok {
+		kl = &keyLock{holders: make(map[uint64]lockMode), released: make(chan struct{})}
+		m.locks[key] = kl
+	}
+
+	for {
+		if kl.grantable(id, mode) {
+			if kl.holders[id] < mode {
+				kl.holders[id] = mode
+			}
+			delete(m.waits, id)
+			m.mu.Unlock()
+
+			return nil
+		}
+
+		edges := make(map[uint64]struct{}, len(kl.holders))
+		for holder := range kl.holders {
+			if holder != id {
+				edges[holder] = struct{}{}
+			}
+		}
+		m.waits[id] = edges
+		if m.cycle(id) {
+			m.abandon(id, key, kl)
+			m.mu.Unlock()
+
+			return ErrDeadlock
+		}
+
+		if timer == nil {
+			timer = time.After(timeout)
+		}
+		released := kl.released
+		kl.waiters++
+		m.mu.Unlock()
+
+		select {
+		case <-released:
+			m.mu.Lock()
+			kl.waiters--
+		case <-timer:
+			m.mu.Lock()
+			kl.waiters--
+			m.abandon(id, key, kl)
+			m.mu.Unlock()
+
+			return ErrLockTimeout
+		}
+	}
+}
+
+// grantable reports whether the lock can be granted to the transaction.
+func (kl *keyLock) grantable(id uint64, mode lockMode) bool {
+	for holder, held := range kl.holders {
+		if holder == id {
+			continue
+		}
+		if mode == lockExclusive || held == lockExclusive {
+			return false
+		}
+	}
+
+	return true
+}
+
+// cycle reports whether the transaction waits for itself in the wait-for graph.
+func (m *lockManager) cycle(id uint64) bool {
+	visited := make(map[uint64]struct{})
+	stack := []uint64{id}
+	for len(stack) > 0 {
+		cur := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		for next := range m.waits[cur] {
+			if next == id {
+				return true
+			}
+			if _, ok := visited[next]; !ok {
+				visited[next] = struct{}{}
+				stack = append(stack, next)
+			}
+		}
+	}
+
+	return false
+}
+
+// abandon removes the waiting transaction from the graph
+// and drops the lock of the key if nobody uses it.
+func (m *lockManager) abandon(id uint64, key string, kl *keyLock) {
+	delete(m.waits, id)
+	if len(kl.holders) == 0 && kl.waiters == 0 {
+		delete(m.locks, key)
+	}
+}
+
+// unlock releases the locks of the keys held by the transaction.
+func (m *lockManager) unlock(id uint64, keys []string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, key := range keys {
+		kl, ok := m.locks[key]
+		if !ok {
+			continue
+		}
+
+		delete(kl.holders, id)
+		close(kl.released)
+		kl.released = make(chan struct{})
+		if len(kl.holders) == 0 && kl.waiters == 0 {
+			delete(m.locks, key)
+		}
+	}
+	delete(m.waits, id)
+}
@@ -0,0 +1,92 @@
+package lsm
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestPessimisticTxn(t *testing.T) {
+	var dir = "tmp-test-pessimistic-txn"
+	l, err := Open(dir, MemTableThreshold(1<<20))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer l.Shutdown()
+
+	l.Put([]byte("a"), []byte("1"))
+	l.Put([]byte("b"), []byte("1"))
+
+	// shared locks are compatible
+	tx1 := l.BeginTxn(Pessimistic(), LockTimeout(50*time.Millisecond))
+	tx2 := l.BeginTxn(Pessimistic(), LockTimeout(50*time.Millisecond))
+	if _, _, err := tx1.Get([]byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := tx2.Get([]byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx2.Put([]byte("a"), []byte("2")); !errors.Is(err, ErrLockTimeout) {
+		t.Fatalf("want %v expect %v", ErrLockTimeout, err)
+	}
+	tx1.Rollback()
+	tx2.Rollback()
+
+	// the exclusive lock blocks the readers until the commit
+	tx1 = l.BeginTxn(Pessimistic())
+	if _, _, err := tx1.GetForUpdate([]byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	tx1.Put([]byte("a"), []byte("2"))
+
+	read := make(chan []byte)
+	go func() {
+		tx := l.BeginTxn(Pessimistic())
+		defer tx.Rollback()
+		v, _, _ := tx.Get([]byte("a"))
+		read <- v
+	}()
+
+	time.Sleep(20 * time.Millisecond)
+	if err := tx1.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if v := <-read; !bytes.Equal(v, []byte("2")) {
+		t.Fatalf("want %s expect %s", "2", v)
+	}
+
+	// deadlock: tx1 waits for tx2 and tx2 waits for tx1
+	tx1 = l.BeginTxn(Pessimistic(), LockTimeout(time.Minute))
+	tx2 = l.BeginTxn(Pessimistic(), LockTimeout(time.Minute))
+	if _, _, err := tx1.GetForUpdate([]byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := tx2.GetForUpdate([]byte("b")); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error)
+	go func() {
+		_, _, err := tx1.GetForUpdate([]byte("b"))
+		done <- err
+	}()
+
+	time.Sleep(20 * time.Millisecond)
+	if _, _, err := tx2.GetForUpdate([]byte("a")); !errors.Is(err, ErrDeadlock) {
+		t.Fatalf("want %v expect %v", ErrDeadlock, err)
+	}
+	tx2.Rollback()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	tx1.Put([]byte("b"), []byte("2"))
+	if err := tx1.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if v, _, _ := l.Get([]byte("b")); !bytes.Equal(v, []byte("2")) {
+		t.Fatalf("want %s expect %s", "2", v)
+	}
+}
@@ -5,9 +5,9 @@ import (
 	"errors"
 	"fmt"
 	"log/slog"
-	"math"
 	"os"
 	"path"
+	"slices"
 	"sync"
 	"time"
 
@@ -20,13 +20,12 @@ import (
 
 const (
 	// MaxKeySize is the maximum allowed key size.
-	// The size is hard-coded and must not be changed since it has
-	// impact on the encoding features.
-	MaxKeySize = math.MaxUint16
+	// The keys and the values are encoded with varint lengths
+	// and the offsets of the SST files are uint64, so the limits
+	// only protect the MemTable from the huge entries.
+	MaxKeySize = 1 << 20
 	// MaxValueSize is the maximum allowed value size.
-	// The size is hard-coded and must not be changed since it has
-	// impact on the encoding features.
-	MaxValueSize = math.MaxUint16
+	MaxValueSize = 1 << 32
 )
 
 var (
@@ -38,37 +37,74 @@ var (
 	ErrKeyTooLarge = errors.New("key too large")
 	// ErrValueTooLarge is returned when putting a value that is larger than MaxValueSize.
 	ErrValueTooLarge = errors.New("value too large")
+	// ErrInvalidTTL is returned when putting a key with a non-positive ttl.
+	ErrInvalidTTL = errors.New("invalid ttl")
 )
 
 // LSMTree (https://en.wikipedia.org/wiki/Log-structured_merge-tree)
 // это реализация лог-структуры merge-tree для хранения данных в файлах.
-// Реализация не является goroutine-safe! Убедитесь, что при необходимости доступ
-// к дереву синхронизируется.
+// Методы дерева можно вызывать из нескольких горутин: записи упорядочиваются
+// блокировкой дерева, а чтения берут текущую версию (MemTable и файлы уровней)
+// и не ждут сброса MemTable и уплотнения.
 type LSMTree struct {
 	// Путь к каталогу, в котором хранятся файлы дерева LSM,
 	// требуется указать выделенный каталог для каждого
 	// экземпляра дерева.
 	root string
 
-	logger    *slog.Logger
-	lock      sync.RWMutex
-	ctx       context.Context
-	cancel    context.CancelFunc
-	wg        sync.WaitGroup
-	encoder   *encoder.Encoder
-	decoder   *encoder.Decoder
-	fobserver *sst.ObserverFiles
-	debug     bool
-	config    *Config
+	logger  *slog.Logger
+	lock    sync.RWMutex
+	ctx     context.Context
+	cancel  context.CancelFunc
+	wg      sync.WaitGroup
+	encoder *encoder.Encoder
+	decoder *encoder.Decoder
+	debug   bool
+
+	// Порядок ключей дерева, имя компаратора записывается на диск.
+	cmp Comparator
 
 	// Перед выполнением любой операции записи,
 	// она записывается в журнал опережающей записи (WAL) и только потом применяется.
-	wal  *wal.WAL
-	cSST chan sst.ElemSST
-
-	// Все изменения, которые стираются в WAL, но не стираются
-	// в отсортированные файлы, хранятся в памяти для ускорения поиска.
-	mem *memtable.Memtable
+	wal     *wal.WAL
+	walSync bool
+	// Файл WAL синхронизируется с диском фоновой горутиной с этим интервалом,
+	// если записи не синхронизируются сами.
+	walSyncInterval time.Duration
+	// Режим восстановления поврежденных записей WAL и отброшенные при открытии записи.
+	walRecovery wal.RecoveryMode
+	recovery    wal.RecoveryStats
+	// Архив удаленных сегментов WAL, nil если сегменты удаляются.
+	walArchive wal.Option
+	// Сжатие записей новых сегментов WAL, nil без сжатия.
+	walCompression wal.Compressor
+	// Блоки данных SST файлов проверяются по контрольным суммам при каждом чтении.
+	verifyChecksums bool
+
+	// Очередь писателей группового коммита: первый писатель (лидер) записывает
+	// в WAL свой пакет и пакеты ждущих за ним писателей одной записью и одним fsync.
+	writers []*writer
+
+	// Заполненные MemTable сбрасываются на диск фоновой горутиной,
+	// писатели ждут установки новой версии после сброса или уплотнения,
+	// когда у семейства MaxWriteBufferNumber MemTable или сработал триггер остановки.
+	cFlush    chan struct{}
+	installed *sync.Cond
+	stalls    stalls
+
+	// Семейства столбцов со своими MemTable и уровнями SST-файлов,
+	// методы дерева работают с семейством по умолчанию.
+	defaultFamily *ColumnFamily
+	families      map[uint32]*ColumnFamily
+
+	// Оператор слияния операндов, записанных Merge.
+	merger MergeOperator
+
+	// Живые снимки, версии ключей видимые снимкам не удаляются при слиянии.
+	snapshots snapshots
+
+	// Блокировки ключей пессимистичных транзакций.
+	locks lockManager
 
 	// Если размер MemTable в байтах превышает пороговое значение, она должна быть
 	// быть смыта в файловую систему.
@@ -92,44 +128,85 @@ func Open(path string, options ...func(*LSMTree)) (*LSMTree, error) {
 		os.MkdirAll(path, os.FileMode(0700))
 	}
 
-	wal, err := wal.NewWAL(path, wal.FileSync(false))
-	if err != nil {
-		return nil, err
-	}
-
-	mem, err := wal.LoadMem()
-	if err != nil {
-		return nil, fmt.Errorf("failed to load mem from %s: %w", wal.Path(), err)
-	}
-	observer, err := sst.NewFilesObserver(path)
-	if err != nil {
-		return nil, fmt.Errorf("file observer %s", err)
-	}
 	ctx, cancel := context.WithCancel(context.Background())
 
 	t := &LSMTree{
 		ctx:                   ctx,
 		cancel:                cancel,
-		wal:                   wal,
-		cSST:                  make(chan sst.ElemSST),
-		mem:                   mem,
-		fobserver:             observer,
+		cFlush:                make(chan struct{}, 1),
+		families:              make(map[uint32]*ColumnFamily),
 		root:                  path,
-		config:                defaultMergeConfig(),
 		sparseKeyDistance:     defaultSparseKeyDistance,
 		diskTableNumThreshold: defaultDiskTableNumThreshold,
 		logger:                logger,
 		encoder:               encoder.NewEncoder(),
 		decoder:               encoder.NewDecoder(),
+		cmp:                   encoder.BytewiseComparator,
+	}
+	t.installed = sync.NewCond(&t.lock)
+	t.defaultFamily = &ColumnFamily{
+		t:      t,
+		name:   DefaultColumnFamily,
+		root:   path,
+		config: defaultMergeConfig(),
 	}
+	t.families[0] = t.defaultFamily
 	for _, option := range options {
 		option(t)
 	}
-	t.wg.Add(1)
-	go t.walJob()
+
+	walOptions := []wal.Option{wal.FileSync(t.walSync), wal.Recovery(t.walRecovery)}
+	if t.walArchive != nil {
+		walOptions = append(walOptions, t.walArchive)
+	}
+	if t.walCompression != nil {
+		walOptions = append(walOptions, wal.Compression(t.walCompression))
+	}
+	wal, err := wal.NewWAL(path, walOptions...)
+	if err != nil {
+		return nil, err
+	}
+	t.wal = wal
+
+	if err := t.checkKeyFormat(); err != nil {
+		return nil, err
+	}
+	if err := t.checkComparator(); err != nil {
+		return nil, err
+	}
+	if err := t.defaultFamily.open(); err != nil {
+		return nil, err
+	}
+
+	if err := t.loadFamilies(); err != nil {
+		return nil, fmt.Errorf("failed to load column families: %w", err)
+	}
+	t.recovery, err = wal.Replay(func(family uint32, ikey, val []byte) {
+		if cf, ok := t.families[family]; ok {
+			cf.mem.Put(ikey, val)
+		}
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to load mem from %s: %w", wal.Path(), err)
+	}
+	if t.recovery.DroppedRecords > 0 {
+		logger.Warn("damaged WAL records dropped",
+			slog.String("mode", t.walRecovery.String()),
+			slog.Int("records", t.recovery.DroppedRecords),
+			slog.Int64("bytes", t.recovery.DroppedBytes))
+	}
 
 	t.wg.Add(1)
-	go t.mergeJob()
+	go t.flushJob()
+	if t.walSyncInterval > 0 {
+		t.wg.Add(1)
+		go t.walSyncJob(t.walSyncInterval)
+	}
+
+	for _, cf := range t.families {
+		t.wg.Add(1)
+		go cf.mergeJob()
+	}
 
 	return t, nil
 }
@@ -137,6 +214,27 @@ func Open(path string, options ...func(*LSMTree)) (*LSMTree, error) {
 type Config struct {
 	MemtblDataSize uint32
 	Merge          MergeSettings
+
+	// Values not smaller than the threshold are kept in the blob files and the SST files
+	// keep only the pointers to them, so the values are not rewritten by every compaction.
+	// Zero disables the separation.
+	BlobThreshold uint32
+	// Share of the oldest blob files whose live values are relocated
+	// to the new blob file by the compaction, so the old files can be removed.
+	BlobGCAgeCutoff float64
+
+	// Maximum number of the MemTables: the active one and the immutable ones
+	// waiting for the flush. The writers wait for the flush when it is reached.
+	MaxWriteBufferNumber int
+
+	// The writes are delayed when level 0 has L0SlowdownWritesTrigger files, the longer
+	// the more files it has, and stopped until the compaction when it has L0StopWritesTrigger files or
+	// the size of the files waiting for the compaction reaches PendingCompactionBytesLimit.
+	// The triggers take effect only with the merge job running (Merge.Interval is set),
+	// zero disables the trigger. The stop trigger below the slowdown trigger is raised to it.
+	L0SlowdownWritesTrigger     int
+	L0StopWritesTrigger         int
+	PendingCompactionBytesLimit uint64
 }
 
 // Define parameters for managing the SST levels
@@ -168,87 +266,162 @@ type MergeSettings struct {
 // Close closes all allocated resources.
 func (t *LSMTree) Close() error {
 	if err := t.wal.Close(); err != nil {
-		return fmt.Errorf("failed to close file %s: %w", t.wal.Name(), err)
+		return fmt.Errorf("failed to close WAL %s: %w", t.wal.Path(), err)
+	}
+	for _, cf := range t.families {
+		if err := cf.blobs.Close(); err != nil {
+			return fmt.Errorf("failed to close blob files of %s: %w", cf.name, err)
+		}
 	}
 
 	return nil
 }
 
-func (t *LSMTree) walJob() {
-	defer t.wg.Done()
-	for {
-		select {
-		case sst, ok := <-t.cSST:
-			if !ok {
-				return
-			}
+// Put puts the key into the db.
+func (t *LSMTree) Put(key []byte, value []byte, options ...WriteOptions) error {
+	b := NewWriteBatch()
+	b.Put(key, value)
 
-			if err := t.wal.Append(sst.Key, sst.Val); err != nil {
-				logger.Error(err.Error())
-			}
-			if t.mem.Size() >= t.config.MemtblDataSize {
-				if err := t.flushMemTable(); err != nil {
-					logger.Error(err.Error(), slog.String("call", "wal job"))
-				}
-			}
+	return t.Write(b, options...)
+}
 
-		case <-t.ctx.Done():
-			return
-		}
+// PutWithTTL puts the key into the db for the ttl.
+// After the ttl the key is treated as deleted and
+// it is dropped by the compaction.
+func (t *LSMTree) PutWithTTL(key []byte, value []byte, ttl time.Duration, options ...WriteOptions) error {
+	if ttl <= 0 {
+		return ErrInvalidTTL
 	}
+
+	b := NewWriteBatch()
+	b.PutWithTTL(key, value, ttl)
+
+	return t.Write(b, options...)
 }
 
-// Put puts the key into the db.
-func (t *LSMTree) Put(key []byte, value []byte) error {
-	if len(key) == 0 {
-		return ErrKeyRequired
-	} else if len(key) > MaxKeySize {
-		return ErrKeyTooLarge
-	} else if len(value) == 0 {
-		return ErrValueRequired
-	} else if uint64(len(value)) > MaxValueSize {
-		return ErrValueTooLarge
-	}
-
-	value = t.encoder.Encode(encoder.OpKindSet, value)
+// Write applies all updates of the batch atomically.
+// The batch is appended to the WAL as a single record and every update
+// gets its own sequence number. The sequence of the tree is moved
+// only when the whole batch is in the MemTable, so readers never see
+// a part of it. Write returns after the record is written to the WAL,
+// the concurrent writes are appended together (see writer).
+func (t *LSMTree) Write(batch *WriteBatch, options ...WriteOptions) error {
+	return t.write(batch, nil, mergeWriteOptions(options))
+}
+
+// write applies the batch. The check is called under the lock
+// before the batch is applied and cancels the write on error.
+func (t *LSMTree) write(batch *WriteBatch, check func() error, wo WriteOptions) error {
+	if err := batch.validate(); err != nil {
+		return err
+	}
+	if wo.Sync && wo.DisableWAL {
+		return ErrSyncWithoutWAL
+	}
+
 	t.lock.Lock()
-	t.cSST <- sst.ElemSST{Key: key, Val: value}
-	t.mem.Put(key, value)
+
+	for idx := range batch.elems {
+		if _, ok := t.families[batch.elems[idx].Family]; !ok {
+			t.lock.Unlock()
+			return ErrUnknownColumnFamily
+		}
+	}
+
+	w := &writer{elems: batch.elems, check: check, options: wo, cond: sync.NewCond(&t.lock)}
+	t.writers = append(t.writers, w)
+	for !w.done && w != t.writers[0] {
+		w.cond.Wait()
+	}
+	if w.done {
+		// committed by the leader
+		t.lock.Unlock()
+		return w.err
+	}
+
+	group := t.group()
+	var elems []wal.Entry
+	for _, g := range group {
+		elems = append(elems, g.elems...)
+	}
+	// the lock is released while waiting for the flush,
+	// so the checks are called after it
+	events, err := t.makeRoom(elems)
+	if err != nil {
+		for _, g := range group {
+			g.err = err
+		}
+		t.finish(group)
+	} else {
+		t.commit(group)
+	}
 	t.lock.Unlock()
-	return nil
+	t.stalls.add(events)
+
+	return w.err
 }
 
 // Get the value for the key from the db.
-func (t *LSMTree) Get(key []byte) ([]byte, bool, error) {
-	value, exists := t.mem.Get(key)
+func (t *LSMTree) Get(key []byte, options ...ReadOption) ([]byte, bool, error) {
+	return t.defaultFamily.Get(key, options...)
+}
+
+// get returns the value of the newest version of the key
+// with the sequence number not greater than seq.
+func (cf *ColumnFamily) get(key []byte, seq uint64) ([]byte, bool, error) {
+	v := cf.ref()
+	defer v.unref()
+
+	// versions older than the range tombstone are deleted
+	rseq := encoder.CoveringSequence(cf.t.cmp, v.rangeTombstones(), key, seq)
+
+	ikey, value, exists := v.lookup(key, seq)
 	if exists {
-		if t.debug {
+		if cf.t.debug {
 			logger.Debug("found key memtable")
 		}
 
-		if t.decoder.Decode(value).IsTombstone() {
-			return t.decoder.Decode(value).Value(), false, sst.ErrKeyNotFound
+		if encoder.Sequence(ikey) < rseq {
+			return nil, false, sst.ErrKeyNotFound
+		}
+		if cf.t.decoder.Decode(value).IsTombstone() || cf.t.decoder.Decode(value).Expired(time.Now()) {
+			return nil, false, sst.ErrKeyNotFound
+		}
+		if cf.t.decoder.Decode(value).Kind() == encoder.OpKindMerge {
+			return cf.fold(v, key, seq, rseq)
 		}
 
-		return t.decoder.Decode(value).Value(), t.decoder.Decode(value).Value() != nil, nil
+		return cf.t.decoder.Decode(value).Value(), cf.t.decoder.Decode(value).Value() != nil, nil
 	}
 
-	value, exists, err := sst.SearchInDiskTables(key, t.fobserver.Iterator(t.config.Merge.MaxLevels))
+	ikey = encoder.MakeInternalKey(key, seq, encoder.OpKindSeek)
+	ikey, value, exists, err := sst.SearchInDiskTables(ikey, v.files.Iterator())
 	if err != nil {
-		return nil, false, fmt.Errorf("failed to search in disk: %s", err)
+		return nil, false, fmt.Errorf("failed to search in disk: %w", err)
 	}
 
 	if exists {
-		val := t.decoder.Decode(value)
+		val := cf.t.decoder.Decode(value)
 
-		if val.IsTombstone() {
+		if encoder.Sequence(ikey) < rseq || val.IsTombstone() || val.Expired(time.Now()) {
 			return nil, false, sst.ErrKeyNotFound
 		}
+		if val.Kind() == encoder.OpKindMerge {
+			return cf.fold(v, key, seq, rseq)
+		}
 
-		if t.debug {
+		if cf.t.debug {
 			logger.Debug("found key disk")
 		}
 
+		if val.IsBlob() {
+			value, err := readBlob(cf.blobs, val.Value())
+			if err != nil {
+				return nil, false, fmt.Errorf("failed to read blob: %w", err)
+			}
+			return value, true, nil
+		}
+
 		return val.Value(), exists, nil
 	}
 
@@ -256,28 +429,135 @@ func (t *LSMTree) Get(key []byte) ([]byte, bool, error) {
 
 }
 
+// DeleteRange deletes all keys in [start, end) from the db.
+// The deletion is stored as a single range tombstone.
+func (t *LSMTree) DeleteRange(start, end []byte, options ...WriteOptions) error {
+	b := NewWriteBatch()
+	b.DeleteRange(start, end)
+
+	return t.Write(b, options...)
+}
+
 // Delete delete the value by key from the db.
-func (t *LSMTree) Delete(key []byte) error {
-	val := t.encoder.Encode(encoder.OpKindDelete, nil)
-	if err := t.wal.Append(key, val); err != nil {
-		return fmt.Errorf("failed to append to file %s: %w", t.wal.Name(), err)
+func (t *LSMTree) Delete(key []byte, options ...WriteOptions) error {
+	b := NewWriteBatch()
+	b.Delete(key)
+
+	return t.Write(b, options...)
+}
+
+// Flush makes the MemTable of the default column family immutable and schedules its flush,
+// it waits for the flush of all immutable MemTables if wait is set.
+func (t *LSMTree) Flush(wait bool) error {
+	return t.defaultFamily.Flush(wait)
+}
+
+// flushMemTable делает текущую MemTable неизменяемой и сбрасывает на диск
+// все неизменяемые MemTable семейства.
+func (cf *ColumnFamily) flushMemTable() error {
+	cf.t.lock.Lock()
+	cf.switchMemTable()
+	cf.t.lock.Unlock()
+
+	for {
+		ok, err := cf.flushImmutable()
+		if err != nil || !ok {
+			return err
+		}
 	}
+}
 
-	t.mem.Put(key, val)
+// full reports whether the MemTable reached the threshold. Called under the lock of the tree.
+func (cf *ColumnFamily) full() bool {
+	return cf.mem.Size() >= uint64(cf.config.MemtblDataSize)
+}
 
-	return nil
+// hasRoom reports whether the MemTable can be made immutable
+// without exceeding MaxWriteBufferNumber. Called under the lock of the tree.
+func (cf *ColumnFamily) hasRoom() bool {
+	return len(cf.imm)+1 < max(cf.config.MaxWriteBufferNumber, 2)
+}
+
+// switchMemTable makes the MemTable immutable, the writes go to the new MemTable
+// and the immutable one is flushed by the flush job. Called under the lock of the tree.
+func (cf *ColumnFamily) switchMemTable() {
+	if cf.mem.Size() == 0 {
+		return
+	}
+
+	cf.imm = append([]*memtable.Memtable{cf.mem}, cf.imm...)
+	cf.mem = memtable.NewMem(memtable.Comparator(cf.t.cmp))
+	cf.install()
+	// the writes to the new MemTable go to the new WAL segment
+	cf.t.wal.Rotate(cf.t.wal.Sequence() + 1)
+
+	select {
+	case cf.t.cFlush <- struct{}{}:
+	default:
+	}
+}
+
+// flushJob flushes the immutable MemTables of the families in the background.
+func (t *LSMTree) flushJob() {
+	defer t.wg.Done()
+	for {
+		select {
+		case <-t.cFlush:
+			t.lock.RLock()
+			families := make([]*ColumnFamily, 0, len(t.families))
+			for _, cf := range t.families {
+				families = append(families, cf)
+			}
+			t.lock.RUnlock()
+
+			for _, cf := range families {
+				for {
+					ok, err := cf.flushImmutable()
+					if err != nil {
+						logger.Error(err.Error(), slog.String("call", "flush job"))
+						// the flush is retried, the writers may wait for it
+						time.AfterFunc(time.Second, func() {
+							select {
+							case t.cFlush <- struct{}{}:
+							default:
+							}
+						})
+					}
+					if err != nil || !ok {
+						break
+					}
+				}
+			}
+
+		case <-t.ctx.Done():
+			return
+		}
+	}
 }
 
-// flushMemTable сбрасывает текущую MemTable на диск и очищает ее.
-// Функция ожидает, что она будет выполняться в синхронизированном блоке,
-// и поэтому не использует никаких механизмов синхронизации.
-func (t *LSMTree) flushMemTable() error {
-	dirname := sst.PathForLevel(t.root, sst.BaseLevel)
+// flushImmutable сбрасывает самую старую неизменяемую MemTable на диск и сообщает,
+// была ли такая MemTable. Файл записывается без блокировки дерева, записи идут
+// в новую MemTable, а сбрасываемая остается видна читателям, пока файл не добавлен в уровень.
+func (cf *ColumnFamily) flushImmutable() (bool, error) {
+	cf.flushLock.Lock()
+	defer cf.flushLock.Unlock()
+
+	cf.t.lock.RLock()
+	if len(cf.imm) == 0 {
+		cf.t.lock.RUnlock()
+		return false, nil
+	}
+	mem := cf.imm[len(cf.imm)-1]
+	rw := cf.newBlobRewriter(0)
+	cf.t.lock.RUnlock()
+	defer rw.release()
+
+	dirname := sst.PathForLevel(cf.root, sst.BaseLevel)
 	if _, err := os.Stat(dirname); os.IsNotExist(err) {
 		os.MkdirAll(dirname, os.FileMode(0700))
 	}
 
-	//filename := t.fobserver.NewNext(sst.BaseLevel)
+	//filename := cf.fobserver.NewNext(sst.BaseLevel)
 	// filename, err := sst.NextFilename(dirname)
 	// if err != nil {
 	// 	return err
@@ -285,49 +565,112 @@ func (t *LSMTree) flushMemTable() error {
 	filename := sst.NewNext()
 	//fmt.Println(filename)
 
-	wr, err := sst.NewWriter(path.Join(dirname, filename), sst.SparseKeyDistance(t.sparseKeyDistance))
+	// the file is synced, since the WAL segments are removed after the flush,
+	// and is not listed by the level until it is renamed
+	wr, err := sst.NewWriter(path.Join(dirname, "flush-"+filename), sst.SparseKeyDistance(cf.t.sparseKeyDistance), sst.FileSync(true))
 	if err != nil {
-		return err
+		return false, err
 	}
 	//fmt.Println("start flush")
-	mem := t.mem.Switch()
 
 	filter := bloom.New(mem.Len(), 100)
 	it := mem.Iterator()
 	for it.HasNext() {
 		k, v := it.Next()
-		filter.Add(string(k))
+		// the large values are written to the blob file
+		if v, err = rw.Rewrite(v); err != nil {
+			return false, err
+		}
+		filter.Add(string(encoder.UserKey(k)))
 		//fmt.Println(string(k), string(v))
 		if err := wr.Write(k, v); err != nil {
-			return err
+			return false, err
+		}
+	}
+	for _, rt := range mem.RangeTombstones() {
+		if err := wr.WriteRangeTombstone(rt); err != nil {
+			return false, err
 		}
 	}
 
-	if err := wr.AddIdxBlock(t.wal.Sequence()); err != nil {
-		return err
+	// the blob file is synced before the file referring to it
+	if err := rw.close(); err != nil {
+		return false, err
+	}
+
+	if err := wr.AddIdxBlock(mem.MaxSequence()); err != nil {
+		return false, err
 	}
 
 	if err := wr.Close(); err != nil {
-		return err
+		return false, err
 	}
-	rd, err := wr.Reader()
+
+	cf.t.lock.Lock()
+	defer cf.t.lock.Unlock()
+
+	// the blob files are recorded before the file referring to them is renamed to the level,
+	// so the level has no file with the blob files not recorded even after the crash.
+	// Both are done under the lock, since the compaction drops the refs of level 0 without the files
+	if err := cf.addBlobRefs(rw.refs); err != nil {
+		return false, err
+	}
+	if err := os.Rename(wr.Name(), path.Join(dirname, filename)); err != nil {
+		return false, err
+	}
+	rd, err := sst.NewReader(path.Join(dirname, filename), cf.t.readerOptions()...)
 	if err != nil {
-		return err
+		return false, err
+	}
+	cf.fobserver.Append(sst.BaseLevel, sst.NewCache(rd, *filter))
+	cf.imm = slices.Clone(cf.imm[:len(cf.imm)-1])
+	cf.install()
+	cf.scheduleMerge()
+
+	// the segments of the flushed MemTable are removed
+	if err := cf.t.wal.MarkFlushed(cf.t.flushedSequence(mem.MaxSequence())); err != nil {
+		return true, err
 	}
 
-	if err := t.wal.UpSequence(); err != nil {
-		return err
+	return true, nil
+}
+
+// readerOptions returns the options of the readers of the SST files.
+func (t *LSMTree) readerOptions() []sst.OptionReader {
+	return []sst.OptionReader{sst.KeyCompare(encoder.InternalCompare(t.cmp)), sst.VerifyOnRead(t.verifyChecksums)}
+}
+
+// VerifyChecksums reads the SST files of all column families and verifies their blocks
+// by the checksums. Returns *sst.ErrCorruption for the first damaged file.
+func (t *LSMTree) VerifyChecksums() error {
+	t.lock.RLock()
+	versions := make([]*sst.Version, 0, len(t.families))
+	for _, cf := range t.families {
+		versions = append(versions, cf.fobserver.Version())
 	}
-	//log.Println(len(t.fobserver.Level(sst.BaseLevel)))
-	t.fobserver.Append(sst.BaseLevel, sst.NewCache(rd, *filter))
-	t.wal.Clear()
+	t.lock.RUnlock()
 
-	return nil
+	var err error
+	for _, v := range versions {
+		for _, file := range v.Files() {
+			if err == nil {
+				err = file.Reader.VerifyChecksums()
+			}
+		}
+		if rerr := v.Release(); rerr != nil {
+			logger.Error(rerr.Error())
+		}
+	}
+
+	return err
 }
 
 func (t *LSMTree) Shutdown() error {
 	t.cancel()
-	close(t.cSST)
+	// the writers waiting for the flush are woken up
+	t.lock.Lock()
+	t.installed.Broadcast()
+	t.lock.Unlock()
 	t.wg.Wait()
 
 	return nil
@@ -2,11 +2,20 @@ package lsm
 
 import (
 	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"fmt"
 	"os"
+	"path"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/go-faker/faker/v4"
 	"github.com/google/uuid"
+	"github.com/s-ilyin/lsm-distributed/lsm/sst"
+	"github.com/s-ilyin/lsm-distributed/lsm/wal"
 )
 
 type kv struct {
@@ -71,3 +80,485 @@ func TestGet(t *testing.T) {
 		}
 	}
 }
+
+func TestSequence(t *testing.T) {
+	var dir = "tmp-test-sequence"
+	l, err := Open(dir, MemTableThreshold(1<<20))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// both versions of the key are flushed to the same file
+	l.Put([]byte("a"), []byte("a1"))
+	l.Put([]byte("a"), []byte("a2"))
+	l.Put([]byte("b"), []byte("b1"))
+	if err := l.defaultFamily.flushMemTable(); err != nil {
+		t.Fatal(err)
+	}
+	l.Put([]byte("b"), []byte("b2"))
+
+	if err := l.defaultFamily.compact(sst.BaseLevel); err != nil {
+		t.Fatal(err)
+	}
+
+	files := l.defaultFamily.fobserver.Level(sst.BaseLevel + 1)
+	if len(files) != 1 {
+		t.Fatalf("want %d files expect %d", 1, len(files))
+	}
+	it, err := files[0].Reader.Iterator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var n int
+	for it.HasNext() {
+		if _, _, err := it.Next(); err != nil {
+			t.Fatal(err)
+		}
+		n++
+	}
+	if n != 2 {
+		t.Fatalf("want %d entries after compaction expect %d", 2, n)
+	}
+
+	seq := l.wal.Sequence()
+	l.Shutdown()
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	l, err = Open(dir, MemTableThreshold(1<<20))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Shutdown()
+
+	if l.wal.Sequence() != seq {
+		t.Fatalf("want sequence %d expect %d", seq, l.wal.Sequence())
+	}
+	for _, tt := range []kv{{k: []byte("a"), v: []byte("a2")}, {k: []byte("b"), v: []byte("b2")}} {
+		v, ok, err := l.Get(tt.k)
+		if err != nil || !ok {
+			t.Fatalf("key %s not found: %v", tt.k, err)
+		}
+		if !bytes.Equal(tt.v, v) {
+			t.Fatalf("[val] want %s expect %s", tt.v, v)
+		}
+	}
+}
+
+func TestWALSegments(t *testing.T) {
+	var dir = "tmp-test-wal-segments"
+	l, err := Open(dir, MemTableThreshold(1<<20))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	segments := func(want ...string) {
+		t.Helper()
+		names, err := filepath.Glob(path.Join(dir, "wal", "*.log"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, name := range names {
+			got = append(got, path.Base(name))
+		}
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Fatalf("want segments %v expect %v", want, got)
+		}
+	}
+
+	l.Put([]byte("a"), []byte("a"))
+	l.Put([]byte("b"), []byte("b"))
+	if err := l.defaultFamily.flushMemTable(); err != nil {
+		t.Fatal(err)
+	}
+	// the new MemTable starts the new segment, the flushed one is removed
+	l.Put([]byte("c"), []byte("c"))
+	segments("000002.log")
+
+	header, err := os.ReadFile(path.Join(dir, "wal", "000002.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if start := binary.LittleEndian.Uint64(header[8:16]); start != 3 {
+		t.Fatalf("want start sequence %d expect %d", 3, start)
+	}
+
+	// only the records not flushed are replayed
+	l.Put([]byte("d"), []byte("d"))
+	l.Shutdown()
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if l, err = Open(dir, MemTableThreshold(1<<20)); err != nil {
+		t.Fatal(err)
+	}
+	defer l.Shutdown()
+
+	if l.wal.Sequence() != 4 {
+		t.Fatalf("want sequence %d expect %d", 4, l.wal.Sequence())
+	}
+	if n := l.defaultFamily.mem.Len(); n != 2 {
+		t.Fatalf("want %d replayed entries expect %d", 2, n)
+	}
+	for _, k := range []string{"a", "b", "c", "d"} {
+		if _, ok, _ := l.Get([]byte(k)); !ok {
+			t.Fatalf("key %s not found", k)
+		}
+	}
+
+	// the segment is kept until its MemTable is flushed
+	l.Put([]byte("e"), []byte("e"))
+	segments("000002.log", "000003.log")
+	if err := l.defaultFamily.flushMemTable(); err != nil {
+		t.Fatal(err)
+	}
+	segments("000003.log")
+}
+
+func TestWALCompression(t *testing.T) {
+	var dir = "tmp-test-wal-compression"
+	compressor, err := wal.NewFlate(flate.BestSpeed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	value := bytes.Repeat([]byte(`{"name":"value","tags":["a","b"]}`), 32)
+
+	open := func(options ...func(*LSMTree)) *LSMTree {
+		t.Helper()
+		l, err := Open(dir, append(options, MemTableThreshold(1<<20))...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return l
+	}
+	reopen := func(l *LSMTree, options ...func(*LSMTree)) *LSMTree {
+		t.Helper()
+		l.Shutdown()
+		if err := l.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return open(options...)
+	}
+
+	l := open(WALCompression(compressor))
+	defer os.RemoveAll(dir)
+	l.Put([]byte("a"), value)
+	stat, err := os.Stat(l.wal.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stat.Size() >= int64(len(value)) {
+		t.Fatalf("want the segment smaller than %d expect %d", len(value), stat.Size())
+	}
+
+	// every segment is read with the compressor of its header
+	l = reopen(l)
+	l.Put([]byte("b"), value)
+	l = reopen(l, WALCompression(compressor))
+	l.Put([]byte("c"), value)
+	l = reopen(l)
+	defer l.Shutdown()
+
+	for idx, codec := range []uint32{wal.FlateID, 0, wal.FlateID} {
+		header, err := os.ReadFile(path.Join(dir, "wal", fmt.Sprintf("%06d.log", idx+1)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := binary.LittleEndian.Uint32(header[16:20]); got != codec {
+			t.Fatalf("segment %d: want compressor %d expect %d", idx+1, codec, got)
+		}
+	}
+	for _, k := range []string{"a", "b", "c"} {
+		if v, ok, _ := l.Get([]byte(k)); !ok || !bytes.Equal(v, value) {
+			t.Fatalf("want %s expect %s", value, v)
+		}
+	}
+}
+
+func TestWALRecoveryModes(t *testing.T) {
+	var dir = "tmp-test-wal-recovery-modes"
+	defer os.RemoveAll(dir)
+
+	// every value takes more than one block of the segment
+	value := func(k string) []byte { return bytes.Repeat([]byte(k), 40<<10) }
+	// write writes the keys and damages the segment by the offsets of the records
+	write := func(damage func(name string, offsets []int64)) {
+		t.Helper()
+		os.RemoveAll(dir)
+		l, err := Open(dir, MemTableThreshold(1<<20))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var offsets []int64
+		for _, k := range []string{"a", "b", "c"} {
+			if err := l.Put([]byte(k), value(k)); err != nil {
+				t.Fatal(err)
+			}
+			stat, err := os.Stat(l.wal.Name())
+			if err != nil {
+				t.Fatal(err)
+			}
+			offsets = append(offsets, stat.Size())
+		}
+		name := l.wal.Name()
+		l.Shutdown()
+		if err := l.Close(); err != nil {
+			t.Fatal(err)
+		}
+		damage(name, offsets)
+	}
+	// flip flips the byte in the middle of the second record
+	flip := func(name string, offsets []int64) {
+		bs, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		bs[(offsets[0]+offsets[1])/2] ^= 0xff
+		if err := os.WriteFile(name, bs, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// tear cuts off the end of the last record
+	tear := func(name string, offsets []int64) {
+		if err := os.Truncate(name, offsets[2]-2); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tt := range []struct {
+		name    string
+		mode    wal.RecoveryMode
+		damage  func(string, []int64)
+		keys    string
+		dropped int
+		fails   bool
+	}{
+		{name: "point in time", mode: wal.PointInTime, damage: flip, keys: "a", dropped: 2},
+		{name: "skip any corrupted", mode: wal.SkipAnyCorrupted, damage: flip, keys: "ac", dropped: 1},
+		{name: "tolerate corrupted tail", mode: wal.TolerateCorruptedTail, damage: flip, fails: true},
+		{name: "tolerate torn tail", mode: wal.TolerateCorruptedTail, damage: tear, keys: "ab", dropped: 1},
+		{name: "absolute consistency", mode: wal.AbsoluteConsistency, damage: tear, fails: true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			write(tt.damage)
+			l, err := Open(dir, MemTableThreshold(1<<20), WALRecoveryMode(tt.mode))
+			if tt.fails {
+				if err == nil {
+					l.Shutdown()
+					t.Fatalf("the damaged record is accepted")
+				}
+				if !errors.Is(err, wal.ErrChecksum) && !errors.Is(err, wal.ErrTornRecord) {
+					t.Fatalf("unexpected error %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer l.Shutdown()
+
+			var keys string
+			for _, k := range []string{"a", "b", "c"} {
+				if v, ok, _ := l.Get([]byte(k)); ok {
+					if !bytes.Equal(v, value(k)) {
+						t.Fatalf("key %s: unexpected value", k)
+					}
+					keys += k
+				}
+			}
+			if keys != tt.keys {
+				t.Fatalf("want keys %s expect %s", tt.keys, keys)
+			}
+			if stats := l.RecoveryStats(); stats.DroppedRecords != tt.dropped || stats.DroppedBytes == 0 {
+				t.Fatalf("want %d dropped records expect %+v", tt.dropped, stats)
+			}
+		})
+	}
+
+	// the records dropped at the point in time are not replayed before the new ones
+	write(flip)
+	l, err := Open(dir, MemTableThreshold(1<<20))
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Put([]byte("d"), []byte("d"))
+	l.Shutdown()
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if l, err = Open(dir, MemTableThreshold(1<<20)); err != nil {
+		t.Fatal(err)
+	}
+	defer l.Shutdown()
+	if stats := l.RecoveryStats(); stats.DroppedRecords != 0 {
+		t.Fatalf("want no dropped records expect %+v", stats)
+	}
+	for _, k := range []string{"a", "d"} {
+		if _, ok, _ := l.Get([]byte(k)); !ok {
+			t.Fatalf("key %s not found", k)
+		}
+	}
+}
+
+func TestLargeEntries(t *testing.T) {
+	var dir = "tmp-test-large-entries"
+	l, err := Open(dir, MemTableThreshold(8<<20))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var (
+		key = bytes.Repeat([]byte("k"), MaxKeySize)
+		val = bytes.Repeat([]byte("v"), 4<<20)
+	)
+	if err := l.Put(append(key, 'k'), []byte("v")); !errors.Is(err, ErrKeyTooLarge) {
+		t.Fatalf("want %v expect %v", ErrKeyTooLarge, err)
+	}
+	if err := l.Put(key, val); err != nil {
+		t.Fatal(err)
+	}
+	l.Put([]byte("a"), []byte("a"))
+
+	check := func() {
+		t.Helper()
+		if v, ok, err := l.Get(key); err != nil || !ok || !bytes.Equal(v, val) {
+			t.Fatalf("want %d bytes expect %d (%v)", len(val), len(v), err)
+		}
+		if v, _, _ := l.Get([]byte("a")); !bytes.Equal(v, []byte("a")) {
+			t.Fatalf("want %s expect %s", "a", v)
+		}
+	}
+
+	// replayed from the WAL
+	l.Shutdown()
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if l, err = Open(dir, MemTableThreshold(8<<20)); err != nil {
+		t.Fatal(err)
+	}
+	defer l.Shutdown()
+	check()
+
+	// and read from the file
+	if err := l.defaultFamily.flushMemTable(); err != nil {
+		t.Fatal(err)
+	}
+	check()
+}
+
+func TestImmutableMemTables(t *testing.T) {
+	var dir = "tmp-test-immutable-memtables"
+	l, err := Open(dir, MemTableThreshold(64), MaxWriteBufferNumber(3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer l.Shutdown()
+
+	key := func(i int) []byte { return []byte(fmt.Sprintf("key-%03d", i)) }
+	cf := l.defaultFamily
+
+	// the flush is held, so the full MemTables stay immutable
+	cf.flushLock.Lock()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			l.Put(key(i), []byte("value-value-value"))
+		}
+	}()
+
+	// the writes wait when the family has MaxWriteBufferNumber MemTables
+	select {
+	case <-done:
+		cf.flushLock.Unlock()
+		t.Fatalf("the writes are not stalled")
+	case <-time.After(100 * time.Millisecond):
+	}
+	l.lock.RLock()
+	n := len(cf.imm)
+	l.lock.RUnlock()
+	if n != 2 {
+		cf.flushLock.Unlock()
+		t.Fatalf("want %d immutable MemTables expect %d", 2, n)
+	}
+
+	// the immutable MemTables are searched
+	if _, ok, err := l.Get(key(0)); !ok {
+		cf.flushLock.Unlock()
+		t.Fatalf("key %s not found: %v", key(0), err)
+	}
+
+	cf.flushLock.Unlock()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("the writes are not resumed after the flush")
+	}
+	for i := 0; i < 100; i++ {
+		if _, ok, err := l.Get(key(i)); !ok {
+			t.Fatalf("key %s not found: %v", key(i), err)
+		}
+	}
+	if len(cf.fobserver.Level(sst.BaseLevel)) == 0 {
+		t.Fatalf("the immutable MemTables are not flushed")
+	}
+}
+
+func TestVerifyChecksums(t *testing.T) {
+	var dir = "tmp-test-verify-checksums"
+	l, err := Open(dir, MemTableThreshold(1<<20))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	l.Put([]byte("a"), []byte("a"))
+	if err := l.Flush(true); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.VerifyChecksums(); err != nil {
+		t.Fatal(err)
+	}
+	l.Shutdown()
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	files, _ := filepath.Glob(path.Join(sst.PathForLevel(dir, sst.BaseLevel), "*.sst"))
+	if len(files) != 1 {
+		t.Fatalf("want %d files expect %v", 1, files)
+	}
+	data, err := os.ReadFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the key of the only entry: [key length][value length][key]
+	data[2] ^= 0xff
+	if err := os.WriteFile(files[0], data, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	l, err = Open(dir, VerifyChecksumsOnRead(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Shutdown()
+
+	var corruption *sst.ErrCorruption
+	if _, _, err := l.Get([]byte("a")); !errors.As(err, &corruption) {
+		t.Fatalf("want %T expect %v", corruption, err)
+	}
+	if corruption.File != files[0] || corruption.Offset != 0 {
+		t.Fatalf("want %s at %d expect %s at %d", files[0], 0, corruption.File, corruption.Offset)
+	}
+	if err := l.VerifyChecksums(); !errors.Is(err, sst.ErrChecksum) {
+		t.Fatalf("want %v expect %v", sst.ErrChecksum, err)
+	}
+}
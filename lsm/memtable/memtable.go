@@ -1,80 +1,254 @@
 package memtable
 
-import sl "github.com/s-ilyin/lsm-distributed/lsm/skiplist"
+import (
+	"bytes"
+	"sync"
+
+	"github.com/s-ilyin/lsm-distributed/lsm/encoder"
+	sl "github.com/s-ilyin/lsm-distributed/lsm/skiplist"
+)
 
 type Memtable struct {
-	data *sl.SkipList
-	b    int
-	len  int
+	// the table is read by the readers while it is written
+	lock      sync.RWMutex
+	cmp       encoder.Comparator
+	data      *sl.SkipList
+	rangeDels []encoder.RangeTombstone
+	b         int
+	len       int
+	minSeq    uint64
+	maxSeq    uint64
 }
 
 // MemTable. All changes that are flushed to the WAL, but not flushed
 // to the sorted files, are stored in memory for faster lookups.
 // A red-black instance might be used directly, but the wrapper and additional
 // layer of abstraction simplifies further changes.
-func NewMem() *Memtable {
-	return &Memtable{
-		data: sl.NewSkipList(),
+// The keys of the table are internal keys (see encoder.MakeInternalKey),
+// so every version of a user key is kept as a separate entry.
+func NewMem(options ...Option) *Memtable {
+	mt := &Memtable{cmp: encoder.BytewiseComparator}
+	for _, opt := range options {
+		opt(mt)
 	}
+	mt.data = mt.newSkipList()
+
+	return mt
+}
+
+type Option func(*Memtable)
+
+// Comparator sets the order of the user keys of the table.
+// The keys are ordered by encoder.BytewiseComparator by default.
+func Comparator(cmp encoder.Comparator) Option {
+	return func(mt *Memtable) {
+		mt.cmp = cmp
+	}
+}
+
+func (mt *Memtable) newSkipList() *sl.SkipList {
+	return sl.NewSkipList(sl.Comparer(encoder.InternalCompare(mt.cmp)))
 }
 
-// put puts the key and the value into the table.
+// put puts the internal key and the value into the table.
+// The range tombstones (the start key and the encoded end key)
+// are kept apart from the point entries.
 func (mt *Memtable) Put(key, val []byte) {
-	prev, ex := mt.data.Put(key, val)
-	if ex {
+	mt.lock.Lock()
+	defer mt.lock.Unlock()
+
+	ukey, seq, kind := encoder.ParseInternalKey(key)
+	if kind == encoder.OpKindRangeDelete {
+		mt.rangeDels = append(mt.rangeDels, encoder.RangeTombstone{
+			Start: ukey,
+			End:   encoder.NewDecoder().Decode(val).Value(),
+			Seq:   seq,
+		})
+		mt.b += len(key) + len(val)
+	} else if prev, ex := mt.data.Put(key, val); ex {
 		mt.b += -len(prev) + len(val)
 	} else {
 		mt.b += len(key) + len(val)
 		mt.len++
 	}
+
+	if seq > mt.maxSeq {
+		mt.maxSeq = seq
+	}
+	if mt.minSeq == 0 || seq < mt.minSeq {
+		mt.minSeq = seq
+	}
 }
 
-// get returns the value by the key.
+// RangeTombstones returns the range tombstones put into the table.
+func (mt *Memtable) RangeTombstones() []encoder.RangeTombstone {
+	mt.lock.RLock()
+	defer mt.lock.RUnlock()
+
+	return mt.rangeDels[:len(mt.rangeDels):len(mt.rangeDels)]
+}
+
+// get returns the newest value of the user key with sequence
+// less than or equal to seq.
 // Caution! Get returns true for the removed keys in the memory.
-func (mt *Memtable) Get(key []byte) ([]byte, bool) {
-	return mt.data.Get(key)
+func (mt *Memtable) Get(key []byte, seq uint64) ([]byte, bool) {
+	_, v, ok := mt.Lookup(key, seq)
+
+	return v, ok
+}
+
+// Lookup returns the internal key and the value of the newest version
+// of the key with the sequence number not greater than seq.
+func (mt *Memtable) Lookup(key []byte, seq uint64) ([]byte, []byte, bool) {
+	mt.lock.RLock()
+	defer mt.lock.RUnlock()
+
+	it := mt.data.Iterator()
+	k, v := it.SeekGE(encoder.MakeInternalKey(key, seq, encoder.OpKindSeek))
+	if k == nil || !bytes.Equal(encoder.UserKey(k), key) {
+		return nil, nil, false
+	}
+
+	return k, v, true
+}
+
+// MinSequence returns the smallest sequence number put into the table.
+func (mt *Memtable) MinSequence() uint64 {
+	mt.lock.RLock()
+	defer mt.lock.RUnlock()
+
+	return mt.minSeq
+}
+
+// MaxSequence returns the largest sequence number put into the table.
+func (mt *Memtable) MaxSequence() uint64 {
+	mt.lock.RLock()
+	defer mt.lock.RUnlock()
+
+	return mt.maxSeq
 }
 
 func (mt *Memtable) Len() int {
+	mt.lock.RLock()
+	defer mt.lock.RUnlock()
+
 	return mt.len
 }
 
 // bytes returns the size of all keys and values inserted into the MemTable in bytes.
-func (mt *Memtable) Size() uint32 {
-	return uint32(mt.b)
+func (mt *Memtable) Size() uint64 {
+	mt.lock.RLock()
+	defer mt.lock.RUnlock()
+
+	return uint64(mt.b)
 }
 
-func (mt *Memtable) Switch() Memtable {
-	old := *mt
-	mt.data = sl.NewSkipList()
+// Switch moves the data to the new table and returns it.
+func (mt *Memtable) Switch() *Memtable {
+	mt.lock.Lock()
+	defer mt.lock.Unlock()
+
+	old := &Memtable{
+		cmp:       mt.cmp,
+		data:      mt.data,
+		rangeDels: mt.rangeDels,
+		b:         mt.b,
+		len:       mt.len,
+		minSeq:    mt.minSeq,
+		maxSeq:    mt.maxSeq,
+	}
+	mt.data = mt.newSkipList()
+	mt.rangeDels = nil
 	mt.b = 0
 	mt.len = 0
+	mt.minSeq = 0
+	mt.maxSeq = 0
 
 	return old
 }
 
 // clear clears all the data and resets the size.
 func (mt *Memtable) Clear() {
-	mt.data = sl.NewSkipList()
+	mt.lock.Lock()
+	defer mt.lock.Unlock()
+
+	mt.data = mt.newSkipList()
+	mt.rangeDels = nil
 	mt.b = 0
+	mt.minSeq = 0
+	mt.maxSeq = 0
 }
 
 // iterator returns iterator for the MemTable. It also iterates over
 // deleted keys, but the value for them is nil.
+// The iterator may be used while the table is written.
 func (mt *Memtable) Iterator() *MemTableIterator {
+	mt.lock.RLock()
+	defer mt.lock.RUnlock()
+
 	return &MemTableIterator{
+		mt: mt,
 		it: mt.data.Iterator(),
 	}
 }
 
 type MemTableIterator struct {
+	mt *Memtable
 	it *sl.Iterator
 }
 
 func (it *MemTableIterator) HasNext() bool {
+	it.mt.lock.RLock()
+	defer it.mt.lock.RUnlock()
+
 	return it.it.HasNext()
 }
 
 func (it *MemTableIterator) Next() ([]byte, []byte) {
+	it.mt.lock.RLock()
+	defer it.mt.lock.RUnlock()
+
 	return it.it.Next()
 }
+
+func (it *MemTableIterator) HasPrev() bool {
+	it.mt.lock.RLock()
+	defer it.mt.lock.RUnlock()
+
+	return it.it.HasPrev()
+}
+
+func (it *MemTableIterator) Prev() ([]byte, []byte) {
+	it.mt.lock.RLock()
+	defer it.mt.lock.RUnlock()
+
+	return it.it.Prev()
+}
+
+func (it *MemTableIterator) First() ([]byte, []byte) {
+	it.mt.lock.RLock()
+	defer it.mt.lock.RUnlock()
+
+	return it.it.First()
+}
+
+func (it *MemTableIterator) Last() ([]byte, []byte) {
+	it.mt.lock.RLock()
+	defer it.mt.lock.RUnlock()
+
+	return it.it.Last()
+}
+
+func (it *MemTableIterator) SeekGE(key []byte) ([]byte, []byte) {
+	it.mt.lock.RLock()
+	defer it.mt.lock.RUnlock()
+
+	return it.it.SeekGE(key)
+}
+
+func (it *MemTableIterator) SeekLT(key []byte) ([]byte, []byte) {
+	it.mt.lock.RLock()
+	defer it.mt.lock.RUnlock()
+
+	return it.it.SeekLT(key)
+}
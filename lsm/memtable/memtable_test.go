@@ -2,23 +2,53 @@ package memtable
 
 import (
 	"testing"
+
+	"github.com/s-ilyin/lsm-distributed/lsm/encoder"
 )
 
 func TestMemSwitch(t *testing.T) {
 	mem := NewMem()
-	mem.Put([]byte("a"), []byte("a"))
+	mem.Put(encoder.MakeInternalKey([]byte("a"), 1, encoder.OpKindSet), []byte("a"))
 
 	sMem := mem.Switch()
-	if _, ok := mem.Get([]byte("a")); ok {
+	if _, ok := mem.Get([]byte("a"), encoder.MaxSequence); ok {
 		t.Fatal("key found!")
 	}
 
-	if _, ok := sMem.Get([]byte("a")); !ok {
+	if _, ok := sMem.Get([]byte("a"), encoder.MaxSequence); !ok {
 		t.Fatal("key not found!")
 	}
 
-	mem.Put([]byte("b"), []byte("b"))
-	if _, ok := mem.Get([]byte("b")); !ok {
+	mem.Put(encoder.MakeInternalKey([]byte("b"), 2, encoder.OpKindSet), []byte("b"))
+	if _, ok := mem.Get([]byte("b"), encoder.MaxSequence); !ok {
 		t.Fatal("key not found!")
 	}
 }
+
+func TestMemVersions(t *testing.T) {
+	mem := NewMem()
+	mem.Put(encoder.MakeInternalKey([]byte("a"), 1, encoder.OpKindSet), []byte("v1"))
+	mem.Put(encoder.MakeInternalKey([]byte("a"), 3, encoder.OpKindSet), []byte("v3"))
+	mem.Put(encoder.MakeInternalKey([]byte("ab"), 2, encoder.OpKindSet), []byte("ab"))
+
+	tests := []struct {
+		seq  uint64
+		want string
+		ok   bool
+	}{
+		{seq: 0, ok: false},
+		{seq: 1, want: "v1", ok: true},
+		{seq: 2, want: "v1", ok: true},
+		{seq: 3, want: "v3", ok: true},
+		{seq: encoder.MaxSequence, want: "v3", ok: true},
+	}
+	for _, tt := range tests {
+		v, ok := mem.Get([]byte("a"), tt.seq)
+		if ok != tt.ok || string(v) != tt.want {
+			t.Fatalf("seq %d: want %s %v expect %s %v", tt.seq, tt.want, tt.ok, v, ok)
+		}
+	}
+	if mem.MaxSequence() != 3 {
+		t.Fatalf("want max sequence %d expect %d", 3, mem.MaxSequence())
+	}
+}
@@ -5,30 +5,41 @@ import (
 	"fmt"
 	"log"
 	"log/slog"
+	"maps"
 	"math"
 	"os"
+	"path"
+	"path/filepath"
+	"slices"
 	"time"
 
 	"github.com/s-ilyin/lsm-distributed/lsm/sst"
 )
 
 // MergeJob runs as a background thread and coordinates when to check SST levels for merging.
-func (t *LSMTree) mergeJob() {
-	defer t.wg.Done()
-	if t.config.Merge.Interval == 0 {
+func (cf *ColumnFamily) mergeJob() {
+	defer cf.t.wg.Done()
+	cf.t.lock.RLock()
+	interval := cf.config.Merge.Interval
+	cf.t.lock.RUnlock()
+	if interval == 0 {
 		log.Println("mergeJob interval not set, stopping goroutine")
 		return
 	}
-	ticker := time.NewTicker(t.config.Merge.Interval)
+	ticker := time.NewTicker(interval)
 
 	for {
 		select {
 		case <-ticker.C:
-			//log.Println("LSM merge job woke up")
-			if err := t.merge(); err != nil {
-				t.logger.Debug(err.Error())
+			if err := cf.merge(); err != nil {
+				cf.t.logger.Debug(err.Error())
 			}
-		case <-t.ctx.Done():
+		case <-cf.cMerge:
+			// the flush added the file or the writers are stalled
+			if err := cf.merge(); err != nil {
+				cf.t.logger.Debug(err.Error())
+			}
+		case <-cf.t.ctx.Done():
 			return
 		}
 
@@ -36,51 +47,69 @@ func (t *LSMTree) mergeJob() {
 }
 
 func (s *LSMTree) SetMergeSettings(ms MergeSettings) {
-	s.config.Merge = ms
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.defaultFamily.config.Merge = ms
+	s.defaultFamily.pendingBytes = s.defaultFamily.pendingCompactionBytes()
 }
 
-func (t *LSMTree) merge() error {
+func (cf *ColumnFamily) merge() error {
+	// the settings may be changed while the levels are checked
+	cf.t.lock.RLock()
+	config := *cf.config
+	cf.t.lock.RUnlock()
 
-	for lvl := sst.Level(0); lvl < t.fobserver.Levels(); lvl++ {
-		var (
-			isMerge = false
+	for lvl := sst.Level(0); lvl < cf.fobserver.Levels(); lvl++ {
+		if cf.needsCompaction(lvl, config) {
+			err := cf.compact(lvl)
+			if err != nil {
+				cf.t.logger.Error(err.Error())
+			}
+			cf.setCompactionError(err)
+		}
+	}
 
-			num = t.config.Merge.NumberOfSstFiles
-		)
+	return nil
+}
 
-		l := t.fobserver.Len(lvl)
+// setCompactionError records the result of the compaction, the writers stopped
+// until the compaction are woken up to fail with the error.
+func (cf *ColumnFamily) setCompactionError(err error) {
+	cf.t.lock.Lock()
+	defer cf.t.lock.Unlock()
 
-		// if t.debug {
-		// 	m := num > 0 && len(files) >= num
-		// 	t.logger.Debug("debug", slog.Int("num", num), slog.Int("files", len(files)))
-		// 	t.logger.Debug("нужно сливать?", slog.Bool("is_merge", m))
-		// }
-		//log.Println(lvl, len(files), t.config.Merge.DataSize, t.fobserver.Size(lvl), num > 0 && len(files) >= num && int64(t.config.Merge.DataSize) >= t.fobserver.Size(lvl))
-		if num > 0 && l >= num && l > t.config.Merge.NumberOfSstFiles*(int(lvl)+1) && t.fobserver.Size(lvl) >= int64(t.config.Merge.DataSize) {
-			//log.Printf("merge level %d, number of files %d exceeded merge threshold", lvl, len(files))
-			isMerge = true
+	cf.compactions++
+	cf.compactErr = err
+	if err != nil {
+		cf.t.installed.Broadcast()
+	}
+}
 
-			if sst.Level(lvl) == t.config.Merge.MaxLevels {
-				// условия для последнего уровня
-				isMerge = false
-			}
-		}
+// needsCompaction reports whether the level exceeds the merge thresholds.
+// Level 0 is merged as well when it has enough files to slow down or stop the writes,
+// even if it is the last level, otherwise the stopped writes are never resumed.
+func (cf *ColumnFamily) needsCompaction(lvl sst.Level, config Config) bool {
+	l := cf.fobserver.Len(lvl)
+	if slowdown, stop := config.l0Triggers(); lvl == sst.BaseLevel &&
+		(slowdown > 0 && l >= slowdown || stop > 0 && l >= stop) {
+		return true
+	}
 
-		if isMerge {
-			//t.logger.Debug("debug", slog.Int("merge", lvl))
-			if err := t.compact(lvl); err != nil {
-				t.logger.Error(err.Error())
-			}
-		}
+	settings := config.Merge
+	if lvl == settings.MaxLevels {
+		// условия для последнего уровня
+		return false
 	}
 
-	return nil
+	num := settings.NumberOfSstFiles
+	return num > 0 && l >= num && l > num*(int(lvl)+1) && cf.fobserver.Size(lvl) >= int64(settings.DataSize)
 }
 
 // Merge берет все текущие SST-файлы на уровне и объединяет их с
 // SST-файлами на следующем уровне дерева LSM. Во время этого
 // процесса данные уплотняются, и все старые значения ключей или надгробные плиты удаляются безвозвратно.
-func (t *LSMTree) compact(level sst.Level) error {
+func (cf *ColumnFamily) compact(level sst.Level) error {
 	// Общий алгоритм
 	//
 	// - найти путь к уровню, получить все sst-файлы
@@ -95,68 +124,149 @@ func (t *LSMTree) compact(level sst.Level) error {
 	// - записываем в syslog, считаем WAL
 	// TODO: если level == tree.merge.MaxLevels, то уплотнить этот уровень вместо слияния в l+1
 
+	// the files are taken from the referenced version, so the flushes go on while the files
+	// are merged, and the lock of the tree is held only to install the merged files
+	cf.compactLock.Lock()
+	defer cf.compactLock.Unlock()
+
+	cf.t.lock.RLock()
 	nextLevel := level + 1
-	currentMaxLvl := t.fobserver.MaxLevel()
+	currentMaxLvl := cf.fobserver.MaxLevel()
 	if level > currentMaxLvl {
+		cf.t.lock.RUnlock()
 		desc := fmt.Sprintf("merge cannot process level %d because the tree only has %d levels", level, currentMaxLvl)
 		log.Println(desc)
 
 		return errors.New(desc)
 	}
 
-	if level > 0 && level == sst.Level(t.config.Merge.MaxLevels) {
+	if level > 0 && level == sst.Level(cf.config.Merge.MaxLevels) {
 		// if max lvl
+		cf.t.lock.RUnlock()
 
 		return nil
 	}
-	if !t.config.Merge.Immediate {
-		t.lock.Lock()
-		defer t.lock.Unlock()
+
+	// the live values of the oldest blob files are relocated to the new blob file
+	gcBefore, err := cf.blobGCBefore()
+	if err != nil {
+		cf.t.lock.RUnlock()
+		return err
 	}
-	currFilesLevel := t.fobserver.Level(level)[:]
-	nextFilesLevel := t.fobserver.Level(nextLevel)[:]
-	mergeFilesLevels := append(currFilesLevel, nextFilesLevel...)
+	rw := cf.newBlobRewriter(gcBefore)
+	defer rw.release()
 
-	nextLvlPath := sst.PathForLevel(t.root, nextLevel)
+	v := cf.ref()
+	defer v.unref()
+	currFilesLevel := v.files.Level(level)
+	nextFilesLevel := v.files.Level(nextLevel)
+	mergeFilesLevels := append(append([]sst.File(nil), currFilesLevel...), nextFilesLevel...)
 
-	var rm bool
-	if level == currentMaxLvl {
-		rm = true
-	}
+	// the deleted and expired keys are dropped only if no files are below the merged level,
+	// the levels are loaded up to the last one, so the bottom level is the deepest one with the files
+	rm := cf.fobserver.BottomLevel() <= nextLevel
+
+	size := int64(cf.config.MemtblDataSize * uint32(math.Pow(2, float64(level+1))))
+	sparseKeyDistance := cf.t.sparseKeyDistance * int32(math.Pow(2, float64(level+1)))
+	snapshots := cf.t.snapshots.sequences()
+	cf.t.lock.RUnlock()
+
+	nextLvlPath := sst.PathForLevel(cf.root, nextLevel)
 
 	readers := make([]*sst.Reader, len(mergeFilesLevels))
 	for idx := range mergeFilesLevels {
 		readers[idx] = mergeFilesLevels[idx].Reader
 	}
 
-	size := int64(t.config.MemtblDataSize * uint32(math.Pow(2, float64(level+1))))
-	sparseKeyDistance := t.sparseKeyDistance * int32(math.Pow(2, float64(level+1)))
-
-	//t.logger.Debug("debug", slog.Int("readers", len(readers)))
-	mergedir, err := sst.Compact(t.root, readers, size, sparseKeyDistance, rm)
+	mergedir, err := sst.Compact(cf.root, readers, size, sparseKeyDistance, rm,
+		sst.Snapshots(snapshots), sst.Merger(cf.t.merger), sst.Comparator(cf.t.cmp),
+		sst.Blobs(rw))
+	if cerr := rw.close(); err == nil {
+		err = cerr
+	}
 	if err != nil {
 		return err
 	}
 
-	if err := os.RemoveAll(nextLvlPath); err != nil {
+	// the merged files are moved to the next level, the replaced files
+	// are removed when the readers release the versions referring to them
+	files, err := cf.moveMerged(mergedir, nextLvlPath)
+	if err != nil {
 		return err
 	}
-	if err := os.Rename(mergedir, nextLvlPath); err != nil {
+
+	cf.t.lock.Lock()
+	defer cf.t.lock.Unlock()
+
+	// the replaced files are on the disk until then, so are their blob files
+	refs := maps.Clone(rw.refs)
+	maps.Copy(refs, cf.blobRefs[nextLevel])
+	if err := writeBlobRefs(nextLvlPath, refs); err != nil {
 		return err
 	}
-	for idx := range currFilesLevel {
-		os.Remove(currFilesLevel[idx].Reader.Name())
+
+	// the files flushed to the level in the meantime stay in it
+	var remaining []sst.File
+	for _, f := range cf.fobserver.Level(level) {
+		if !slices.ContainsFunc(currFilesLevel, func(merged sst.File) bool { return merged.Reader == f.Reader }) {
+			remaining = append(remaining, f)
+		}
 	}
+	cf.fobserver.Replace(level, remaining)
+	cf.fobserver.Replace(nextLevel, files)
+	cf.install()
 
-	//log.Println("reload lvl")
-	if err := t.fobserver.Reload(nextLevel); err != nil {
+	// the blob files are removed when no level refers to them,
+	// the refs of the level are kept while the flushed files refer to them
+	cf.blobRefs[nextLevel] = rw.refs
+	if len(remaining) == 0 {
+		delete(cf.blobRefs, level)
+		if err := writeBlobRefs(sst.PathForLevel(cf.root, level), nil); err != nil {
+			return err
+		}
+	}
+	if err := cf.retire(mergeFilesLevels); err != nil {
 		return err
 	}
-	t.fobserver.Flush(level)
 
-	if t.debug {
-		t.logger.Debug("уплотнение закончено", slog.Int("lvl", int(level)))
+	if cf.t.debug {
+		cf.t.logger.Debug("уплотнение закончено", slog.Int("lvl", int(level)))
 	}
 
 	return nil
 }
+
+// moveMerged moves the files merged by the compaction to the directory of the level
+// and opens them.
+func (cf *ColumnFamily) moveMerged(mergedir, dirname string) ([]sst.File, error) {
+	if mergedir == "" {
+		return nil, nil
+	}
+	if err := os.MkdirAll(dirname, os.FileMode(0700)); err != nil {
+		return nil, err
+	}
+
+	entries, err := os.ReadDir(mergedir)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []sst.File
+	for _, e := range entries {
+		if e.IsDir() || filepath.Ext(e.Name()) != ".sst" {
+			continue
+		}
+
+		filename := path.Join(dirname, e.Name())
+		if err := os.Rename(path.Join(mergedir, e.Name()), filename); err != nil {
+			return nil, err
+		}
+		rd, err := sst.NewReader(filename, cf.t.readerOptions()...)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, sst.File{Reader: rd})
+	}
+
+	return files, os.RemoveAll(mergedir)
+}
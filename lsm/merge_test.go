@@ -4,6 +4,8 @@ import (
 	"os"
 	"testing"
 	"time"
+
+	"github.com/s-ilyin/lsm-distributed/lsm/sst"
 )
 
 func TestMerge(t *testing.T) {
@@ -56,3 +58,73 @@ func TestMerge(t *testing.T) {
 
 	time.Sleep(2 * time.Second)
 }
+
+func TestCompactBottomLevel(t *testing.T) {
+	var dir = "tmp-test-compact-bottom-level"
+	l, err := Open(dir, MemTableThreshold(1<<20))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer l.Shutdown()
+
+	// count returns the number of the entries and the range tombstones of the level
+	count := func(level sst.Level) (int, int) {
+		t.Helper()
+		var entries, tombstones int
+		for _, file := range l.defaultFamily.fobserver.Level(level) {
+			it, err := file.Reader.Iterator()
+			if err != nil {
+				t.Fatal(err)
+			}
+			for it.HasNext() {
+				if _, _, err := it.Next(); err != nil {
+					t.Fatal(err)
+				}
+				entries++
+			}
+			tombstones += len(file.Reader.RangeTombstones())
+		}
+		return entries, tombstones
+	}
+
+	l.Put([]byte("z"), []byte("z"))
+	if err := l.defaultFamily.flushMemTable(); err != nil {
+		t.Fatal(err)
+	}
+	for _, level := range []sst.Level{sst.BaseLevel, sst.BaseLevel + 1} {
+		if err := l.defaultFamily.compact(level); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	l.Put([]byte("a"), []byte("a"))
+	l.Put([]byte("y"), []byte("y"))
+	l.DeleteRange([]byte("a"), []byte("b"))
+	l.Delete([]byte("z"))
+	if err := l.defaultFamily.flushMemTable(); err != nil {
+		t.Fatal(err)
+	}
+
+	// level 2 has the files, so the tombstones are kept above it
+	if err := l.defaultFamily.compact(sst.BaseLevel); err != nil {
+		t.Fatal(err)
+	}
+	if entries, tombstones := count(sst.BaseLevel + 1); entries != 2 || tombstones != 1 {
+		t.Fatalf("want %d entries %d tombstones expect %d %d", 2, 1, entries, tombstones)
+	}
+
+	// and dropped with the keys they delete at the bottom level
+	if err := l.defaultFamily.compact(sst.BaseLevel + 1); err != nil {
+		t.Fatal(err)
+	}
+	if entries, tombstones := count(sst.BaseLevel + 2); entries != 1 || tombstones != 0 {
+		t.Fatalf("want %d entries %d tombstones expect %d %d", 1, 0, entries, tombstones)
+	}
+	if _, ok, _ := l.Get([]byte("z")); ok {
+		t.Fatalf("deleted key found")
+	}
+	if v, ok, _ := l.Get([]byte("y")); !ok || string(v) != "y" {
+		t.Fatalf("want %s expect %s", "y", v)
+	}
+}
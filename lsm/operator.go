@@ -0,0 +1,165 @@
+package lsm
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/s-ilyin/lsm-distributed/lsm/blob"
+	"github.com/s-ilyin/lsm-distributed/lsm/encoder"
+	"github.com/s-ilyin/lsm-distributed/lsm/sst"
+)
+
+// ErrNoMergeOperator is returned when merging or reading merge operands
+// of the tree opened without the merge operator.
+var ErrNoMergeOperator = errors.New("merge operator is not set")
+
+// MergeOperator combines the merge operands of a key with its value.
+type MergeOperator = encoder.MergeOperator
+
+// Merger sets the merge operator of the tree, it is required to use Merge.
+// The same operator must be used every time the tree is opened.
+func Merger(op MergeOperator) func(*LSMTree) {
+	return func(t *LSMTree) {
+		t.merger = op
+	}
+}
+
+// Merge appends the merge operand to the key. The operands are combined
+// with the value of the key by the merge operator on read and compaction.
+func (t *LSMTree) Merge(key, operand []byte, options ...WriteOptions) error {
+	if t.merger == nil {
+		return ErrNoMergeOperator
+	}
+
+	b := NewWriteBatch()
+	b.Merge(key, operand)
+
+	return t.Write(b, options...)
+}
+
+// fold merges the operands of the key not newer than seq with its value.
+// The versions older than rseq are deleted by the range tombstone.
+// The versions are visited from the newest to the oldest: the MemTables first,
+// then the files of the version from the newest to the oldest.
+func (cf *ColumnFamily) fold(ver *version, key []byte, seq, rseq uint64) ([]byte, bool, error) {
+	var (
+		st   = mergeState{rangeSeq: rseq, blobs: cf.blobs}
+		ikey = encoder.MakeInternalKey(key, seq, encoder.OpKindSeek)
+	)
+
+	for _, mem := range ver.memtables() {
+		if st.done {
+			break
+		}
+
+		it := mem.Iterator()
+		k, v := it.SeekGE(ikey)
+		for k != nil && bytes.Equal(encoder.UserKey(k), key) && !st.add(k, cf.t.decoder.Decode(v)) {
+			k, v = it.Next()
+		}
+	}
+
+	for _, file := range ver.files.Files() {
+		if st.done {
+			break
+		}
+
+		fit, err := file.Reader.Iterator()
+		if err != nil {
+			return nil, false, fmt.Errorf("failed to search in disk: %w", err)
+		}
+
+		k, v, err := fit.SeekGE(ikey)
+		for err == nil && bytes.Equal(encoder.UserKey(k), key) && !st.add(k, cf.t.decoder.Decode(v)) {
+			k, v, err = fit.Next()
+		}
+		if err != nil && err != io.EOF {
+			return nil, false, fmt.Errorf("failed to search in disk table %s: %w", file.Reader.Name(), err)
+		}
+	}
+
+	return st.value(cf.t.merger, key)
+}
+
+// mergeState collects the versions of a key from the newest to the oldest
+// until the value of the key is found.
+type mergeState struct {
+	// operands from the newest to the oldest
+	operands [][]byte
+	existing []byte
+	// the existing value is the pointer to the blob file
+	blob  bool
+	blobs *blob.Store
+	// sequence of the last added version
+	last uint64
+	// versions older than the range tombstone are deleted
+	rangeSeq uint64
+	done     bool
+}
+
+// add adds the next older version of the key and reports whether the value is resolved.
+func (s *mergeState) add(ikey []byte, val *encoder.EncodedValue) bool {
+	// the same version may be found in several sources
+	seq := encoder.Sequence(ikey)
+	if s.last != 0 && seq >= s.last {
+		return false
+	}
+	s.last = seq
+
+	if seq < s.rangeSeq {
+		s.done = true
+		return true
+	}
+
+	switch val.Kind() {
+	case encoder.OpKindMerge:
+		s.operands = append(s.operands, val.Value())
+		return false
+	case encoder.OpKindSet:
+		// the expired value is treated as deleted
+		if !val.Expired(time.Now()) {
+			s.existing, s.blob = val.Value(), val.IsBlob()
+		}
+	}
+	s.done = true
+
+	return true
+}
+
+// value merges the collected operands into the existing value.
+func (s *mergeState) value(op MergeOperator, key []byte) ([]byte, bool, error) {
+	if s.blob {
+		existing, err := readBlob(s.blobs, s.existing)
+		if err != nil {
+			return nil, false, fmt.Errorf("failed to read blob: %w", err)
+		}
+		s.existing, s.blob = existing, false
+	}
+
+	if len(s.operands) == 0 {
+		if s.existing == nil {
+			return nil, false, sst.ErrKeyNotFound
+		}
+
+		return s.existing, true, nil
+	}
+
+	if op == nil {
+		return nil, false, ErrNoMergeOperator
+	}
+
+	operands := make([][]byte, len(s.operands))
+	for idx := range s.operands {
+		operands[len(operands)-1-idx] = s.operands[idx]
+	}
+
+	value, err := op.FullMerge(key, s.existing, operands)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to merge: %w", err)
+	}
+
+	return value, true, nil
+}
@@ -0,0 +1,124 @@
+package lsm
+
+import (
+	"errors"
+	"os"
+	"strconv"
+	"testing"
+
+	"github.com/s-ilyin/lsm-distributed/lsm/sst"
+)
+
+// counter adds the operands to the value.
+type counter struct{}
+
+func (counter) FullMerge(key, existing []byte, operands [][]byte) ([]byte, error) {
+	var sum int
+	if existing != nil {
+		n, err := strconv.Atoi(string(existing))
+		if err != nil {
+			return nil, err
+		}
+		sum = n
+	}
+	for _, op := range operands {
+		n, err := strconv.Atoi(string(op))
+		if err != nil {
+			return nil, err
+		}
+		sum += n
+	}
+
+	return []byte(strconv.Itoa(sum)), nil
+}
+
+func (counter) PartialMerge(key, left, right []byte) ([]byte, bool) {
+	v, err := counter{}.FullMerge(key, left, [][]byte{right})
+
+	return v, err == nil
+}
+
+func TestMergeOperator(t *testing.T) {
+	var dir = "tmp-test-merge-operator"
+	l, err := Open(dir, MemTableThreshold(1<<20), Merger(counter{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer l.Shutdown()
+
+	check := func(key string, want string) {
+		t.Helper()
+		v, ok, err := l.Get([]byte(key))
+		if err != nil || !ok {
+			t.Fatalf("[%s] key not found: %v", key, err)
+		}
+		if string(v) != want {
+			t.Fatalf("[%s] want %s expect %s", key, want, v)
+		}
+	}
+
+	l.Put([]byte("a"), []byte("10"))
+	l.Merge([]byte("a"), []byte("1"))
+	l.Merge([]byte("b"), []byte("5"))
+	if err := l.defaultFamily.flushMemTable(); err != nil {
+		t.Fatal(err)
+	}
+	l.Merge([]byte("a"), []byte("2"))
+	l.Merge([]byte("b"), []byte("5"))
+
+	// operands are folded across the MemTable and the files
+	check("a", "13")
+	check("b", "10")
+
+	it, err := l.NewIterator(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got string
+	for ; it.Valid(); it.Next() {
+		got += string(it.Key()) + "=" + string(it.Value()) + ";"
+	}
+	if got != "a=13;b=10;" {
+		t.Fatalf("want %s expect %s", "a=13;b=10;", got)
+	}
+
+	// the compaction collapses the chains into values
+	if err := l.defaultFamily.flushMemTable(); err != nil {
+		t.Fatal(err)
+	}
+	l.Delete([]byte("a"))
+	l.Merge([]byte("a"), []byte("7"))
+	if err := l.defaultFamily.flushMemTable(); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.defaultFamily.compact(sst.BaseLevel); err != nil {
+		t.Fatal(err)
+	}
+
+	files := l.defaultFamily.fobserver.Level(sst.BaseLevel + 1)
+	if len(files) != 1 {
+		t.Fatalf("want %d files expect %d", 1, len(files))
+	}
+	fit, err := files[0].Reader.Iterator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var n int
+	for fit.HasNext() {
+		if _, _, err := fit.Next(); err != nil {
+			t.Fatal(err)
+		}
+		n++
+	}
+	if n != 2 {
+		t.Fatalf("want %d entries expect %d", 2, n)
+	}
+	check("a", "7")
+	check("b", "10")
+
+	l.merger = nil
+	if err := l.Merge([]byte("a"), []byte("1")); !errors.Is(err, ErrNoMergeOperator) {
+		t.Fatalf("want %v expect %v", ErrNoMergeOperator, err)
+	}
+}
@@ -1,6 +1,10 @@
 package lsm
 
-import "time"
+import (
+	"time"
+
+	"github.com/s-ilyin/lsm-distributed/lsm/wal"
+)
 
 const (
 	// Default MemTable table threshold.
@@ -9,6 +13,8 @@ const (
 	defaultSparseKeyDistance = 4 << 10
 	// Default DiskTable number threshold.
 	defaultDiskTableNumThreshold = 10
+	// Default number of the MemTables of a column family: the active one and one immutable.
+	defaultMaxWriteBufferNumber = 2
 )
 
 func DebugMode(debug bool) func(*LSMTree) {
@@ -22,7 +28,7 @@ func DebugMode(debug bool) func(*LSMTree) {
 // быть сброшен на диск.
 func MemTableThreshold(memTableThreshold uint32) func(*LSMTree) {
 	return func(t *LSMTree) {
-		t.config.MemtblDataSize = memTableThreshold
+		t.defaultFamily.config.MemtblDataSize = memTableThreshold
 	}
 }
 
@@ -43,15 +49,24 @@ func DiskTableNumThreshold(diskTableNumThreshold int) func(*LSMTree) {
 	}
 }
 
+// MaxWriteBufferNumber sets the maximum number of the MemTables of the default column family:
+// the active one and the immutable ones waiting for the flush. The writers wait
+// for the flush when the limit is reached, the values less than 2 are treated as 2.
+func MaxWriteBufferNumber(n int) func(*LSMTree) {
+	return func(t *LSMTree) {
+		t.defaultFamily.config.MaxWriteBufferNumber = n
+	}
+}
+
 func DiskDataSize(size uint64) func(*LSMTree) {
 	return func(l *LSMTree) {
-		l.config.Merge.DataSize = size
+		l.defaultFamily.config.Merge.DataSize = size
 	}
 }
 
 func MergeConfig(ms MergeSettings) func(*LSMTree) {
 	return func(l *LSMTree) {
-		l.config.Merge = ms
+		l.defaultFamily.config.Merge = ms
 	}
 }
 
@@ -64,5 +79,59 @@ func defaultMergeConfig() *Config {
 			NumberOfSstFiles: 8,
 			DataSize:         1 << 10 * 1 << 10, // 1MB
 		},
+		BlobGCAgeCutoff:      defaultBlobGCAgeCutoff,
+		MaxWriteBufferNumber: defaultMaxWriteBufferNumber,
+	}
+}
+
+// WALSync makes every write return only after the WAL file is synced to the disk.
+// The concurrent writes are synced together, so the throughput grows with the number of the writers.
+func WALSync(fsync bool) func(*LSMTree) {
+	return func(t *LSMTree) {
+		t.walSync = fsync
+	}
+}
+
+// WALSyncInterval makes the background job sync the WAL file to the disk with the interval,
+// so the writes not synced by themselves are lost on the crash only for the last interval.
+func WALSyncInterval(interval time.Duration) func(*LSMTree) {
+	return func(t *LSMTree) {
+		t.walSyncInterval = interval
+	}
+}
+
+// WALRecoveryMode sets how the damaged WAL records are treated when the tree is opened,
+// wal.PointInTime by default.
+func WALRecoveryMode(mode wal.RecoveryMode) func(*LSMTree) {
+	return func(t *LSMTree) {
+		t.walRecovery = mode
+	}
+}
+
+// WALArchive moves the WAL segments removed after the flush to the archive directory
+// instead of deleting them, so the tree can be restored to a point in time by RestoreToPointInTime.
+// The directory "archive" in the WAL directory is used if dir is empty. The segments
+// older than the ttl are removed, and the oldest segments are removed while the archive
+// is larger than sizeLimit bytes, zero disables the limit.
+func WALArchive(dir string, ttl time.Duration, sizeLimit int64) func(*LSMTree) {
+	return func(t *LSMTree) {
+		t.walArchive = wal.Archive(dir, ttl, sizeLimit)
+	}
+}
+
+// WALCompression compresses the records of the WAL with the compressor, for example wal.NewFlate.
+// The segments written before with the other compressor or without compression are still read,
+// the custom compressor must be registered by wal.RegisterCompressor.
+func WALCompression(c wal.Compressor) func(*LSMTree) {
+	return func(t *LSMTree) {
+		t.walCompression = c
+	}
+}
+
+// VerifyChecksumsOnRead verifies the blocks of the SST files by their checksums on every read,
+// the damaged block fails the read with *sst.ErrCorruption. The index blocks are always verified.
+func VerifyChecksumsOnRead(verify bool) func(*LSMTree) {
+	return func(t *LSMTree) {
+		t.verifyChecksums = verify
 	}
 }
@@ -0,0 +1,16 @@
+package lsm
+
+import "github.com/s-ilyin/lsm-distributed/lsm/encoder"
+
+// rangeTombstones returns the range tombstones of the MemTables and all files of the version.
+func (v *version) rangeTombstones() []encoder.RangeTombstone {
+	var tombstones []encoder.RangeTombstone
+	for _, mem := range v.memtables() {
+		tombstones = append(tombstones, mem.RangeTombstones()...)
+	}
+	for _, file := range v.files.Files() {
+		tombstones = append(tombstones, file.Reader.RangeTombstones()...)
+	}
+
+	return tombstones
+}
@@ -0,0 +1,105 @@
+package lsm
+
+import (
+	"os"
+	"testing"
+
+	"github.com/s-ilyin/lsm-distributed/lsm/sst"
+)
+
+func TestDeleteRange(t *testing.T) {
+	var dir = "tmp-test-delete-range"
+	l, err := Open(dir, MemTableThreshold(1<<20))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, k := range []string{"a", "b", "c", "d", "e"} {
+		l.Put([]byte(k), []byte(k))
+	}
+	if err := l.defaultFamily.flushMemTable(); err != nil {
+		t.Fatal(err)
+	}
+	l.Put([]byte("bb"), []byte("bb"))
+	if err := l.DeleteRange([]byte("b"), []byte("d")); err != nil {
+		t.Fatal(err)
+	}
+	l.Put([]byte("c"), []byte("c2"))
+
+	check := func(want string) {
+		t.Helper()
+		var got string
+		for _, k := range []string{"a", "b", "bb", "c", "d", "e"} {
+			if v, ok, _ := l.Get([]byte(k)); ok {
+				got += string(v)
+			}
+		}
+		if got != want {
+			t.Fatalf("[get] want %s expect %s", want, got)
+		}
+
+		it, err := l.NewIterator(nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = ""
+		for ; it.Valid(); it.Next() {
+			got += string(it.Value())
+		}
+		if got != want {
+			t.Fatalf("[iterator] want %s expect %s", want, got)
+		}
+	}
+
+	check("ac2de")
+
+	// the tombstone is persisted in the range-del block of the file
+	if err := l.defaultFamily.flushMemTable(); err != nil {
+		t.Fatal(err)
+	}
+	check("ac2de")
+
+	// and it is replayed from the WAL
+	l.DeleteRange([]byte("d"), []byte("e"))
+	l.Shutdown()
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	l, err = Open(dir, MemTableThreshold(1<<20))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Shutdown()
+	check("ac2e")
+
+	// the compaction to the bottom level drops the covered keys and the tombstones
+	if err := l.defaultFamily.flushMemTable(); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.defaultFamily.compact(sst.BaseLevel); err != nil {
+		t.Fatal(err)
+	}
+	files := l.defaultFamily.fobserver.Level(sst.BaseLevel + 1)
+	if len(files) != 1 {
+		t.Fatalf("want %d files expect %d", 1, len(files))
+	}
+	fit, err := files[0].Reader.Iterator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var n int
+	for fit.HasNext() {
+		if _, _, err := fit.Next(); err != nil {
+			t.Fatal(err)
+		}
+		n++
+	}
+	if n != 3 {
+		t.Fatalf("want %d entries expect %d", 3, n)
+	}
+	if rts := files[0].Reader.RangeTombstones(); len(rts) != 0 {
+		t.Fatalf("want %d tombstones expect %d", 0, len(rts))
+	}
+	check("ac2e")
+}
@@ -1,22 +1,104 @@
 package sl
 
+// Iterator is a bidirectional cursor over the list.
+// It starts before the first node: the first call of Next returns the first node.
+// Moving past the last node leaves the iterator after the end,
+// so the following Prev returns the last node again.
 type Iterator struct {
+	sl      *SkipList
 	current *node
 }
 
 func (sl *SkipList) Iterator() *Iterator {
-	return &Iterator{current: sl.head}
+	return &Iterator{sl: sl, current: sl.head}
 }
 
 func (i *Iterator) HasNext() bool {
-	return i.current.tower[0] != nil
+	return i.current != nil && i.current.tower[0] != nil
 }
 
 func (i *Iterator) Next() ([]byte, []byte) {
+	if i.current == nil {
+		return nil, nil
+	}
 	i.current = i.current.tower[0]
 
+	return i.entry()
+}
+
+// HasPrev reports whether Prev returns a node.
+func (i *Iterator) HasPrev() bool {
+	if i.current == nil {
+		return i.sl.head.tower[0] != nil
+	}
+
+	return i.current != i.sl.head && i.current.prev != nil
+}
+
+// Prev moves the iterator to the previous node and returns it.
+func (i *Iterator) Prev() ([]byte, []byte) {
+	switch {
+	case i.current == nil:
+		i.current = i.sl.last()
+	case i.current == i.sl.head:
+		return nil, nil
+	default:
+		i.current = i.current.prev
+	}
+
+	if i.current == nil {
+		i.current = i.sl.head
+
+		return nil, nil
+	}
+
+	return i.entry()
+}
+
+// First moves the iterator to the first node and returns it.
+func (i *Iterator) First() ([]byte, []byte) {
+	i.current = i.sl.head.tower[0]
+
+	return i.entry()
+}
+
+// Last moves the iterator to the last node and returns it.
+func (i *Iterator) Last() ([]byte, []byte) {
+	i.current = i.sl.last()
 	if i.current == nil {
+		i.current = i.sl.head
+
 		return nil, nil
 	}
+
+	return i.entry()
+}
+
+// SeekGE moves the iterator to the first node whose key is
+// greater than or equal to the given key and returns it.
+func (i *Iterator) SeekGE(key []byte) ([]byte, []byte) {
+	_, journey := i.sl.search(key)
+	i.current = journey[0].tower[0]
+
+	return i.entry()
+}
+
+// SeekLT moves the iterator to the last node whose key is
+// less than the given key and returns it.
+func (i *Iterator) SeekLT(key []byte) ([]byte, []byte) {
+	_, journey := i.sl.search(key)
+	i.current = journey[0]
+	if i.current == i.sl.head {
+		return nil, nil
+	}
+
+	return i.entry()
+}
+
+func (i *Iterator) entry() ([]byte, []byte) {
+	if i.current == nil || i.current == i.sl.head {
+		return nil, nil
+	}
+
 	return i.current.key, i.current.val
 }
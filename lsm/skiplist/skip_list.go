@@ -27,11 +27,25 @@ func init() {
 	}
 }
 
-func NewSkipList() *SkipList {
-	sl := &SkipList{}
+type Option func(*SkipList)
+
+// Comparer sets the function that orders the keys of the list.
+// The keys are compared by bytes.Compare by default.
+func Comparer(cmp func(a, b []byte) int) Option {
+	return func(sl *SkipList) {
+		sl.cmp = cmp
+	}
+}
+
+func NewSkipList(options ...Option) *SkipList {
+	sl := &SkipList{cmp: bytes.Compare}
 	sl.head = &node{}
 	sl.height = 1
 
+	for _, opt := range options {
+		opt(sl)
+	}
+
 	return sl
 }
 
@@ -39,12 +53,16 @@ type node struct {
 	key   []byte
 	val   []byte
 	tower [MaxHeight]*node
+	// prev points to the previous node at the lowest level,
+	// nil for the first node.
+	prev *node
 }
 
 type SkipList struct {
 	head   *node
 	height int
 	size   int32
+	cmp    func(a, b []byte) int
 }
 
 func randomHeight() int {
@@ -84,6 +102,13 @@ func (sl *SkipList) Put(key []byte, val []byte) ([]byte, bool) {
 		prev.tower[level] = nd
 	}
 
+	if journey[0] != nil && journey[0] != sl.head {
+		nd.prev = journey[0]
+	}
+	if nd.tower[0] != nil {
+		nd.tower[0].prev = nd
+	}
+
 	if height > sl.height {
 		sl.height = height
 	}
@@ -100,7 +125,7 @@ func (sl *SkipList) search(key []byte) (*node, [MaxHeight]*node) {
 	for level := sl.height - 1; level >= 0; level-- {
 		for next = prev.tower[level]; next != nil; next = prev.tower[level] {
 			// если key < или == next.key
-			if bytes.Compare(key, next.key) <= 0 {
+			if sl.cmp(key, next.key) <= 0 {
 				break
 			}
 			prev = next
@@ -109,7 +134,7 @@ func (sl *SkipList) search(key []byte) (*node, [MaxHeight]*node) {
 		journey[level] = prev
 	}
 
-	if next != nil && bytes.Equal(key, next.key) {
+	if next != nil && sl.cmp(key, next.key) == 0 {
 		return next, journey
 	}
 
@@ -123,6 +148,10 @@ func (sl *SkipList) Delete(key []byte) bool {
 		return false
 	}
 
+	if found.tower[0] != nil {
+		found.tower[0].prev = found.prev
+	}
+
 	for level := 0; level < sl.height; level++ {
 		if journey[level].tower[level] != found {
 			break
@@ -130,6 +159,7 @@ func (sl *SkipList) Delete(key []byte) bool {
 		journey[level].tower[level] = found.tower[level]
 		found.tower[level] = nil
 	}
+	found.prev = nil
 	found = nil
 	sl.shrink()
 
@@ -145,6 +175,22 @@ func (sl *SkipList) shrink() {
 	}
 }
 
+// last returns the last node of the list or nil if the list is empty.
+func (sl *SkipList) last() *node {
+	prev := sl.head
+	for level := sl.height - 1; level >= 0; level-- {
+		for next := prev.tower[level]; next != nil; next = prev.tower[level] {
+			prev = next
+		}
+	}
+
+	if prev == sl.head {
+		return nil
+	}
+
+	return prev
+}
+
 func (sl *SkipList) String() string {
 	v := &visualizer{sl}
 	return v.visualize()
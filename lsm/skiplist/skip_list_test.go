@@ -11,3 +11,48 @@ func TestSkipList(t *testing.T) {
 	sl.Put([]byte("c"), []byte("c"))
 	sl.Put([]byte("b"), []byte("b"))
 }
+
+func TestIterator(t *testing.T) {
+	sl := NewSkipList()
+	for _, k := range []string{"b", "d", "a", "e", "c"} {
+		sl.Put([]byte(k), []byte(k))
+	}
+	sl.Delete([]byte("c"))
+
+	tests := []struct {
+		name string
+		move func(it *Iterator) ([]byte, []byte)
+		want string
+	}{
+		{name: "first", move: func(it *Iterator) ([]byte, []byte) { return it.First() }, want: "a"},
+		{name: "last", move: func(it *Iterator) ([]byte, []byte) { return it.Last() }, want: "e"},
+		{name: "seek ge exists", move: func(it *Iterator) ([]byte, []byte) { return it.SeekGE([]byte("b")) }, want: "b"},
+		{name: "seek ge deleted", move: func(it *Iterator) ([]byte, []byte) { return it.SeekGE([]byte("c")) }, want: "d"},
+		{name: "seek ge end", move: func(it *Iterator) ([]byte, []byte) { return it.SeekGE([]byte("f")) }, want: ""},
+		{name: "seek lt exists", move: func(it *Iterator) ([]byte, []byte) { return it.SeekLT([]byte("b")) }, want: "a"},
+		{name: "seek lt deleted", move: func(it *Iterator) ([]byte, []byte) { return it.SeekLT([]byte("d")) }, want: "b"},
+		{name: "seek lt begin", move: func(it *Iterator) ([]byte, []byte) { return it.SeekLT([]byte("a")) }, want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			k, _ := tt.move(sl.Iterator())
+			if string(k) != tt.want {
+				t.Fatalf("want %q expect %q", tt.want, string(k))
+			}
+		})
+	}
+
+	var keys string
+	it := sl.Iterator()
+	for it.HasNext() {
+		k, _ := it.Next()
+		keys += string(k)
+	}
+	for it.HasPrev() {
+		k, _ := it.Prev()
+		keys += string(k)
+	}
+	if keys != "abdedba" {
+		t.Fatalf("want %s expect %s", "abdedba", keys)
+	}
+}
@@ -0,0 +1,102 @@
+package lsm
+
+import (
+	"container/list"
+	"sync"
+)
+
+// Snapshot is a consistent point-in-time view of the tree.
+// Reads with the snapshot see only the entries written before it was taken.
+type Snapshot struct {
+	seq  uint64
+	elem *list.Element
+}
+
+// Sequence returns the sequence number of the snapshot.
+func (s *Snapshot) Sequence() uint64 {
+	return s.seq
+}
+
+// snapshots keeps the live snapshots ordered by the sequence number.
+type snapshots struct {
+	lock sync.Mutex
+	list list.List
+}
+
+func (s *snapshots) acquire(seq uint64) *Snapshot {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	snap := &Snapshot{seq: seq}
+	snap.elem = s.list.PushBack(snap)
+
+	return snap
+}
+
+func (s *snapshots) release(snap *Snapshot) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if snap.elem != nil {
+		s.list.Remove(snap.elem)
+		snap.elem = nil
+	}
+}
+
+// sequences returns the sequence numbers of the live snapshots in ascending order.
+func (s *snapshots) sequences() []uint64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	seqs := make([]uint64, 0, s.list.Len())
+	for e := s.list.Front(); e != nil; e = e.Next() {
+		seq := e.Value.(*Snapshot).seq
+		if len(seqs) == 0 || seqs[len(seqs)-1] != seq {
+			seqs = append(seqs, seq)
+		}
+	}
+
+	return seqs
+}
+
+// NewSnapshot takes the snapshot of the current state of the tree.
+// Compaction keeps the versions of the keys visible to the snapshot
+// until it is released by ReleaseSnapshot.
+func (t *LSMTree) NewSnapshot() *Snapshot {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	return t.snapshots.acquire(t.wal.Sequence())
+}
+
+// ReleaseSnapshot releases the snapshot.
+func (t *LSMTree) ReleaseSnapshot(s *Snapshot) {
+	t.snapshots.release(s)
+}
+
+type readOptions struct {
+	snapshot *Snapshot
+}
+
+type ReadOption func(*readOptions)
+
+// ReadSnapshot makes Get and iterators read the state of the tree at the snapshot.
+func ReadSnapshot(s *Snapshot) ReadOption {
+	return func(ro *readOptions) {
+		ro.snapshot = s
+	}
+}
+
+// readSequence returns the sequence number the read should see.
+func (t *LSMTree) readSequence(options []ReadOption) uint64 {
+	var ro readOptions
+	for _, opt := range options {
+		opt(&ro)
+	}
+
+	if ro.snapshot != nil {
+		return ro.snapshot.seq
+	}
+
+	return t.wal.Sequence()
+}
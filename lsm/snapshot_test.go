@@ -0,0 +1,91 @@
+package lsm
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	"github.com/s-ilyin/lsm-distributed/lsm/sst"
+)
+
+func TestSnapshot(t *testing.T) {
+	var dir = "tmp-test-snapshot"
+	l, err := Open(dir, MemTableThreshold(1<<20))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer l.Shutdown()
+
+	l.Put([]byte("a"), []byte("a1"))
+	l.Put([]byte("b"), []byte("b1"))
+	snap := l.NewSnapshot()
+	l.Put([]byte("a"), []byte("a2"))
+	l.Delete([]byte("b"))
+
+	check := func(key string, want string, ok bool, options ...ReadOption) {
+		t.Helper()
+		v, exists, _ := l.Get([]byte(key), options...)
+		if exists != ok {
+			t.Fatalf("[%s ok] want %v expect %v", key, ok, exists)
+		}
+		if ok && !bytes.Equal([]byte(want), v) {
+			t.Fatalf("[%s val] want %s expect %s", key, want, v)
+		}
+	}
+
+	check("a", "a2", true)
+	check("b", "", false)
+	check("a", "a1", true, ReadSnapshot(snap))
+	check("b", "b1", true, ReadSnapshot(snap))
+
+	it, err := l.NewIterator(nil, nil, ReadSnapshot(snap))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keys string
+	for ; it.Valid(); it.Next() {
+		keys += string(it.Value())
+	}
+	if keys != "a1b1" {
+		t.Fatalf("want %s expect %s", "a1b1", keys)
+	}
+
+	// the versions seen by the snapshot survive the compaction
+	if err := l.defaultFamily.flushMemTable(); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.defaultFamily.compact(sst.BaseLevel); err != nil {
+		t.Fatal(err)
+	}
+	check("a", "a2", true)
+	check("a", "a1", true, ReadSnapshot(snap))
+	check("b", "b1", true, ReadSnapshot(snap))
+
+	l.ReleaseSnapshot(snap)
+	if err := l.defaultFamily.compact(sst.BaseLevel + 1); err != nil {
+		t.Fatal(err)
+	}
+
+	files := l.defaultFamily.fobserver.Level(sst.BaseLevel + 2)
+	if len(files) != 1 {
+		t.Fatalf("want %d files expect %d", 1, len(files))
+	}
+	fit, err := files[0].Reader.Iterator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var n int
+	for fit.HasNext() {
+		if _, _, err := fit.Next(); err != nil {
+			t.Fatal(err)
+		}
+		n++
+	}
+	// the newest version of a, the tombstone of b is dropped at the bottom level
+	if n != 1 {
+		t.Fatalf("want %d entries expect %d", 1, n)
+	}
+	check("a", "a2", true)
+	check("b", "", false)
+}
@@ -81,8 +81,12 @@ func Decode(r IOReader) ([]byte, []byte, error) {
 }
 
 // encodeKeyOffset encodes key offset and writes it to the given writer.
+// The offset is encoded as varint, the files of formatBaseline keep it as uint32.
 func EncodeKeyOffset(w io.Writer, key []byte, offset int) (int, error) {
-	return Encode(w, key, encodeUInt32(uint32(offset)))
+	var encoded [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(encoded[:], uint64(offset))
+
+	return Encode(w, key, encoded[:n])
 }
 
 func binaryPutUint64(w io.Writer, x uint64) (int, error) {
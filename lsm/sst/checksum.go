@@ -0,0 +1,112 @@
+package sst
+
+import (
+	"errors"
+	"fmt"
+	"hash/crc32"
+)
+
+// Size of the crc32c trailer of the blocks of formatVersion.
+const sizeChecksum = sizeCellDefault
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+var (
+	// ErrChecksum is the cause of ErrCorruption when the block does not match its checksum.
+	ErrChecksum = errors.New("checksum mismatch")
+	// errMalformed is the cause of ErrCorruption when the block can not be decoded.
+	errMalformed = errors.New("malformed block")
+)
+
+// ErrCorruption is returned when the file does not match its checksums
+// or its blocks can not be decoded.
+type ErrCorruption struct {
+	File string
+	// Offset of the damaged block in the file.
+	Offset int64
+	Err    error
+}
+
+func (e *ErrCorruption) Error() string {
+	return fmt.Sprintf("sst file %s is corrupted at %d: %v", e.File, e.Offset, e.Err)
+}
+
+func (e *ErrCorruption) Unwrap() error {
+	return e.Err
+}
+
+// VerifyOnRead makes the reader verify the checksum of every data block it reads.
+// The index block, the range-del block and the footer are always verified when the file is opened.
+func VerifyOnRead(verify bool) OptionReader {
+	return func(r *Reader) {
+		r.verify = verify
+	}
+}
+
+func (r *Reader) corruption(offset int64, err error) error {
+	return &ErrCorruption{File: r.Name(), Offset: offset, Err: err}
+}
+
+// hasChecksums reports whether the blocks of the file end with the checksum.
+func (r *Reader) hasChecksums() bool {
+	return r.version >= formatVersion
+}
+
+// verifyBlock checks the block read from the offset against its trailer
+// and returns the block without the trailer.
+func (r *Reader) verifyBlock(block []byte, offset int64, verify bool) ([]byte, error) {
+	if !r.hasChecksums() {
+		return block, nil
+	}
+	if len(block) < sizeChecksum {
+		return nil, r.corruption(offset, fmt.Errorf("%w: the block is too short: %d", errMalformed, len(block)))
+	}
+
+	data := block[:len(block)-sizeChecksum]
+	if verify && crc32.Checksum(data, castagnoli) != decodeUInt32(block[len(data):]) {
+		return nil, r.corruption(offset, ErrChecksum)
+	}
+
+	return data, nil
+}
+
+// VerifyChecksums reads all blocks of the file from the disk and verifies them by their checksums.
+// The blocks of the files written before the checksums are only checked to be decoded.
+func (r *Reader) VerifyChecksums() error {
+	f, err := r.readFooter()
+	if err != nil {
+		return err
+	}
+	if _, err := r.readIndexBlock(f); err != nil {
+		return err
+	}
+	if _, err := r.readRangeDelBlock(f); err != nil {
+		return err
+	}
+
+	for pos := 0; pos < int(r.lenKeys); pos++ {
+		from, to, err := r.segmentBounds(pos)
+		if err != nil {
+			return err
+		}
+		block, err := r.readBlock(from, to, true)
+		if err != nil {
+			return err
+		}
+		if len(block) == 0 {
+			continue
+		}
+
+		it, _, err := newBytesIterator(block)
+		if err != nil {
+			return r.corruption(from, err)
+		}
+		for it.hasNext() {
+			if _, _, _, err := it.next(); err != nil {
+				return r.corruption(from, err)
+			}
+		}
+	}
+
+	return nil
+}
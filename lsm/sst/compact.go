@@ -4,9 +4,10 @@ import (
 	"bytes"
 	"container/heap"
 	"fmt"
-	"log"
 	"os"
 	"path"
+	"sort"
+	"time"
 
 	"github.com/s-ilyin/lsm-distributed/lsm/bloom"
 	"github.com/s-ilyin/lsm-distributed/lsm/encoder"
@@ -14,27 +15,134 @@ import (
 
 type iterator struct {
 	n      int
-	it     *FileIterator
+	it     KVIterator
 	seqNum uint64
 }
 
-func push(h *Heap, it *iterator) {
-	if has := it.it.HasNext(); has {
-		//fmt.Println("push", it.n, it.it.HasNext())
-		if k, v, err := it.it.Next(); err == nil {
-			heap.Push(h, &Node{Seq: it.seqNum, SST: ElemSST{Key: k, Val: v}, It: it})
-		} else {
-			log.Println("err push heap", string(k), string(v), err)
-		}
+// push reads the next entry of the iterator into the heap.
+// Exhausted iterators are silently left out of the heap.
+func push(h *Heap, it *iterator) error {
+	if !it.it.HasNext() {
+		return nil
 	}
+
+	k, v, err := it.it.Next()
+	if err != nil {
+		return err
+	}
+	heap.Push(h, &Node{Seq: it.seqNum, SST: ElemSST{Key: k, Val: v}, It: it})
+
+	return nil
 }
 
 func pop(h *Heap) *Node {
 	return heap.Pop(h).(*Node)
 }
 
-func Compact(dirname string, files []*Reader, size int64, distance int32, rm bool) (string, error) {
-	hp := &Heap{}
+type CompactOption func(c *compaction)
+
+// Snapshots sets the sequence numbers of the live snapshots in ascending order.
+// The newest version of a key visible to every snapshot is kept by the compaction.
+func Snapshots(seqs []uint64) CompactOption {
+	return func(c *compaction) {
+		c.snapshots = seqs
+	}
+}
+
+// Merger sets the merge operator used to collapse the chains of merge operands.
+// Without the operator the operands are kept as is.
+func Merger(op encoder.MergeOperator) CompactOption {
+	return func(c *compaction) {
+		c.merger = op
+	}
+}
+
+// Comparator sets the order of the user keys of the files.
+// The keys are ordered by encoder.BytewiseComparator by default.
+func Comparator(cmp encoder.Comparator) CompactOption {
+	return func(c *compaction) {
+		c.cmp = cmp
+	}
+}
+
+// BlobValues moves the values between the SST files and the blob files.
+type BlobValues interface {
+	// Resolve returns the value the pointer to the blob file refers to.
+	Resolve(ptr []byte) ([]byte, error)
+	// Rewrite returns the encoded value to write to the output file:
+	// the large value may be separated to the blob file and the value
+	// of the old blob file may be relocated to the new one.
+	Rewrite(val []byte) ([]byte, error)
+}
+
+// Blobs sets the blob values of the files. The values written by the compaction
+// are passed through BlobValues.Rewrite, the values kept in the blob files
+// are resolved to merge the operands into them.
+func Blobs(b BlobValues) CompactOption {
+	return func(c *compaction) {
+		c.blobs = b
+	}
+}
+
+type compaction struct {
+	cmp       encoder.Comparator
+	snapshots []uint64
+	merger    encoder.MergeOperator
+	blobs     BlobValues
+	// the expired values are treated as deleted
+	now time.Time
+	// range tombstones of the compacted files
+	rangeDels []encoder.RangeTombstone
+}
+
+// addRangeDels adds the range tombstones of the file skipping the ones already added.
+func (c *compaction) addRangeDels(tombstones []encoder.RangeTombstone) {
+	for _, t := range tombstones {
+		dup := false
+		for _, added := range c.rangeDels {
+			if added.Seq == t.Seq && bytes.Equal(added.Start, t.Start) && bytes.Equal(added.End, t.End) {
+				dup = true
+				break
+			}
+		}
+		if !dup {
+			c.rangeDels = append(c.rangeDels, t)
+		}
+	}
+}
+
+// covered reports whether the version of the key is deleted by a range tombstone
+// and no snapshot sees the version before the tombstone.
+func (c *compaction) covered(ukey []byte, seq uint64, stripe int) bool {
+	for _, t := range c.rangeDels {
+		if t.Covers(c.cmp, ukey, seq) && c.stripe(t.Seq) == stripe {
+			return true
+		}
+	}
+
+	return false
+}
+
+// stripe returns the position of the earliest snapshot that sees the sequence,
+// or the number of snapshots if the sequence is newer than all of them.
+// Only the newest version of a key in every stripe is visible to the readers.
+func (c *compaction) stripe(seq uint64) int {
+	return sort.Search(len(c.snapshots), func(i int) bool {
+		return c.snapshots[i] >= seq
+	})
+}
+
+// Compact merges the files into new files of the given size in the merge directory.
+// The files must contain internal keys: only the newest version of every key is kept
+// (plus the versions seen by the snapshots) and the keys deleted by the range tombstones are dropped.
+// If rm is set, the deleted and expired keys and the range tombstones are dropped.
+func Compact(dirname string, files []*Reader, size int64, distance int32, rm bool, options ...CompactOption) (string, error) {
+	c := &compaction{cmp: encoder.BytewiseComparator, now: time.Now()}
+	for _, opt := range options {
+		opt(c)
+	}
+
+	hp := &Heap{cmp: encoder.InternalCompare(c.cmp)}
 	heap.Init(hp)
 	var (
 		maxSeqNum    uint64 = 0
@@ -54,11 +162,14 @@ func Compact(dirname string, files []*Reader, size int64, distance int32, rm boo
 		if r.Sequence() > maxSeqNum {
 			maxSeqNum = r.Sequence()
 		}
+		c.addRangeDels(r.RangeTombstones())
 		maxCountKeys += int(r.lenKeys)*int(distance) + int(distance)
 
-		push(hp, &iterator{it: it, seqNum: r.Sequence(), n: idx})
+		if err := push(hp, &iterator{it: it, seqNum: r.Sequence(), n: idx}); err != nil {
+			return mergepath, fmt.Errorf("push heap %s", err)
+		}
 	}
-	if hp.Len() == 0 {
+	if hp.Len() == 0 && len(c.rangeDels) == 0 {
 		return mergepath, nil
 	}
 	mergepath = path.Join(dirname, "level-merge")
@@ -85,20 +196,16 @@ func Compact(dirname string, files []*Reader, size int64, distance int32, rm boo
 		filter  = bloom.New(maxCountKeys, 100)
 	)
 
-	wf := func(n *Node) error {
-		if decoder.Decode(n.SST.Val).IsTombstone() && rm {
-			return nil
-		}
-
+	wf := func(e ElemSST) error {
 		if wr.Bytes() > int(size) {
-			if err = wr.AddIdxBlock(n.Seq); err != nil {
+			if err = wr.AddIdxBlock(maxSeqNum); err != nil {
 				return fmt.Errorf("add idx block %s", err)
 			}
 			if err = wr.Close(); err != nil {
 				return fmt.Errorf("close writer %s", err)
 			}
 
-			rd, err := wr.Reader()
+			rd, err := wr.Reader(KeyCompare(encoder.InternalCompare(c.cmp)))
 			if err != nil {
 				return err
 			}
@@ -114,37 +221,110 @@ func Compact(dirname string, files []*Reader, size int64, distance int32, rm boo
 			}
 		}
 
-		filter.AddByte(n.SST.Key)
-		return wr.Write(n.SST.Key, n.SST.Val)
+		val := e.Val
+		if c.blobs != nil {
+			if val, err = c.blobs.Rewrite(val); err != nil {
+				return fmt.Errorf("rewrite blob %s", err)
+			}
+		}
+
+		filter.AddByte(encoder.UserKey(e.Key))
+		return wr.Write(e.Key, val)
 	}
 
+	// the versions of a key are ordered from the newest to the oldest,
+	// so only the first value of every user key in a snapshot stripe is written,
+	// the merge operands preceding it are merged into it
 	var (
-		cur  = pop(hp)
-		next *Node
+		prev       []byte
+		prevStripe int
+		resolved   bool
+		chain      []ElemSST
 	)
-	push(hp, cur.It)
-
 	for hp.Len() > 0 {
-		next = pop(hp)
-		push(hp, next.It)
-		if cur != nil && bytes.Equal(cur.SST.Key, next.SST.Key) {
-			if next.Seq > cur.Seq {
-				cur = next
+		n := pop(hp)
+		if err := push(hp, n.It); err != nil {
+			return mergepath, fmt.Errorf("push heap %s", err)
+		}
+
+		ukey, seq, kind := encoder.ParseInternalKey(n.SST.Key)
+		stripe := c.stripe(seq)
+		if prev == nil || !bytes.Equal(prev, ukey) || stripe != prevStripe {
+			// nothing older than the operands of the key is left
+			// if the key ends at the last level
+			last := rm && (prev == nil || !bytes.Equal(prev, ukey))
+			if err := c.collapse(prev, chain, last, wf); err != nil {
+				return mergepath, err
 			}
+			prev, prevStripe, resolved, chain = ukey, stripe, false, chain[:0]
+		}
+		if resolved {
 			continue
 		}
-		if err := wf(cur); err != nil {
-			return mergepath, fmt.Errorf("err write %s", err)
+
+		// the range tombstone hides the version and all older versions in the stripe
+		if c.covered(ukey, seq, stripe) {
+			resolved = true
+			if len(chain) > 0 {
+				if err := c.fullMerge(ukey, nil, chain, wf); err != nil {
+					return mergepath, err
+				}
+				chain = chain[:0]
+			}
+			continue
+		}
+
+		if kind == encoder.OpKindMerge {
+			if c.merger != nil {
+				chain = append(chain, n.SST)
+				continue
+			}
+		} else {
+			resolved = true
+
+			val := decoder.Decode(n.SST.Val)
+			expired := val.Expired(c.now)
+
+			if len(chain) > 0 {
+				var existing []byte
+				if kind != encoder.OpKindDelete && !expired {
+					if existing, err = c.value(val); err != nil {
+						return mergepath, err
+					}
+				}
+				if err := c.fullMerge(ukey, existing, chain, wf); err != nil {
+					return mergepath, err
+				}
+				chain = chain[:0]
+				continue
+			}
+
+			// the tombstone or the expired value hides all older versions from every snapshot
+			if rm && stripe == 0 && (kind == encoder.OpKindDelete || expired) {
+				continue
+			}
 		}
 
-		cur = next
+		if err := wf(n.SST); err != nil {
+			return mergepath, fmt.Errorf("err write %s", err)
+		}
+	}
+	if err := c.collapse(prev, chain, rm, wf); err != nil {
+		return mergepath, err
 	}
 
-	if err := wf(cur); err != nil {
-		return mergepath, fmt.Errorf("err write %s", err)
+	// the range tombstones go to the last file, nothing is left to delete
+	// for the tombstone seen by every snapshot at the last level
+	for _, t := range c.rangeDels {
+		if rm && c.stripe(t.Seq) == 0 {
+			continue
+		}
+		if err := wr.WriteRangeTombstone(t); err != nil {
+			return mergepath, err
+		}
 	}
 
-	if err := wr.AddIdxBlock(cur.Seq); err != nil {
+	if err := wr.AddIdxBlock(maxSeqNum); err != nil {
 		return mergepath, fmt.Errorf("add idx block %s", err)
 	}
 
@@ -154,3 +334,73 @@ func Compact(dirname string, files []*Reader, size int64, distance int32, rm boo
 
 	return mergepath, nil
 }
+
+// value returns the value of the entry resolving the pointer to the blob file.
+func (c *compaction) value(val *encoder.EncodedValue) ([]byte, error) {
+	if !val.IsBlob() {
+		return val.Value(), nil
+	}
+	if c.blobs == nil {
+		return nil, fmt.Errorf("the blob value without the blob files")
+	}
+
+	return c.blobs.Resolve(val.Value())
+}
+
+// fullMerge merges the operands of the key, from the newest to the oldest,
+// into the existing value and writes the result with the sequence of the newest operand.
+func (c *compaction) fullMerge(ukey, existing []byte, chain []ElemSST, wf func(ElemSST) error) error {
+	var (
+		decoder  = encoder.NewDecoder()
+		operands = make([][]byte, len(chain))
+	)
+	for idx := range chain {
+		operands[len(chain)-1-idx] = decoder.Decode(chain[idx].Val).Value()
+	}
+
+	value, err := c.merger.FullMerge(ukey, existing, operands)
+	if err != nil {
+		return fmt.Errorf("full merge %s", err)
+	}
+
+	return wf(ElemSST{
+		Key: encoder.MakeInternalKey(ukey, encoder.Sequence(chain[0].Key), encoder.OpKindSet),
+		Val: encoder.NewEncoder().Encode(encoder.OpKindSet, value),
+	})
+}
+
+// collapse writes the operands of the key left without a value in the stripe.
+// If the key has no older versions, the operands are fully merged,
+// otherwise the adjacent operands are combined by the partial merge.
+func (c *compaction) collapse(ukey []byte, chain []ElemSST, last bool, wf func(ElemSST) error) error {
+	if len(chain) == 0 {
+		return nil
+	}
+	if last {
+		return c.fullMerge(ukey, nil, chain, wf)
+	}
+
+	var (
+		decoder = encoder.NewDecoder()
+		enc     = encoder.NewEncoder()
+		// operands combined from the oldest to the newest
+		merged = []ElemSST{chain[len(chain)-1]}
+	)
+	for idx := len(chain) - 2; idx >= 0; idx-- {
+		acc := merged[len(merged)-1]
+		left, right := decoder.Decode(acc.Val).Value(), decoder.Decode(chain[idx].Val).Value()
+		if value, ok := c.merger.PartialMerge(ukey, left, right); ok {
+			merged[len(merged)-1] = ElemSST{Key: chain[idx].Key, Val: enc.Encode(encoder.OpKindMerge, value)}
+			continue
+		}
+		merged = append(merged, chain[idx])
+	}
+
+	for idx := len(merged) - 1; idx >= 0; idx-- {
+		if err := wf(merged[idx]); err != nil {
+			return fmt.Errorf("err write %s", err)
+		}
+	}
+
+	return nil
+}
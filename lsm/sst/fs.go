@@ -4,12 +4,14 @@ import (
 	"fmt"
 	"math"
 	"path"
+	"sort"
 	"sync"
 )
 
-func NewFilesObserver(root string) (*ObserverFiles, error) {
+func NewFilesObserver(root string, options ...OptionReader) (*ObserverFiles, error) {
 	of := &ObserverFiles{
-		dir: root,
+		dir:     root,
+		options: options,
 	}
 	if err := of.loadup(); err != nil {
 		return nil, err
@@ -26,13 +28,19 @@ const (
 	BaseLevel Level = iota
 )
 
+// ObserverFiles keeps the files of the levels. The levels are copied on write,
+// so the snapshots taken by Version are not changed by the flush and the compaction.
 type ObserverFiles struct {
-	lock   sync.RWMutex
-	levels [maxLevel]*SSTLevel
-	dir    string
+	lock    sync.RWMutex
+	levels  [maxLevel]*SSTLevel
+	dir     string
+	options []OptionReader
 }
 
 func (of *ObserverFiles) MaxLevel() Level {
+	of.lock.RLock()
+	defer of.lock.RUnlock()
+
 	var lvl Level
 	for idx := range of.levels {
 		if of.levels[idx] != nil {
@@ -43,6 +51,20 @@ func (of *ObserverFiles) MaxLevel() Level {
 	return lvl
 }
 
+// BottomLevel returns the deepest level with the files, BaseLevel if the levels have no files.
+func (of *ObserverFiles) BottomLevel() Level {
+	of.lock.RLock()
+	defer of.lock.RUnlock()
+
+	for idx := len(of.levels) - 1; idx > 0; idx-- {
+		if of.levels[idx] != nil && len(of.levels[idx].Files) > 0 {
+			return Level(idx)
+		}
+	}
+
+	return BaseLevel
+}
+
 func (of *ObserverFiles) Levels() Level {
 	return Level(len(of.levels))
 }
@@ -61,6 +83,9 @@ func (of *ObserverFiles) Level(level Level) []File {
 func (of *ObserverFiles) Len(level Level) int {
 	of.lock.RLock()
 	defer of.lock.RUnlock()
+	if of.levels[level] == nil {
+		return 0
+	}
 	return len(of.levels[level].Files[:])
 }
 
@@ -86,14 +111,28 @@ func (of *ObserverFiles) Append(level Level, file File) {
 		of.lock.Lock()
 		defer of.lock.Unlock()
 		if of.levels[level] == nil {
-			of.levels[level] = &SSTLevel{Files: make([]File, 0)}
-			of.levels[level].Files = append(of.levels[level].Files, file)
+			of.levels[level] = &SSTLevel{Files: []File{file}}
 
 			return
 		}
 
-		of.levels[level].Files = append(of.levels[level].Files, file)
+		files := of.levels[level].Files
+		of.levels[level] = &SSTLevel{Files: append(files[:len(files):len(files)], file)}
+	}
+}
+
+// Replace sets the files of the level and returns the replaced files.
+func (of *ObserverFiles) Replace(level Level, files []File) []File {
+	of.lock.Lock()
+	defer of.lock.Unlock()
+
+	var old []File
+	if of.levels[level] != nil {
+		old = of.levels[level].Files
 	}
+	of.levels[level] = &SSTLevel{Files: files}
+
+	return old
 }
 
 func (of *ObserverFiles) Flush(level Level) int {
@@ -101,7 +140,7 @@ func (of *ObserverFiles) Flush(level Level) int {
 	if level <= maxLevel && of.levels[level] != nil {
 		of.lock.Lock()
 		n = len(of.levels[level].Files)
-		of.levels[level].Files = of.levels[level].Files[:0]
+		of.levels[level] = &SSTLevel{}
 		of.lock.Unlock()
 	}
 
@@ -125,29 +164,72 @@ func (of *ObserverFiles) Reload(level Level) error {
 	if err != nil {
 		return err
 	}
-	if of.levels[level] == nil {
-		of.levels[level] = &SSTLevel{}
+	var loaded []File
+	if of.levels[level] != nil {
+		loaded = of.levels[level].Files
 	}
+	loaded = loaded[:len(loaded):len(loaded)]
 
 	for idx := range files {
 		//fmt.Println("open file", path.Join(PathForLevel(of.dir, level), files[idx]))
-		r, err := NewReader(path.Join(PathForLevel(of.dir, level), files[idx]))
+		r, err := NewReader(path.Join(PathForLevel(of.dir, level), files[idx]), of.options...)
 		if err != nil {
 			return err
 		}
-		of.levels[level].Files = append(of.levels[level].Files, File{
+		loaded = append(loaded, File{
 			Reader: r,
 		})
 	}
+	// the names do not keep the order the files were appended in,
+	// the newer files have the larger sequence numbers
+	sort.SliceStable(loaded, func(i, j int) bool {
+		return loaded[i].Reader.Sequence() < loaded[j].Reader.Sequence()
+	})
+	of.levels[level] = &SSTLevel{Files: loaded}
 
 	//log.Println("update lvl", len(of.levels[level].Files))
 	return nil
 }
 
 func (of *ObserverFiles) NewNext(level Level) string {
+	of.lock.RLock()
+	defer of.lock.RUnlock()
+	if of.levels[level] == nil {
+		return "0000.sst"
+	}
 	return fmt.Sprintf("000%d.sst", len(of.levels[level].Files))
 }
 
 func (of *ObserverFiles) Iterator(max Level) *LevelIterator {
-	return newLevelIterator(of.levels[:max])
+	of.lock.RLock()
+	defer of.lock.RUnlock()
+
+	return newLevelIterator(append([]*SSTLevel(nil), of.levels[:max]...))
+}
+
+// MaxSequence returns the largest sequence number of all files.
+func (of *ObserverFiles) MaxSequence() uint64 {
+	var seq uint64
+	for _, f := range of.Files(maxLevel) {
+		if f.Reader.Sequence() > seq {
+			seq = f.Reader.Sequence()
+		}
+	}
+
+	return seq
+}
+
+// Files returns the files of the first max levels ordered
+// from the newest to the oldest.
+func (of *ObserverFiles) Files(max Level) []File {
+	of.lock.RLock()
+	defer of.lock.RUnlock()
+
+	var files []File
+	it := newLevelIterator(of.levels[:max])
+	for it.hasNext() {
+		files = append(files, it.next())
+	}
+
+	return files
 }
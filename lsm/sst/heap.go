@@ -9,25 +9,46 @@ type Node struct {
 }
 
 // An min-heap of SST entries
-// Provides an easy way to sort large numbers of entries
-type Heap []*Node
+// Provides an easy way to sort large numbers of entries.
+// Equal keys are ordered from the highest Seq to the lowest,
+// so the entry of the newest source is always popped first.
+type Heap struct {
+	nodes []*Node
+	// keys are compared by bytes.Compare if cmp is not set
+	cmp func(a, b []byte) int
+}
+
+func (h *Heap) Len() int { return len(h.nodes) }
+func (h *Heap) Less(i, j int) bool {
+	if cmp := h.compare(h.nodes[i].SST.Key, h.nodes[j].SST.Key); cmp != 0 {
+		return cmp < 0
+	}
 
-func (h Heap) Len() int { return len(h) }
-func (h Heap) Less(i, j int) bool {
-	return bytes.Compare(h[i].SST.Key, h[j].SST.Key) < 1
+	return h.nodes[i].Seq > h.nodes[j].Seq
 }
-func (h Heap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+func (h *Heap) Swap(i, j int) { h.nodes[i], h.nodes[j] = h.nodes[j], h.nodes[i] }
 
 func (h *Heap) Push(x interface{}) {
-	// Push and Pop use pointer receivers because they modify the slice's length,
-	// not just its contents.
-	*h = append(*h, x.(*Node))
+	h.nodes = append(h.nodes, x.(*Node))
 }
 
 func (h *Heap) Pop() interface{} {
-	old := *h
+	old := h.nodes
 	n := len(old)
 	x := old[n-1]
-	*h = old[0 : n-1]
+	h.nodes = old[0 : n-1]
 	return x
 }
+
+// Top returns the smallest node without removing it.
+func (h *Heap) Top() *Node {
+	return h.nodes[0]
+}
+
+func (h *Heap) compare(a, b []byte) int {
+	if h.cmp == nil {
+		return bytes.Compare(a, b)
+	}
+
+	return h.cmp(a, b)
+}
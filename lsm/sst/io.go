@@ -1,7 +1,9 @@
 package sst
 
 import (
+	"bytes"
 	"fmt"
+	"io"
 	"os"
 	"regexp"
 	"strconv"
@@ -9,6 +11,7 @@ import (
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/s-ilyin/lsm-distributed/lsm/encoder"
 )
 
 const (
@@ -125,28 +128,43 @@ func OpenBy(binpath string) (*os.File, error) {
 	return fsst, nil
 }
 
-// searchInDiskTables searches a value by the key in DiskTables, by traversing
-// all tables in the directory.
-func SearchInDiskTables(key []byte, iterator *LevelIterator) ([]byte, bool, error) {
-	var err error
+// searchInDiskTables searches a value by the internal key in DiskTables, by traversing
+// all tables from the newest to the oldest. Returns the internal key and the value
+// of the newest version of the user key with the sequence not greater than the key one.
+func SearchInDiskTables(key []byte, iterator *LevelIterator) ([]byte, []byte, bool, error) {
 	for iterator.hasNext() {
-		var val []byte
 		file := iterator.next()
-		val, err = searchInDiskTable(key, file.Reader)
+		k, val, err := searchInDiskTable(key, file.Reader)
 		if err != nil && err != ErrKeyNotFound {
-			return nil, false, fmt.Errorf("failed to search in disk table %s: %s", file.Reader.Name(), err)
+			return nil, nil, false, fmt.Errorf("failed to search in disk table %s: %w", file.Reader.Name(), err)
 		}
 		if err == ErrKeyNotFound {
 			continue
 		}
 
-		return val, true, nil
+		return k, val, true, nil
 	}
 
-	return nil, false, err
+	return nil, nil, false, nil
 }
 
-// searchInDiskTable searches a given key in a given disk table.
-func searchInDiskTable(key []byte, reader *Reader) ([]byte, error) {
-	return reader.search(key)
+// searchInDiskTable searches a given internal key in a given disk table.
+func searchInDiskTable(key []byte, reader *Reader) ([]byte, []byte, error) {
+	it, err := reader.Iterator()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	k, val, err := it.SeekGE(key)
+	if err == io.EOF {
+		return nil, nil, ErrKeyNotFound
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if !bytes.Equal(encoder.UserKey(k), encoder.UserKey(key)) {
+		return nil, nil, ErrKeyNotFound
+	}
+
+	return k, val, nil
 }
@@ -2,6 +2,7 @@ package sst
 
 import (
 	"bytes"
+	"io"
 	"os"
 	"path"
 	"strconv"
@@ -125,31 +126,38 @@ func TestBytesIterator(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	block, err := rd.readDataBlock(0, rd.endDataBlock)
-	if err != nil {
-		t.Fatal(err)
-	}
-
-	it, _, err := newBytesIterator(block)
-	if err != nil {
-		t.Fatal(err)
-	}
-
 	var i int
-	for it.hasNext() {
-		tk := test[i].k
-		tv := test[i].v
-		k, v, _, err := it.next()
+	// every sparse key starts the data block with its own checksum
+	for pos := 0; pos < int(rd.lenKeys); pos++ {
+		from, to, err := rd.segmentBounds(pos)
 		if err != nil {
 			t.Fatal(err)
 		}
-		if !bytes.Equal(tk, k) {
-			t.Fatalf("[key] want %s expect %s", string(tk), string(k))
+		block, err := rd.readDataBlock(from, to)
+		if err != nil {
+			t.Fatal(err)
 		}
-		if !bytes.Equal(tv, v) {
-			t.Fatalf("[val] want %s expect %s", string(tv), string(v))
+
+		it, _, err := newBytesIterator(block)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for it.hasNext() {
+			tk := test[i].k
+			tv := test[i].v
+			k, v, _, err := it.next()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(tk, k) {
+				t.Fatalf("[key] want %s expect %s", string(tk), string(k))
+			}
+			if !bytes.Equal(tv, v) {
+				t.Fatalf("[val] want %s expect %s", string(tv), string(v))
+			}
+			i++
 		}
-		i++
 	}
 	if i != len(test) {
 		t.Fatalf("want %d op expect %d op", len(test), i)
@@ -379,3 +387,78 @@ func TestFileIteratorManySegments(t *testing.T) {
 		t.Fatalf("want %d op expect %d op", len(test), i)
 	}
 }
+
+func TestFileIteratorSeek(t *testing.T) {
+	var dir = "tmp-test-file-iterator-seek"
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		os.MkdirAll(dir, os.FileMode(0700))
+	}
+	defer os.RemoveAll(dir)
+
+	wr, err := NewWriter(path.Join(dir, NewNext()), SparseKeyDistance(12))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []string{"b", "d", "f", "h", "j", "l", "n"} {
+		wr.Write([]byte(k), []byte(k+k))
+	}
+	wr.AddIdxBlock(10)
+	wr.Close()
+
+	rd, err := wr.Reader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rd.Close()
+
+	tests := []struct {
+		name string
+		move func(it *FileIterator) ([]byte, []byte, error)
+		want string
+	}{
+		{name: "first", move: func(it *FileIterator) ([]byte, []byte, error) { return it.First() }, want: "b"},
+		{name: "last", move: func(it *FileIterator) ([]byte, []byte, error) { return it.Last() }, want: "n"},
+		{name: "seek ge exists", move: func(it *FileIterator) ([]byte, []byte, error) { return it.SeekGE([]byte("h")) }, want: "h"},
+		{name: "seek ge between", move: func(it *FileIterator) ([]byte, []byte, error) { return it.SeekGE([]byte("i")) }, want: "j"},
+		{name: "seek ge before", move: func(it *FileIterator) ([]byte, []byte, error) { return it.SeekGE([]byte("a")) }, want: "b"},
+		{name: "seek ge after", move: func(it *FileIterator) ([]byte, []byte, error) { return it.SeekGE([]byte("o")) }, want: ""},
+		{name: "seek lt exists", move: func(it *FileIterator) ([]byte, []byte, error) { return it.SeekLT([]byte("h")) }, want: "f"},
+		{name: "seek lt between", move: func(it *FileIterator) ([]byte, []byte, error) { return it.SeekLT([]byte("i")) }, want: "h"},
+		{name: "seek lt before", move: func(it *FileIterator) ([]byte, []byte, error) { return it.SeekLT([]byte("b")) }, want: ""},
+		{name: "seek lt after", move: func(it *FileIterator) ([]byte, []byte, error) { return it.SeekLT([]byte("z")) }, want: "n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			it, err := rd.Iterator()
+			if err != nil {
+				t.Fatal(err)
+			}
+			k, _, err := tt.move(it)
+			if err != nil && err != io.EOF {
+				t.Fatal(err)
+			}
+			if string(k) != tt.want {
+				t.Fatalf("want %q expect %q", tt.want, string(k))
+			}
+		})
+	}
+
+	it, err := rd.Iterator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := it.Last(); err != nil {
+		t.Fatal(err)
+	}
+	var keys string
+	for it.HasPrev() {
+		k, _, err := it.Prev()
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys += string(k)
+	}
+	if keys != "ljhfdb" {
+		t.Fatalf("want %s expect %s", "ljhfdb", keys)
+	}
+}
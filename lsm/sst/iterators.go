@@ -3,6 +3,7 @@ package sst
 import (
 	"encoding/binary"
 	"io"
+	"sort"
 )
 
 func newBytesIterator(block []byte) (*BytesIterator, int, error) {
@@ -45,12 +46,21 @@ func (bi *BytesIterator) read() ([]byte, []byte, int, error) {
 	}
 
 	kl, n := binary.Uvarint(bi.buf[bi.n:])
+	if n <= 0 {
+		return nil, nil, nn, errMalformed
+	}
 	bi.n += n
 	nn += n
 
 	vl, n := binary.Uvarint(bi.buf[bi.n:])
+	if n <= 0 {
+		return nil, nil, nn, errMalformed
+	}
 	bi.n += n
 	nn += n
+	if left := uint64(len(bi.buf) - bi.n); kl > left || vl > left-kl {
+		return nil, nil, nn, errMalformed
+	}
 
 	key := bi.buf[bi.n : bi.n+int(kl)]
 	bi.n += int(kl)
@@ -91,171 +101,271 @@ func (bi *BytesIterator) close() {
 }
 
 func NewReaderIterator(r *Reader) (*FileIterator, error) {
-	var (
-		maxKeys = int(r.lenKeys) - 1
-		sp      = 0       // start point at r.offsets
-		ep      = maxKeys // end point at r.offsets
-	)
-	var (
-		so  int64 = 0
-		eo  int64 = r.endDataBlock
-		err error
-	)
-	if ep != 0 {
-		ep = sp + 1
-		eo, err = r.readOffsetAtDataBlock(ep)
-		if err != nil {
-			return nil, err
-		}
+	it := &FileIterator{
+		rd:      r,
+		segment: -1,
+		pos:     -1,
 	}
-	so, err = r.readOffsetAtDataBlock(sp)
-	if err != nil {
-		return nil, err
+	if r.lenKeys == 0 {
+		return it, nil
 	}
 
-	segment, err := r.readDataBlock(so, eo)
-	if err != nil {
+	if err := it.load(0); err != nil {
 		return nil, err
 	}
+	it.pos = -1
 
-	it, n, err := newBytesIterator(segment)
-	if err != nil {
-		return nil, err
-	}
-	return &FileIterator{
-		it:         it,
-		rd:         r,
-		err:        err,
-		segment:    ep,
-		maxsegment: int(r.lenKeys) - 1,
-		end:        int(r.endDataBlock),
-		n:          n,
-	}, nil
+	return it, nil
 }
 
+type entry struct {
+	key []byte
+	val []byte
+}
+
+// FileIterator is a bidirectional cursor over the SST file.
+//
+// The file is read by the sparse index segments. The entries of the current
+// segment are decoded into restart points, so the iterator moves backward
+// without rereading the segment. The iterator starts before the first entry:
+// the first call of Next returns the first entry of the file.
 type FileIterator struct {
-	rd         *Reader
-	it         *BytesIterator
-	key        []byte
-	val        []byte
-	err        error
-	segment    int
-	maxsegment int
-	n          int
-	end        int
+	rd      *Reader
+	entries []entry
+	segment int
+	pos     int
+	err     error
 }
 
 func (it *FileIterator) HasNext() bool {
-	return it.n <= it.end && it.err == nil
+	if it.err != nil {
+		return false
+	}
+
+	return it.pos+1 < len(it.entries) || it.segment+1 < int(it.rd.lenKeys)
 }
 
 func (it *FileIterator) Next() ([]byte, []byte, error) {
-	if !it.it.hasNext() {
-		if err := it.swap(); err != nil {
+	if it.err != nil {
+		return nil, nil, it.err
+	}
+
+	it.pos++
+	for it.pos >= len(it.entries) {
+		if it.segment+1 >= int(it.rd.lenKeys) {
+			it.pos = len(it.entries)
+
+			return nil, nil, io.EOF
+		}
+		if err := it.load(it.segment + 1); err != nil {
 			return nil, nil, err
 		}
+		it.pos = 0
 	}
 
-	nextKey, nextVal, n, err := it.it.next()
-	if err != nil {
-		it.err = err
+	return it.current()
+}
+
+// HasPrev reports whether Prev returns an entry.
+func (it *FileIterator) HasPrev() bool {
+	if it.err != nil {
+		return false
+	}
+
+	return it.pos > 0 || it.segment > 0
+}
+
+// Prev moves the iterator to the previous entry and returns it.
+func (it *FileIterator) Prev() ([]byte, []byte, error) {
+	if it.err != nil {
+		return nil, nil, it.err
+	}
+
+	it.pos--
+	for it.pos < 0 {
+		if it.segment <= 0 {
+			it.pos = -1
+
+			return nil, nil, io.EOF
+		}
+		if err := it.load(it.segment - 1); err != nil {
+			return nil, nil, err
+		}
+		it.pos = len(it.entries) - 1
+	}
+
+	return it.current()
+}
+
+// First moves the iterator to the first entry of the file and returns it.
+func (it *FileIterator) First() ([]byte, []byte, error) {
+	if it.rd.lenKeys == 0 {
+		return nil, nil, io.EOF
+	}
+	if err := it.load(0); err != nil {
+		return nil, nil, err
+	}
+	it.pos = -1
+
+	return it.Next()
+}
+
+// Last moves the iterator to the last entry of the file and returns it.
+func (it *FileIterator) Last() ([]byte, []byte, error) {
+	if it.rd.lenKeys == 0 {
+		return nil, nil, io.EOF
+	}
+	if err := it.load(int(it.rd.lenKeys) - 1); err != nil {
+		return nil, nil, err
+	}
+	it.pos = len(it.entries)
+
+	return it.Prev()
+}
 
+// SeekGE moves the iterator to the first entry whose key is
+// greater than or equal to the given key and returns it.
+func (it *FileIterator) SeekGE(key []byte) ([]byte, []byte, error) {
+	if err := it.seek(key); err != nil {
 		return nil, nil, err
 	}
 
-	it.key = nextKey
-	it.val = nextVal
-	it.n += n
+	return it.Next()
+}
+
+// SeekLT moves the iterator to the last entry whose key is
+// less than the given key and returns it.
+func (it *FileIterator) SeekLT(key []byte) ([]byte, []byte, error) {
+	if err := it.seek(key); err != nil {
+		return nil, nil, err
+	}
 
-	if it.n == it.end {
-		it.err = io.EOF
+	if it.pos < 0 {
+		// the key is less than or equal to the first key of the segment
+		return it.Prev()
 	}
 
-	return it.key, it.val, nil
+	return it.current()
 }
 
-func (it *FileIterator) swap() error {
-	var (
-		startOffsetBlock, endOffsetBlock = int64(0), it.rd.endDataBlock
-		err                              error
-	)
-	startOffsetBlock, err = it.rd.readOffsetAtDataBlock(it.segment)
+// seek positions the iterator on the last entry whose key is less than the
+// given key, so the following Next returns the first entry not less than it.
+func (it *FileIterator) seek(key []byte) error {
+	if it.rd.lenKeys == 0 {
+		return io.EOF
+	}
+
+	segment, err := it.rd.bsearchSegment(key)
 	if err != nil {
 		return err
 	}
+	if segment < 0 {
+		segment = 0
+	}
+	if err := it.load(segment); err != nil {
+		return err
+	}
 
-	if it.segment < it.maxsegment {
-		endOffsetBlock, err = it.rd.readOffsetAtDataBlock(it.segment + 1)
-		if err != nil {
-			return err
-		}
+	it.pos = sort.Search(len(it.entries), func(i int) bool {
+		return it.rd.cmp(it.entries[i].key, key) >= 0
+	}) - 1
+
+	return nil
+}
+
+// load reads the sparse segment and decodes its entries.
+func (it *FileIterator) load(segment int) error {
+	if segment == it.segment {
+		return nil
 	}
 
-	block, err := it.rd.readDataBlock(startOffsetBlock, endOffsetBlock)
+	from, to, err := it.rd.segmentBounds(segment)
+	if err != nil {
+		it.err = err
+
+		return err
+	}
+	block, err := it.rd.readDataBlock(from, to)
 	if err != nil {
+		it.err = err
+
 		return err
 	}
-	newit, _, err := newBytesIterator(block)
+
+	bi, _, err := newBytesIterator(block)
 	if err != nil {
+		it.err = err
+
 		return err
 	}
-	it.it = newit
-	it.segment += 1
+
+	entries := it.entries[:0]
+	for bi.hasNext() {
+		k, v, _, err := bi.next()
+		if err != nil {
+			it.err = it.rd.corruption(from, err)
+
+			return it.err
+		}
+		entries = append(entries, entry{key: k, val: v})
+	}
+
+	it.entries = entries
+	it.segment = segment
 
 	return nil
 }
 
+func (it *FileIterator) current() ([]byte, []byte, error) {
+	if it.pos < 0 || it.pos >= len(it.entries) {
+		return nil, nil, io.EOF
+	}
+	e := it.entries[it.pos]
+
+	return e.key, e.val, nil
+}
+
 func newLevelIterator(levels []*SSTLevel) *LevelIterator {
 	it := &LevelIterator{
 		levels: levels,
+		nf:     -1,
 	}
-	it.cur = it.levels[it.nl]
-	if it.cur == nil {
-		return it
-	}
-
-	files := it.levels[it.nl].Files
-	it.nf = len(files) - 1
-	it.file = files[it.nf]
+	it.skip()
 
 	return it
 }
 
+// LevelIterator walks over SST files from the newest to the oldest:
+// level by level, and inside a level from the last appended file.
 type LevelIterator struct {
 	levels []*SSTLevel
-	file   File
-	cur    *SSTLevel
 	nl     int
 	nf     int
 }
 
+// skip moves the iterator to the last file of the next non-empty level
+// when the current level is exhausted.
+func (it *LevelIterator) skip() {
+	for it.nf < 0 && it.nl < len(it.levels) {
+		if it.levels[it.nl] != nil && len(it.levels[it.nl].Files) > 0 {
+			it.nf = len(it.levels[it.nl].Files) - 1
+			return
+		}
+		it.nl++
+	}
+}
+
 func (it *LevelIterator) hasNext() bool {
-	return it.nl < len(it.levels) && it.cur != nil
+	return it.nl < len(it.levels)
 }
 
 func (it *LevelIterator) next() File {
-	f := it.file
-
-	if it.nf == 0 {
+	f := it.levels[it.nl].Files[it.nf]
+	it.nf--
+	if it.nf < 0 {
 		it.nl++
-
-		// if last lvl
-		if it.nl == len(it.levels) {
-			return f
-		}
-		it.cur = it.levels[it.nl]
-		it.nf = 0
-		if len(it.cur.Files) > 0 {
-			it.nf = len(it.cur.Files) - 1
-		}
-		if it.cur.Files != nil {
-			it.file = it.cur.Files[it.nf]
-		}
-
-		return f
+		it.skip()
 	}
-	it.file = it.cur.Files[it.nf-1]
-	it.nf--
 
 	return f
 }
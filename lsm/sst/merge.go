@@ -0,0 +1,73 @@
+package sst
+
+import (
+	"container/heap"
+	"io"
+)
+
+// KVIterator is a forward-only iterator over key-value pairs sorted by key.
+type KVIterator interface {
+	HasNext() bool
+	Next() ([]byte, []byte, error)
+}
+
+// MergeIterator lazily merges several sorted sources into one ordered stream.
+// Only one entry per source is kept in memory at a time.
+//
+// Sources are passed from the newest to the oldest: when a key is present
+// in several sources only the entry of the newest one is returned,
+// the shadowed entries are skipped. Tombstones are returned as is,
+// it is up to the caller to interpret the values.
+type MergeIterator struct {
+	hp  *Heap
+	err error
+}
+
+// NewMergeIterator merges the sources ordered by cmp. Keys equal by cmp
+// are treated as the same key.
+func NewMergeIterator(cmp func(a, b []byte) int, sources ...KVIterator) (*MergeIterator, error) {
+	hp := &Heap{cmp: cmp}
+	heap.Init(hp)
+
+	for idx := range sources {
+		// the first source has the highest priority
+		it := &iterator{it: sources[idx], seqNum: uint64(len(sources) - idx), n: idx}
+		if err := push(hp, it); err != nil {
+			return nil, err
+		}
+	}
+
+	return &MergeIterator{hp: hp}, nil
+}
+
+func (mi *MergeIterator) HasNext() bool {
+	return mi.hp.Len() > 0 && mi.err == nil
+}
+
+func (mi *MergeIterator) Next() ([]byte, []byte, error) {
+	if mi.err != nil {
+		return nil, nil, mi.err
+	}
+	if mi.hp.Len() == 0 {
+		return nil, nil, io.EOF
+	}
+
+	cur := pop(mi.hp)
+	if err := push(mi.hp, cur.It); err != nil {
+		mi.err = err
+
+		return nil, nil, err
+	}
+
+	// skip the older versions of the same key
+	for mi.hp.Len() > 0 && mi.hp.compare(mi.hp.Top().SST.Key, cur.SST.Key) == 0 {
+		old := pop(mi.hp)
+		if err := push(mi.hp, old.It); err != nil {
+			mi.err = err
+
+			return nil, nil, err
+		}
+	}
+
+	return cur.SST.Key, cur.SST.Val, nil
+}
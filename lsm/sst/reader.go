@@ -5,8 +5,12 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"hash/crc32"
 	"io"
 	"os"
+	"sync/atomic"
+
+	"github.com/s-ilyin/lsm-distributed/lsm/encoder"
 )
 
 // errors
@@ -20,35 +24,75 @@ const (
 	sizeCellMax     = 1 << 3
 )
 
+// The format of the file:
+// [data block][range-del block][sparse idx: ([key][data file offset])+][offsets key sparse idx][footer]
+//
+// The files written before the range-del block (formatBaseline) keep the offsets as uint32
+// and have the footer [seqnum u64][len keys u32][total size idx block u32] without the magic,
+// so the size of the file is limited by 4 GiB.
+//
+// The files of formatVersion split the data block by the sparse keys and keep the data file offsets
+// as varints and the offsets of the sparse keys as uint64. Every block of the data,
+// the range-del block and the index block ([sparse idx][offsets key sparse idx]) end with
+// the crc32c of the block, the footer keeps the crc32c of its sizes:
+// [seqnum u64][len keys u64][size range-del block u64][total size idx block u64][crc32c u32][version u32][magic u64].
+const (
+	formatBaseline = 0
+	formatVersion  = 3
+
+	footerMagic        uint64 = 0x5f7473735f6d736c // "lsm_sst_"
+	footerSize                = 4*sizeCellMax + sizeChecksum + sizeCellDefault + sizeCellMax
+	footerSizeBaseline        = sizeCellMax + 2*sizeCellDefault
+)
+
+type OptionReader func(r *Reader)
+
+// KeyCompare sets the function that orders the keys of the file.
+// The keys are compared by bytes.Compare by default.
+func KeyCompare(cmp func(a, b []byte) int) OptionReader {
+	return func(r *Reader) {
+		r.cmp = cmp
+	}
+}
+
 type Reader struct {
 	//åbsst *bufio.Reader
 	fsst *os.File
-	it   *FileIterator
+	cmp  func(a, b []byte) int
+
+	// the number of the owners of the file, see Ref
+	refs     atomic.Int32
+	obsolete atomic.Bool
+	onRemove func()
+	// the data blocks are verified by the checksums on every read
+	verify bool
 
-	buf            *bytes.Buffer
 	offsets        []byte
 	keysvalues     []byte
+	rangeDels      []encoder.RangeTombstone
 	sizeIndexBlock int64
 	size           int64
 	endDataBlock   int64
 	seqNum         uint64
+	version        uint32
 
-	lenKeys uint32
+	lenKeys uint64
 }
 
 func (r *Reader) Iterator() (*FileIterator, error) {
-	it, err := NewReaderIterator(r)
-	if err != nil {
-		return nil, err
-	}
-	r.it = it
-	return it, nil
+	return NewReaderIterator(r)
 }
 
 func (r *Reader) Sequence() uint64 {
 	return r.seqNum
 }
 
+// PlainKeys reports whether the file keeps the user keys without the sequence number
+// and the kind, the files of formatBaseline are written before the keys were internal.
+func (r *Reader) PlainKeys() bool {
+	return r.version == formatBaseline
+}
+
 func (r *Reader) Close() error {
 	if err := r.fsst.Close(); err != nil {
 		return err
@@ -61,7 +105,42 @@ func (r *Reader) Name() string {
 	return r.fsst.Name()
 }
 
-func NewReader(path string) (*Reader, error) {
+// Ref adds the owner of the file. The reader is created with one owner,
+// the file is closed when the last owner releases it by Unref.
+func (r *Reader) Ref() {
+	r.refs.Add(1)
+}
+
+// Unref releases the file. The last owner closes the file
+// and removes it if the file is obsolete.
+func (r *Reader) Unref() error {
+	if r.refs.Add(-1) > 0 {
+		return nil
+	}
+	if err := r.Close(); err != nil {
+		return err
+	}
+	if !r.obsolete.Load() {
+		return nil
+	}
+
+	err := os.Remove(r.Name())
+	if r.onRemove != nil {
+		r.onRemove()
+	}
+
+	return err
+}
+
+// MarkObsolete marks the file replaced by the new files, so it is removed
+// when the last owner releases it. The callback is called after the removal.
+// The file must be marked before the owner calling it releases the file.
+func (r *Reader) MarkObsolete(onRemove func()) {
+	r.onRemove = onRemove
+	r.obsolete.Store(true)
+}
+
+func NewReader(path string, options ...OptionReader) (*Reader, error) {
 	fsst, err := OpenBy(path)
 	if err != nil {
 		return nil, err
@@ -75,84 +154,151 @@ func NewReader(path string) (*Reader, error) {
 	r := &Reader{
 		fsst: fsst,
 		size: stat.Size(),
-		buf:  bytes.NewBuffer(make([]byte, sizeBuf)),
+		cmp:  bytes.Compare,
 	}
+	r.refs.Store(1)
 
-	// start read header sparse index [decode seqnum][decode len keys][decode total size idx block]
-	pos := r.size - (2*sizeCellDefault + sizeCellMax)
+	for _, opt := range options {
+		opt(r)
+	}
 
-	needed := 2*sizeCellDefault + sizeCellMax
+	f, err := r.readFooter()
+	if err != nil {
+		fsst.Close()
+		return nil, err
+	}
+	r.version, r.seqNum, r.lenKeys, r.sizeIndexBlock = f.version, f.seqNum, f.lenKeys, f.sizeIndexBlock
+	r.endDataBlock = r.size - r.sizeIndexBlock - f.sizeRangeDel
 
-	if r.buf.Len() < needed {
-		r.buf.Grow(needed)
+	if r.rangeDels, err = r.readRangeDelBlock(f); err != nil {
+		fsst.Close()
+		return nil, err
 	}
-	buf := r.buf.Bytes()[:needed]
 
-	var n int
-	if n, err = r.fsst.ReadAt(buf[:], int64(pos)); err != nil {
+	// load idx-block data in memory: [key][data file offset]+[offsets key sparse idx]
+	index, err := r.readIndexBlock(f)
+	if err != nil {
+		fsst.Close()
 		return nil, err
 	}
-	if n < len(buf) {
-		return nil, fmt.Errorf("read %d < needed %d", n, len(buf))
+	startOffset := int64(len(index)) - int64(r.lenKeys)*int64(r.sizeCellOffset())
+	if startOffset < 0 {
+		fsst.Close()
+		return nil, r.corruption(r.size-r.sizeIndexBlock, fmt.Errorf("%w: %d sparse keys do not fit the index", errMalformed, r.lenKeys))
 	}
+	r.offsets = index[startOffset:]
+	r.keysvalues = index[:startOffset]
 
-	var (
-		nn          int
-		cellDefault [sizeCellDefault]byte
-		cellMax     [sizeCellMax]byte
-	)
+	return r, nil
+}
 
-	n, err = r.buf.Read(cellMax[:])
-	if err != nil {
-		return nil, err
+// footer is the footer of the file.
+type footer struct {
+	version        uint32
+	seqNum         uint64
+	lenKeys        uint64
+	sizeRangeDel   int64
+	sizeIndexBlock int64
+	// the size of the footer itself
+	size int64
+}
+
+// readFooter reads the footer of the file, the files of formatBaseline have no magic at the end.
+func (r *Reader) readFooter() (footer, error) {
+	if r.size < footerSizeBaseline {
+		return footer{}, r.corruption(0, fmt.Errorf("%w: the file is too short: %d", errMalformed, r.size))
 	}
 
-	r.seqNum = decodeUInt64(cellMax[:])
-	nn += n
+	buf := make([]byte, min(r.size, footerSize))
+	if _, err := r.fsst.ReadAt(buf, r.size-int64(len(buf))); err != nil {
+		return footer{}, err
+	}
 
-	n, err = r.buf.Read(cellDefault[:])
-	if err != nil {
-		return nil, err
+	var f footer
+	if len(buf) == footerSize && decodeUInt64(buf[len(buf)-sizeCellMax:]) == footerMagic {
+		f.version = decodeUInt32(buf[len(buf)-sizeCellMax-sizeCellDefault:])
+		if f.version != formatVersion {
+			return footer{}, fmt.Errorf("unsupported format version %d", f.version)
+		}
+		if crc32.Checksum(buf[:4*sizeCellMax], castagnoli) != decodeUInt32(buf[4*sizeCellMax:]) {
+			return footer{}, r.corruption(r.size-footerSize, ErrChecksum)
+		}
+		f.size = footerSize
+		f.seqNum = decodeUInt64(buf[0:])
+		f.lenKeys = decodeUInt64(buf[sizeCellMax:])
+		f.sizeRangeDel = int64(decodeUInt64(buf[2*sizeCellMax:]))
+		f.sizeIndexBlock = int64(decodeUInt64(buf[3*sizeCellMax:]))
+	} else {
+		buf = buf[len(buf)-footerSizeBaseline:]
+		f.version = formatBaseline
+		f.size = footerSizeBaseline
+		f.seqNum = decodeUInt64(buf[0:])
+		f.lenKeys = uint64(decodeUInt32(buf[sizeCellMax:]))
+		f.sizeIndexBlock = int64(decodeUInt32(buf[sizeCellMax+sizeCellDefault:]))
 	}
 
-	r.lenKeys = decodeUInt32(cellDefault[:])
-	nn += n
+	if f.sizeIndexBlock < f.size || f.sizeIndexBlock > r.size || f.sizeRangeDel < 0 || f.sizeRangeDel > r.size-f.sizeIndexBlock {
+		return footer{}, r.corruption(r.size-f.size, fmt.Errorf("%w: the blocks of the footer are out of the file", errMalformed))
+	}
 
-	n, err = r.buf.Read(cellDefault[:])
-	if err != nil {
-		return nil, err
+	return f, nil
+}
+
+// readIndexBlock reads the sparse index with the offsets of its keys.
+func (r *Reader) readIndexBlock(f footer) ([]byte, error) {
+	start := r.size - f.sizeIndexBlock
+	block := make([]byte, f.sizeIndexBlock-f.size)
+	if _, err := r.fsst.ReadAt(block, start); err != nil {
+		return nil, fmt.Errorf("failed to read idx block: %w", err)
 	}
 
-	r.sizeIndexBlock = int64(decodeUInt32(cellDefault[:]))
-	nn += n
-	startIndexBlock := r.size - r.sizeIndexBlock
-	r.endDataBlock = startIndexBlock
-	// end read header sparse index
+	// the index is read once, so it is always verified
+	return r.verifyBlock(block, start, true)
+}
 
-	// start read sparse idx [key][data file offset]+[offsets key sparse idx]
+// sizeCellOffset returns the size of the offset of the sparse key.
+func (r *Reader) sizeCellOffset() int {
+	if r.version == formatBaseline {
+		return sizeCellDefault
+	}
 
-	//fmt.Println(r.seqNum, r.lenKeys, r.size, r.sizeIndexBlock, r.size-r.sizeIndexBlock)
-	r.buf.Reset()
-	endOffsets := r.sizeIndexBlock - int64(nn)
-	if r.buf.Len() < int(endOffsets) {
-		r.buf.Grow(int(endOffsets))
+	return sizeCellMax
+}
+
+// readRangeDelBlock reads the range tombstones of the range-del block
+// placed right after the data block.
+func (r *Reader) readRangeDelBlock(f footer) ([]encoder.RangeTombstone, error) {
+	if f.sizeRangeDel == 0 {
+		return nil, nil
 	}
-	buf = r.buf.Bytes()[:endOffsets]
 
-	// load idx-block data in memory
-	if n, err = r.fsst.ReadAt(buf, int64(startIndexBlock)); err != nil {
+	start := r.size - f.sizeIndexBlock - f.sizeRangeDel
+	block := make([]byte, f.sizeRangeDel)
+	if _, err := r.fsst.ReadAt(block, start); err != nil {
+		return nil, fmt.Errorf("failed to read range-del block: %w", err)
+	}
+	block, err := r.verifyBlock(block, start, true)
+	if err != nil {
 		return nil, err
 	}
-	if n < len(buf) {
-		return nil, fmt.Errorf("read n %d < len buf %d", n, len(buf))
+
+	var rangeDels []encoder.RangeTombstone
+	br := bytes.NewReader(block)
+	for br.Len() > 0 {
+		k, v, err := Decode(br)
+		if err != nil {
+			return nil, r.corruption(start, fmt.Errorf("failed to decode range tombstone: %w", err))
+		}
+		start, seq, _ := encoder.ParseInternalKey(k)
+		rangeDels = append(rangeDels, encoder.RangeTombstone{Start: start, End: v, Seq: seq})
 	}
 
-	startOffset := endOffsets - (int64(r.lenKeys) * sizeCellDefault)
-	r.offsets = r.buf.Bytes()[startOffset:endOffsets]
-	r.keysvalues = r.buf.Bytes()[:startOffset]
-	// end read sparse idx [key][data file offset]+[offsets key sparse idx]
+	return rangeDels, nil
+}
 
-	return r, nil
+// RangeTombstones returns the range tombstones of the file.
+func (r *Reader) RangeTombstones() []encoder.RangeTombstone {
+	return r.rangeDels
 }
 
 func (r *Reader) readOffsetAtDataBlock(pos int) (int64, error) {
@@ -160,21 +306,46 @@ func (r *Reader) readOffsetAtDataBlock(pos int) (int64, error) {
 	if err != nil {
 		return 0, err
 	}
+	if r.version == formatBaseline {
+		return int64(decodeUInt32(offset)), nil
+	}
 
-	return int64(decodeUInt32(offset)), nil
+	off, n := binary.Uvarint(offset)
+	if n <= 0 || off > uint64(r.endDataBlock) {
+		return 0, r.corruption(r.size-r.sizeIndexBlock, fmt.Errorf("%w: offset of the sparse key %d", errMalformed, pos))
+	}
+
+	return int64(off), nil
 }
 
 func (r *Reader) readOffsetSparseKeyAt(pos int) int64 {
-	return int64(decodeUInt32(r.offsets[pos*sizeCellDefault : pos*sizeCellDefault+sizeCellDefault]))
+	if r.version == formatBaseline {
+		return int64(decodeUInt32(r.offsets[pos*sizeCellDefault : pos*sizeCellDefault+sizeCellDefault]))
+	}
+
+	return int64(decodeUInt64(r.offsets[pos*sizeCellMax : pos*sizeCellMax+sizeCellMax]))
 }
 
 func (r *Reader) readIdxBlockAt(pos int) ([]byte, []byte, error) {
+	malformed := r.corruption(r.size-r.sizeIndexBlock, fmt.Errorf("%w: sparse key %d", errMalformed, pos))
 	offset := r.readOffsetSparseKeyAt(pos)
+	if offset < 0 || offset >= int64(len(r.keysvalues)) {
+		return nil, nil, malformed
+	}
 	kl, n := binary.Uvarint(r.keysvalues[offset:])
+	if n <= 0 {
+		return nil, nil, malformed
+	}
 	offset += int64(n)
 
 	vl, n := binary.Uvarint(r.keysvalues[offset:])
+	if n <= 0 {
+		return nil, nil, malformed
+	}
 	offset += int64(n)
+	if left := uint64(int64(len(r.keysvalues)) - offset); kl > left || vl > left-kl {
+		return nil, nil, malformed
+	}
 
 	key := r.keysvalues[offset : offset+int64(kl)]
 
@@ -184,61 +355,79 @@ func (r *Reader) readIdxBlockAt(pos int) ([]byte, []byte, error) {
 	return key, val, nil
 }
 
-func (r *Reader) bsearch(skey []byte) (int64, int64, bool, error) {
-	low, high, mid := 0, int(r.lenKeys), 0
-	var from, to = int64(0), r.endDataBlock
+// bsearchSegment returns the position of the last sparse segment
+// whose first key is less than or equal to skey, or -1 if there is no such segment.
+func (r *Reader) bsearchSegment(skey []byte) (int, error) {
+	low, high := 0, int(r.lenKeys)
 
 	for low < high {
-		mid = (low + high) / 2
-		k, v, err := r.readIdxBlockAt(mid)
+		mid := (low + high) / 2
+		k, _, err := r.readIdxBlockAt(mid)
 		if err != nil {
-			return 0, 0, from < to, err
+			return 0, err
 		}
 
-		offset := int64(decodeUInt32(v))
+		// if k <= skey
+		if r.cmp(k, skey) <= 0 {
+			low = mid + 1
+		} else {
+			high = mid
+		}
+	}
 
-		cmp := bytes.Compare(skey, k)
-		switch cmp {
-		// if skey == k
-		case 0:
-			from = offset
+	return low - 1, nil
+}
 
-			if mid == int(r.lenKeys)-1 {
-				return from, to, from < to, nil
-			}
+// segmentBounds returns the data file offsets of the sparse segment.
+func (r *Reader) segmentBounds(pos int) (int64, int64, error) {
+	from, err := r.readOffsetAtDataBlock(pos)
+	if err != nil {
+		return 0, 0, err
+	}
+	if pos == int(r.lenKeys)-1 {
+		return from, r.endDataBlock, nil
+	}
 
-			to, err = r.readOffsetAtDataBlock(mid + 1)
-			if err != nil {
-				return 0, 0, from < to, err
-			}
+	to, err := r.readOffsetAtDataBlock(pos + 1)
+	if err != nil {
+		return 0, 0, err
+	}
+	if from > to {
+		return 0, 0, r.corruption(from, fmt.Errorf("%w: the sparse segment %d ends at %d", errMalformed, pos, to))
+	}
 
-			return from, to, from < to, nil
-		// if skey < k
-		case -1:
-			to = offset
-			high = mid
-		case 1:
-			// if skey > k
-			from = offset
-			low = mid + 1
-		}
+	return from, to, nil
+}
+
+func (r *Reader) bsearch(skey []byte) (int64, int64, bool, error) {
+	pos, err := r.bsearchSegment(skey)
+	if err != nil {
+		return 0, 0, false, err
+	}
+	if pos < 0 {
+		return 0, 0, false, nil
+	}
+
+	from, to, err := r.segmentBounds(pos)
+	if err != nil {
+		return 0, 0, false, err
 	}
 
 	return from, to, from < to, nil
 }
 
+// readDataBlock reads the entries of the data block, verified if the reader verifies the reads.
 func (r *Reader) readDataBlock(from, to int64) ([]byte, error) {
+	return r.readBlock(from, to, r.verify)
+}
+
+func (r *Reader) readBlock(from, to int64, verify bool) ([]byte, error) {
 	block := make([]byte, to-from)
-	n, err := r.fsst.ReadAt(block, from)
-	if err != nil {
+	if _, err := r.fsst.ReadAt(block, from); err != nil {
 		return nil, err
 	}
 
-	if len(block) < n {
-		return nil, fmt.Errorf("%d < %d", len(block), n)
-	}
-
-	return block, nil
+	return r.verifyBlock(block, from, verify)
 }
 
 func (r *Reader) search(key []byte) ([]byte, error) {
@@ -256,7 +445,12 @@ func (r *Reader) search(key []byte) ([]byte, error) {
 		return nil, err
 	}
 
-	return r.lsearch(key, block)
+	val, err := r.lsearch(key, block)
+	if err != nil && err != ErrKeyNotFound {
+		return nil, r.corruption(from, err)
+	}
+
+	return val, err
 }
 
 func (r *Reader) lsearch(skey, block []byte) ([]byte, error) {
@@ -275,7 +469,7 @@ func (r *Reader) lsearch(skey, block []byte) ([]byte, error) {
 		if err == io.EOF {
 			return nil, ErrKeyNotFound
 		}
-		if bytes.Equal(skey, key) {
+		if r.cmp(skey, key) == 0 {
 			return val, nil
 		}
 	}
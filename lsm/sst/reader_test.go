@@ -2,10 +2,13 @@ package sst
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"os"
 	"path"
 	"testing"
+
+	"github.com/s-ilyin/lsm-distributed/lsm/encoder"
 )
 
 func TestOffsetsReader(t *testing.T) {
@@ -19,8 +22,9 @@ func TestOffsetsReader(t *testing.T) {
 			offset: 0,
 		},
 		{
+			// [key length][value length][aa][varint offset]
 			name:   "2",
-			offset: 8,
+			offset: 5,
 		},
 	}
 	if _, err := os.Stat(dir); os.IsNotExist(err) {
@@ -54,6 +58,87 @@ func TestOffsetsReader(t *testing.T) {
 	}
 }
 
+func TestReaderBaselineFormat(t *testing.T) {
+	var dir = "tmp-test-reader-baseline"
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		os.Mkdir(dir, os.FileMode(0777))
+	}
+	defer os.RemoveAll(dir)
+
+	// the file written before the range-del block:
+	// uint32 offsets and the footer [seqnum u64][len keys u32][total size idx block u32]
+	var (
+		buf     bytes.Buffer
+		idx     bytes.Buffer
+		offsets []uint32
+		keys    = []string{"a", "b", "c", "d", "e"}
+	)
+	for i, k := range keys {
+		if i%2 == 0 {
+			offsets = append(offsets, uint32(idx.Len()))
+			Encode(&idx, []byte(k), encodeUInt32(uint32(buf.Len())))
+		}
+		Encode(&buf, []byte(k), []byte(k+k))
+	}
+	for _, off := range offsets {
+		idx.Write(encodeUInt32(off))
+	}
+	idx.Write(encodeUInt64(7))
+	idx.Write(encodeUInt32(uint32(len(offsets))))
+	idx.Write(encodeUInt32(uint32(idx.Len() + sizeCellDefault)))
+	buf.Write(idx.Bytes())
+
+	filename := path.Join(dir, "data_baseline.sst")
+	if err := os.WriteFile(filename, buf.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	rd, err := NewReader(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rd.Close()
+
+	if rd.version != formatBaseline || rd.Sequence() != 7 {
+		t.Fatalf("want %d@%d expect %d@%d", formatBaseline, 7, rd.version, rd.Sequence())
+	}
+	for _, k := range keys {
+		val, err := rd.search([]byte(k))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(val) != k+k {
+			t.Fatalf("want %s expect %s", k+k, val)
+		}
+	}
+
+	it, err := rd.Iterator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got string
+	for it.HasNext() {
+		k, _, err := it.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got += string(k)
+	}
+	if got != "abcde" {
+		t.Fatalf("want %s expect %s", "abcde", got)
+	}
+
+	// the footer without the magic pointing to no index is not read as the empty file
+	damaged := bytes.Repeat([]byte{0xff}, 32)
+	if err := os.WriteFile(filename, damaged, 0600); err != nil {
+		t.Fatal(err)
+	}
+	var corruption *ErrCorruption
+	if _, err := NewReader(filename); !errors.As(err, &corruption) || corruption.File != filename {
+		t.Fatalf("want %T expect %v", corruption, err)
+	}
+}
+
 func TestReader(t *testing.T) {
 	var dir = "tmp-test-reader"
 	tests := []struct {
@@ -229,3 +314,122 @@ func BenchmarkReaderSparse16384(b *testing.B) {
 		}
 	}
 }
+
+func TestReaderRangeTombstones(t *testing.T) {
+	var dir = "tmp-test-reader-range-del"
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		os.Mkdir(dir, os.FileMode(0777))
+	}
+	defer os.RemoveAll(dir)
+
+	wr, err := NewWriter(path.Join(dir, "0000.sst"), SparseKeyDistance(4))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wr.Write([]byte("aa"), []byte("bb"))
+	wr.Write([]byte("cc"), []byte("dd"))
+	wr.WriteRangeTombstone(encoder.RangeTombstone{Start: []byte("b"), End: []byte("c"), Seq: 7})
+	wr.WriteRangeTombstone(encoder.RangeTombstone{Start: []byte("x"), End: []byte("z"), Seq: 9})
+	wr.AddIdxBlock(10)
+	wr.Close()
+
+	rd, err := NewReader(wr.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rd.Close()
+
+	rts := rd.RangeTombstones()
+	if len(rts) != 2 {
+		t.Fatalf("want %d tombstones expect %d", 2, len(rts))
+	}
+	if string(rts[0].Start) != "b" || string(rts[0].End) != "c" || rts[0].Seq != 7 {
+		t.Fatalf("want %s-%s@%d expect %s-%s@%d", "b", "c", 7, rts[0].Start, rts[0].End, rts[0].Seq)
+	}
+
+	// the data block ends before the range-del block
+	it, err := rd.Iterator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keys string
+	for it.HasNext() {
+		k, _, err := it.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys += string(k)
+	}
+	if keys != "aacc" {
+		t.Fatalf("want %s expect %s", "aacc", keys)
+	}
+}
+
+func TestReaderCorruption(t *testing.T) {
+	var dir = "tmp-test-reader-corruption"
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		os.Mkdir(dir, os.FileMode(0777))
+	}
+	defer os.RemoveAll(dir)
+
+	wr, err := NewWriter(path.Join(dir, "0000.sst"), SparseKeyDistance(4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	wr.Write([]byte("aa"), []byte("bb"))
+	wr.Write([]byte("cc"), []byte("dd"))
+	wr.AddIdxBlock(10)
+	wr.Close()
+
+	rd, err := NewReader(wr.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rd.VerifyChecksums(); err != nil {
+		t.Fatal(err)
+	}
+	rd.Close()
+
+	data, err := os.ReadFile(wr.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the value of the second entry: [aabb][crc32c][cc dd]
+	damaged := bytes.Clone(data)
+	damaged[6+sizeChecksum+4] ^= 0xff
+	if err := os.WriteFile(wr.Name(), damaged, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	rd, err = NewReader(wr.Name(), VerifyOnRead(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rd.Close()
+
+	var corruption *ErrCorruption
+	if err := rd.VerifyChecksums(); !errors.As(err, &corruption) || !errors.Is(err, ErrChecksum) {
+		t.Fatalf("want %v expect %v", ErrChecksum, err)
+	}
+	if corruption.File != wr.Name() || corruption.Offset != 6+sizeChecksum {
+		t.Fatalf("want %s at %d expect %s at %d", wr.Name(), 6+sizeChecksum, corruption.File, corruption.Offset)
+	}
+	if _, err := rd.search([]byte("cc")); !errors.As(err, &corruption) {
+		t.Fatalf("want %T expect %v", corruption, err)
+	}
+	// the first block is not damaged
+	if val, err := rd.search([]byte("aa")); err != nil || string(val) != "bb" {
+		t.Fatalf("want %s expect %s %v", "bb", val, err)
+	}
+
+	// the damaged footer fails the open
+	damaged = bytes.Clone(data)
+	damaged[len(damaged)-footerSize] ^= 0xff
+	if err := os.WriteFile(wr.Name(), damaged, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewReader(wr.Name()); !errors.As(err, &corruption) || !errors.Is(err, ErrChecksum) {
+		t.Fatalf("want %v expect %v", ErrChecksum, err)
+	}
+}
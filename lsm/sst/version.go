@@ -0,0 +1,58 @@
+package sst
+
+// Version is the snapshot of the files of all levels. The files of the version
+// are not closed until it is released, even if they are replaced in the meantime.
+type Version struct {
+	levels []*SSTLevel
+}
+
+// Version takes the snapshot of the files of all levels, it must be released by Release.
+func (of *ObserverFiles) Version() *Version {
+	of.lock.RLock()
+	defer of.lock.RUnlock()
+
+	v := &Version{levels: append([]*SSTLevel(nil), of.levels[:]...)}
+	for _, f := range v.Files() {
+		f.Reader.Ref()
+	}
+
+	return v
+}
+
+// Iterator returns the iterator over the files of the version
+// from the newest to the oldest.
+func (v *Version) Iterator() *LevelIterator {
+	return newLevelIterator(v.levels)
+}
+
+// Level returns the files of the level of the version.
+func (v *Version) Level(level Level) []File {
+	if int(level) < len(v.levels) && v.levels[level] != nil {
+		return v.levels[level].Files
+	}
+
+	return nil
+}
+
+// Files returns the files of the version ordered from the newest to the oldest.
+func (v *Version) Files() []File {
+	var files []File
+	it := v.Iterator()
+	for it.hasNext() {
+		files = append(files, it.next())
+	}
+
+	return files
+}
+
+// Release releases the files of the version.
+func (v *Version) Release() error {
+	var err error
+	for _, f := range v.Files() {
+		if uerr := f.Reader.Unref(); err == nil {
+			err = uerr
+		}
+	}
+
+	return err
+}
@@ -5,7 +5,12 @@ import (
 	"bytes"
 	"encoding/binary"
 	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
 	"os"
+
+	"github.com/s-ilyin/lsm-distributed/lsm/encoder"
 )
 
 type OptionWriter func(w *Writer)
@@ -16,6 +21,13 @@ func SparseKeyDistance(sparseKeyDistance int32) OptionWriter {
 	}
 }
 
+// FileSync makes Close sync the file to the disk.
+func FileSync(fsync bool) OptionWriter {
+	return func(w *Writer) {
+		w.fsync = fsync
+	}
+}
+
 func NewWriter(filepath string, options ...OptionWriter) (*Writer, error) {
 	file, err := NewSSTFiles(filepath)
 	if err != nil {
@@ -26,12 +38,16 @@ func NewWriter(filepath string, options ...OptionWriter) (*Writer, error) {
 		fd:       file,
 		buff:     bufio.NewWriter(file),
 		bufidx:   bytes.NewBuffer(make([]byte, 0, sizeBuf)),
+		bufrdel:  bytes.NewBuffer(nil),
 		keyNum:   0,
 		dataPos:  0,
 		indexPos: 0,
 		n:        0,
 	}
 
+	w.sum = crc32.New(castagnoli)
+	w.data = io.MultiWriter(w.buff, w.sum)
+
 	for _, opt := range options {
 		opt(w)
 	}
@@ -43,9 +59,14 @@ type Writer struct {
 	fd     *os.File
 	bufidx *bytes.Buffer
 	buff   *bufio.Writer
+	// range tombstones are written between the data and the index blocks
+	bufrdel *bytes.Buffer
+	// the entries of the data block are written to the file and the checksum of the block
+	data io.Writer
+	sum  hash.Hash32
 
 	reader                    *Reader
-	offsets                   []uint32
+	offsets                   []uint64
 	sparseKeyDistance         int32
 	keyNum                    int32
 	dataPos, indexPos, sprPos int
@@ -56,10 +77,11 @@ type Writer struct {
 
 	idxB  bool
 	close bool
+	fsync bool
 }
 
-func (w *Writer) Reader() (*Reader, error) {
-	r, err := NewReader(w.Name())
+func (w *Writer) Reader(options ...OptionReader) (*Reader, error) {
+	r, err := NewReader(w.Name(), options...)
 	if err != nil {
 		return nil, err
 	}
@@ -73,7 +95,7 @@ func (w *Writer) Name() string {
 }
 
 func (w *Writer) Write(key, val []byte) error {
-	dBytes, err := Encode(w.buff, key, val)
+	dBytes, err := Encode(w.data, key, val)
 	if err != nil {
 		return fmt.Errorf("failed to write to the data file: %w", err)
 	}
@@ -82,19 +104,34 @@ func (w *Writer) Write(key, val []byte) error {
 		w.offset = w.dataPos
 	}
 	w.distance += len(key) + len(val) + (2 * binary.MaxVarintLen64)
+	w.dataPos += dBytes
 
 	if w.distance >= int(w.sparseKeyDistance) {
 		if err = w.writeSparseKey(key); err != nil {
 			return fmt.Errorf("failed to write to the file: %w", err)
 		}
+		if err = w.finishBlock(); err != nil {
+			return fmt.Errorf("failed to write to the file: %w", err)
+		}
 		w.distance = 0
 		w.key = nil
 	}
-	w.dataPos += dBytes
 	w.keyNum++
 	w.n += len(key) + len(val)
 	return nil
 }
+
+// WriteRangeTombstone adds the range tombstone to the range-del block of the file.
+// The tombstone is stored as the internal key of the start with the end as the value.
+func (w *Writer) WriteRangeTombstone(t encoder.RangeTombstone) error {
+	ikey := encoder.MakeInternalKey(t.Start, t.Seq, encoder.OpKindRangeDelete)
+	if _, err := Encode(w.bufrdel, ikey, t.End); err != nil {
+		return fmt.Errorf("failed to write the range tombstone: %w", err)
+	}
+
+	return nil
+}
+
 func (w *Writer) writeSparseKey(key []byte) error {
 	if w.bufidx.Available() < len(key)+sizeCellDefault {
 		w.bufidx.Grow(len(key) + sizeCellDefault)
@@ -105,12 +142,24 @@ func (w *Writer) writeSparseKey(key []byte) error {
 		return err
 	}
 
-	w.offsets = append(w.offsets, uint32(w.sprPos))
+	w.offsets = append(w.offsets, uint64(w.sprPos))
 	w.sprPos += n
 
 	return nil
 }
 
+// finishBlock ends the data block of the sparse key with the checksum of the block.
+func (w *Writer) finishBlock() error {
+	n, err := binaryPutUint32(w.buff, w.sum.Sum32())
+	if err != nil {
+		return err
+	}
+	w.dataPos += n
+	w.sum.Reset()
+
+	return nil
+}
+
 func (w *Writer) AddIdxBlock(seqNum uint64) error {
 	var (
 		err error
@@ -121,26 +170,54 @@ func (w *Writer) AddIdxBlock(seqNum uint64) error {
 		if err = w.writeSparseKey(w.key); err != nil {
 			return err
 		}
+		if err = w.finishBlock(); err != nil {
+			return err
+		}
 		w.key = nil
 	}
 
+	sizeRangeDel := w.bufrdel.Len()
+	if sizeRangeDel > 0 {
+		if n, err = binaryPutUint32(w.bufrdel, crc32.Checksum(w.bufrdel.Bytes(), castagnoli)); err != nil {
+			return err
+		}
+		sizeRangeDel += n
+	}
+	nRangeDel, err := w.buff.ReadFrom(w.bufrdel)
+	if err != nil {
+		return err
+	}
+	w.dataPos += int(nRangeDel)
+
 	for idx := range w.offsets {
-		if n, err = binaryPutUint32(w.bufidx, w.offsets[idx]); err != nil {
+		if n, err = binaryPutUint64(w.bufidx, w.offsets[idx]); err != nil {
 			return err
 		}
 		w.sprPos += n
 	}
+	if n, err = binaryPutUint32(w.bufidx, crc32.Checksum(w.bufidx.Bytes(), castagnoli)); err != nil {
+		return err
+	}
+	w.sprPos += n
 
-	if n, err = binaryPutUint64(w.bufidx, seqNum); err != nil {
+	// footer: [seqnum][len keys][size range-del block][total size idx block][crc32c][version][magic]
+	footer := []uint64{seqNum, uint64(len(w.offsets)), uint64(sizeRangeDel), uint64(w.sprPos + footerSize)}
+	start := w.bufidx.Len()
+	for idx := range footer {
+		if n, err = binaryPutUint64(w.bufidx, footer[idx]); err != nil {
+			return err
+		}
+		w.sprPos += n
+	}
+	if n, err = binaryPutUint32(w.bufidx, crc32.Checksum(w.bufidx.Bytes()[start:], castagnoli)); err != nil {
 		return err
 	}
 	w.sprPos += n
-	if n, err = binaryPutUint32(w.bufidx, uint32(len(w.offsets))); err != nil {
+	if n, err = binaryPutUint32(w.bufidx, formatVersion); err != nil {
 		return err
 	}
 	w.sprPos += n
-
-	if n, err = binaryPutUint32(w.bufidx, uint32(w.sprPos+sizeCellDefault)); err != nil {
+	if n, err = binaryPutUint64(w.bufidx, footerMagic); err != nil {
 		return err
 	}
 	w.sprPos += n
@@ -177,9 +254,11 @@ func (w *Writer) Close() error {
 		return fmt.Errorf("err flush at the close: %s", err)
 	}
 	// fsync degrades performance!!!
-	// if err := w.fd.Sync(); err != nil {
-	// 	return fmt.Errorf("err sync at the close: %s", err)
-	// }
+	if w.fsync {
+		if err := w.fd.Sync(); err != nil {
+			return fmt.Errorf("err sync at the close: %s", err)
+		}
+	}
 	if err := w.fd.Close(); err != nil {
 		return fmt.Errorf("err close at the close: %s", err)
 	}
@@ -0,0 +1,270 @@
+package lsm
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/s-ilyin/lsm-distributed/lsm/sst"
+	"github.com/s-ilyin/lsm-distributed/lsm/wal"
+)
+
+// Delay of the write when level 0 of the family reaches the slowdown trigger,
+// the delay grows by slowdownDelay with every file above the trigger up to maxSlowdownDelay.
+const (
+	slowdownDelay    = time.Millisecond
+	maxSlowdownDelay = 100 * time.Millisecond
+)
+
+// WriteStallCondition is the state of the writes of a column family.
+type WriteStallCondition int
+
+const (
+	WriteStallNormal WriteStallCondition = iota
+	// The writes are delayed to let the compaction catch up.
+	WriteStallDelayed
+	// The writes wait for the flush or the compaction.
+	WriteStallStopped
+)
+
+func (c WriteStallCondition) String() string {
+	switch c {
+	case WriteStallDelayed:
+		return "delayed"
+	case WriteStallStopped:
+		return "stopped"
+	default:
+		return "normal"
+	}
+}
+
+// WriteStallCause is the reason of the write stall.
+type WriteStallCause string
+
+const (
+	// The family has MaxWriteBufferNumber MemTables waiting for the flush.
+	StallMemTableLimit WriteStallCause = "memtable limit"
+	// Level 0 has L0SlowdownWritesTrigger or L0StopWritesTrigger files.
+	StallL0Files WriteStallCause = "level 0 files"
+	// The files waiting for the compaction reached PendingCompactionBytesLimit.
+	StallPendingCompactionBytes WriteStallCause = "pending compaction bytes"
+)
+
+// WriteStallInfo describes the write delayed or stopped by the write controller.
+type WriteStallInfo struct {
+	Family    string
+	Condition WriteStallCondition
+	Cause     WriteStallCause
+	// Time the write was delayed or stopped for.
+	Duration time.Duration
+}
+
+// WriteStallStats are the write stalls since the tree was opened.
+type WriteStallStats struct {
+	Delays    uint64
+	DelayTime time.Duration
+	Stops     uint64
+	StopTime  time.Duration
+}
+
+// WriteStallTriggers sets the number of the level 0 files of the default column family
+// starting from which the writes are delayed and stopped until the compaction.
+func WriteStallTriggers(slowdown, stop int) func(*LSMTree) {
+	return func(t *LSMTree) {
+		t.defaultFamily.config.L0SlowdownWritesTrigger = slowdown
+		t.defaultFamily.config.L0StopWritesTrigger = stop
+	}
+}
+
+// PendingCompactionBytesLimit sets the size of the files of the default column family
+// waiting for the compaction starting from which the writes are stopped.
+func PendingCompactionBytesLimit(limit uint64) func(*LSMTree) {
+	return func(t *LSMTree) {
+		t.defaultFamily.config.PendingCompactionBytesLimit = limit
+	}
+}
+
+// OnWriteStall sets the listener called after every delayed or stopped write.
+// The listener is called without holding the lock of the tree.
+func OnWriteStall(listener func(WriteStallInfo)) func(*LSMTree) {
+	return func(t *LSMTree) {
+		t.stalls.listener = listener
+	}
+}
+
+// stalls collects the write stalls.
+type stalls struct {
+	lock     sync.Mutex
+	stats    WriteStallStats
+	listener func(WriteStallInfo)
+}
+
+func (s *stalls) add(events []WriteStallInfo) {
+	if len(events) == 0 {
+		return
+	}
+
+	s.lock.Lock()
+	for _, e := range events {
+		switch e.Condition {
+		case WriteStallDelayed:
+			s.stats.Delays++
+			s.stats.DelayTime += e.Duration
+		case WriteStallStopped:
+			s.stats.Stops++
+			s.stats.StopTime += e.Duration
+		}
+	}
+	s.lock.Unlock()
+
+	if s.listener != nil {
+		for _, e := range events {
+			s.listener(e)
+		}
+	}
+}
+
+// WriteStallStats returns the write stalls since the tree was opened.
+func (t *LSMTree) WriteStallStats() WriteStallStats {
+	t.stalls.lock.Lock()
+	defer t.stalls.lock.Unlock()
+
+	return t.stalls.stats
+}
+
+// stallCondition returns the state of the writes of the family by the level 0 files
+// and the size of the files waiting for the compaction. The triggers take effect
+// only if the merge job is running. Called under the lock of the tree.
+func (cf *ColumnFamily) stallCondition() (WriteStallCondition, WriteStallCause) {
+	if cf.config.Merge.Interval == 0 {
+		return WriteStallNormal, ""
+	}
+
+	l0 := cf.fobserver.Len(sst.BaseLevel)
+	slowdown, stop := cf.config.l0Triggers()
+	if stop > 0 && l0 >= stop {
+		return WriteStallStopped, StallL0Files
+	}
+	if limit := cf.config.PendingCompactionBytesLimit; limit > 0 && cf.pendingBytes >= limit {
+		return WriteStallStopped, StallPendingCompactionBytes
+	}
+	if slowdown > 0 && l0 >= slowdown {
+		return WriteStallDelayed, StallL0Files
+	}
+
+	return WriteStallNormal, ""
+}
+
+// l0Triggers returns the level 0 stall triggers of the config,
+// the stop trigger below the slowdown trigger is raised to it.
+func (c Config) l0Triggers() (int, int) {
+	slowdown, stop := c.L0SlowdownWritesTrigger, c.L0StopWritesTrigger
+	if stop > 0 && stop < slowdown {
+		stop = slowdown
+	}
+
+	return slowdown, stop
+}
+
+// delay returns the delay of the write while the writes of the family are slowed down,
+// so the writes slow down the more the compaction of level 0 falls behind.
+// Called under the lock of the tree.
+func (cf *ColumnFamily) delay() time.Duration {
+	slowdown, _ := cf.config.l0Triggers()
+	over := max(cf.fobserver.Len(sst.BaseLevel)-slowdown+1, 1)
+
+	return min(time.Duration(over)*slowdownDelay, maxSlowdownDelay)
+}
+
+// pendingCompactionBytes estimates the size of the files the compaction has to rewrite:
+// the levels exceeding the merge thresholds and the levels they are merged into.
+// The estimate is kept by install, so it is not computed by every write.
+func (cf *ColumnFamily) pendingCompactionBytes() uint64 {
+	var size int64
+	for lvl := sst.Level(0); lvl < cf.config.Merge.MaxLevels && lvl+1 < cf.fobserver.Levels(); lvl++ {
+		if cf.needsCompaction(lvl, *cf.config) {
+			size += cf.fobserver.Size(lvl) + cf.fobserver.Size(lvl+1)
+		}
+	}
+
+	return uint64(size)
+}
+
+// makeRoom is the write controller: it switches the full MemTables of the families
+// of the batch and holds the writer back while the flush or the compaction falls behind.
+// The writer waits for the flush while the family has MaxWriteBufferNumber MemTables,
+// and it is delayed or stopped by the stall triggers. The stalls of the writer are returned.
+// Called under the lock of the tree, the lock is released while waiting.
+func (t *LSMTree) makeRoom(elems []wal.Entry) ([]WriteStallInfo, error) {
+	var (
+		events []WriteStallInfo
+		seen   = make(map[uint32]struct{})
+	)
+	for idx := range elems {
+		if _, ok := seen[elems[idx].Family]; ok {
+			continue
+		}
+		seen[elems[idx].Family] = struct{}{}
+		cf := t.families[elems[idx].Family]
+
+		var (
+			start       time.Time
+			stopCause   WriteStallCause
+			compactions uint64
+		)
+		for {
+			condition, cause := WriteStallNormal, WriteStallCause("")
+			if cf.full() {
+				if cf.hasRoom() {
+					cf.switchMemTable()
+					continue
+				}
+				condition, cause = WriteStallStopped, StallMemTableLimit
+			} else if condition, cause = cf.stallCondition(); condition == WriteStallStopped {
+				cf.scheduleMerge()
+			}
+
+			if condition == WriteStallDelayed {
+				// the lock is released, so the flush and the compaction go on
+				cf.scheduleMerge()
+				delayed, delay := time.Now(), cf.delay()
+				t.lock.Unlock()
+				time.Sleep(delay)
+				t.lock.Lock()
+				events = append(events, WriteStallInfo{
+					Family:    cf.name,
+					Condition: WriteStallDelayed,
+					Cause:     cause,
+					Duration:  time.Since(delayed),
+				})
+			}
+			if condition != WriteStallStopped {
+				break
+			}
+			stopCause = cause
+
+			if err := t.ctx.Err(); err != nil {
+				return events, err
+			}
+			// the compaction failed since the write was stopped, so the write is not resumed by it
+			if !start.IsZero() && cause != StallMemTableLimit && cf.compactions != compactions && cf.compactErr != nil {
+				return events, fmt.Errorf("the writes are stopped by the failed compaction: %w", cf.compactErr)
+			}
+			if start.IsZero() {
+				start = time.Now()
+				compactions = cf.compactions
+			}
+			t.installed.Wait()
+		}
+		if !start.IsZero() {
+			events = append(events, WriteStallInfo{
+				Family:    cf.name,
+				Condition: WriteStallStopped,
+				Cause:     stopCause,
+				Duration:  time.Since(start),
+			})
+		}
+	}
+
+	return events, nil
+}
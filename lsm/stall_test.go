@@ -0,0 +1,157 @@
+package lsm
+
+import (
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/s-ilyin/lsm-distributed/lsm/sst"
+)
+
+func TestWriteStall(t *testing.T) {
+	var (
+		dir    = "tmp-test-write-stall"
+		lock   sync.Mutex
+		events []WriteStallInfo
+	)
+	defer os.RemoveAll(dir)
+	l := openLevel0(t, dir, MergeConfig(MergeSettings{Interval: time.Hour}), WriteStallTriggers(2, 3),
+		OnWriteStall(func(info WriteStallInfo) {
+			lock.Lock()
+			events = append(events, info)
+			lock.Unlock()
+		}))
+	defer l.Shutdown()
+
+	// the delay grows with the files above the slowdown trigger
+	for _, tt := range []struct {
+		slowdown int
+		want     time.Duration
+	}{{1, 2 * slowdownDelay}, {2, slowdownDelay}} {
+		setTriggers(l, tt.slowdown, 3)
+		l.lock.Lock()
+		delay := l.defaultFamily.delay()
+		l.lock.Unlock()
+		if delay != tt.want {
+			t.Fatalf("want %s expect %s", tt.want, delay)
+		}
+	}
+
+	// the writes are delayed at the slowdown trigger until the merge job compacts level 0
+	l.Put([]byte("c"), []byte("c"))
+	lock.Lock()
+	if len(events) == 0 || events[0].Condition != WriteStallDelayed || events[0].Cause != StallL0Files ||
+		events[0].Family != DefaultColumnFamily {
+		t.Fatalf("want %s expect %+v", WriteStallDelayed, events)
+	}
+	lock.Unlock()
+	waitLevel0(t, l, 2)
+
+	if stats := l.WriteStallStats(); stats.Delays == 0 || stats.Stops != 0 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+	if v, ok, _ := l.Get([]byte("c")); !ok || string(v) != "c" {
+		t.Fatalf("want %s expect %s", "c", v)
+	}
+}
+
+func TestWriteStallStop(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		merge func(*LSMTree)
+	}{
+		{name: "default", merge: func(*LSMTree) {}},
+		// level 0 is the last level
+		{name: "no levels", merge: MergeConfig(MergeSettings{Interval: time.Hour})},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var dir = "tmp-test-write-stall-stop"
+			defer os.RemoveAll(dir)
+			// the stop trigger below the slowdown trigger is raised to it
+			l := openLevel0(t, dir, tt.merge, WriteStallTriggers(3, 2))
+			defer l.Shutdown()
+
+			l.lock.Lock()
+			condition, _ := l.defaultFamily.stallCondition()
+			l.lock.Unlock()
+			if condition != WriteStallNormal {
+				t.Fatalf("want %s expect %s", WriteStallNormal, condition)
+			}
+			setTriggers(l, 0, 2)
+
+			// the write is stopped and resumed by the merge job
+			done := make(chan error)
+			go func() {
+				done <- l.Put([]byte("c"), []byte("c"))
+			}()
+			select {
+			case err := <-done:
+				if err != nil {
+					t.Fatal(err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("the write is not resumed by the merge job")
+			}
+
+			if stats := l.WriteStallStats(); stats.Stops != 1 {
+				t.Fatalf("unexpected stats %+v", stats)
+			}
+			waitLevel0(t, l, 2)
+			if v, ok, _ := l.Get([]byte("c")); !ok || string(v) != "c" {
+				t.Fatalf("want %s expect %s", "c", v)
+			}
+		})
+	}
+}
+
+// openLevel0 opens the tree with two files on level 0. The files are flushed
+// without the options and the tree is reopened, so no merge is scheduled by the flushes.
+func openLevel0(t *testing.T, dir string, options ...func(*LSMTree)) *LSMTree {
+	t.Helper()
+	l, err := Open(dir, MemTableThreshold(1<<20), MergeConfig(MergeSettings{Interval: time.Hour}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []string{"a", "b"} {
+		l.Put([]byte(k), []byte(k))
+		if err := l.defaultFamily.flushMemTable(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	l.Shutdown()
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if l, err = Open(dir, append([]func(*LSMTree){MemTableThreshold(1 << 20)}, options...)...); err != nil {
+		t.Fatal(err)
+	}
+
+	return l
+}
+
+// setTriggers sets the level 0 stall triggers of the default family.
+func setTriggers(l *LSMTree, slowdown, stop int) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.defaultFamily.config.L0SlowdownWritesTrigger = slowdown
+	l.defaultFamily.config.L0StopWritesTrigger = stop
+}
+
+// waitLevel0 waits for the merge job to compact level 0 below the number of the files.
+func waitLevel0(t *testing.T, l *LSMTree, files int) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		l.lock.RLock()
+		n := l.defaultFamily.fobserver.Len(sst.BaseLevel)
+		l.lock.RUnlock()
+		if n < files {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("want less than %d files on level 0 expect %d", files, n)
+		}
+	}
+}
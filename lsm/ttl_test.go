@@ -0,0 +1,79 @@
+package lsm
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/s-ilyin/lsm-distributed/lsm/sst"
+)
+
+func TestPutWithTTL(t *testing.T) {
+	var dir = "tmp-test-ttl"
+	l, err := Open(dir, MemTableThreshold(1<<20))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer l.Shutdown()
+
+	if err := l.PutWithTTL([]byte("a"), []byte("a"), 50*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	l.Put([]byte("b"), []byte("b"))
+	l.PutWithTTL([]byte("c"), []byte("c"), time.Hour)
+	if err := l.PutWithTTL([]byte("d"), []byte("d"), 0); !errors.Is(err, ErrInvalidTTL) {
+		t.Fatalf("want %v expect %v", ErrInvalidTTL, err)
+	}
+
+	if v, ok, _ := l.Get([]byte("a")); !ok || string(v) != "a" {
+		t.Fatalf("want %s expect %s", "a", v)
+	}
+	if err := l.defaultFamily.flushMemTable(); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if _, ok, _ := l.Get([]byte("a")); ok {
+		t.Fatalf("expired key found")
+	}
+	if v, ok, _ := l.Get([]byte("c")); !ok || string(v) != "c" {
+		t.Fatalf("want %s expect %s", "c", v)
+	}
+
+	it, err := l.NewIterator(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keys string
+	for ; it.Valid(); it.Next() {
+		keys += string(it.Key())
+	}
+	if keys != "bc" {
+		t.Fatalf("want %s expect %s", "bc", keys)
+	}
+
+	// the expired key is dropped by the compaction to the bottom level
+	if err := l.defaultFamily.compact(sst.BaseLevel); err != nil {
+		t.Fatal(err)
+	}
+	files := l.defaultFamily.fobserver.Level(sst.BaseLevel + 1)
+	if len(files) != 1 {
+		t.Fatalf("want %d files expect %d", 1, len(files))
+	}
+	fit, err := files[0].Reader.Iterator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var n int
+	for fit.HasNext() {
+		if _, _, err := fit.Next(); err != nil {
+			t.Fatal(err)
+		}
+		n++
+	}
+	if n != 2 {
+		t.Fatalf("want %d entries expect %d", 2, n)
+	}
+}
@@ -0,0 +1,275 @@
+package lsm
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/s-ilyin/lsm-distributed/lsm/encoder"
+	sl "github.com/s-ilyin/lsm-distributed/lsm/skiplist"
+	"github.com/s-ilyin/lsm-distributed/lsm/sst"
+)
+
+var (
+	// ErrTxnConflict is returned by Commit when a key read by the transaction
+	// was changed by another writer after the transaction had started.
+	ErrTxnConflict = errors.New("transaction conflict")
+	// ErrTxnDone is returned when using a committed or rolled back transaction.
+	ErrTxnDone = errors.New("transaction is done")
+)
+
+// DefaultLockTimeout is the time a pessimistic transaction waits for the lock of a key.
+const DefaultLockTimeout = time.Second
+
+type TxnOption func(*Txn)
+
+// Pessimistic makes the transaction lock the keys it reads and writes
+// instead of validating the read set at Commit.
+func Pessimistic() TxnOption {
+	return func(tx *Txn) {
+		tx.pessimistic = true
+	}
+}
+
+// LockTimeout sets the time a pessimistic transaction waits for the lock of a key.
+func LockTimeout(d time.Duration) TxnOption {
+	return func(tx *Txn) {
+		tx.timeout = d
+	}
+}
+
+// Txn is a transaction. Writes are buffered until Commit and
+// the transaction reads its own writes.
+//
+// An optimistic transaction reads the state of the tree at its start
+// and Commit fails with ErrTxnConflict if any key read by the transaction
+// was changed since then.
+//
+// A pessimistic transaction takes a shared lock of every key it reads
+// and an exclusive lock of every key it writes or reads by GetForUpdate,
+// the locks are held until Commit or Rollback. Reads see the latest
+// committed state. Only transactions take the locks, writes made
+// directly to the tree are not blocked by them.
+//
+// Txn is not goroutine-safe.
+type Txn struct {
+	t      *LSMTree
+	snap   *Snapshot
+	writes *sl.SkipList
+	reads  map[string]struct{}
+	done   bool
+
+	id          uint64
+	pessimistic bool
+	timeout     time.Duration
+	locked      map[string]lockMode
+}
+
+// BeginTxn starts a new transaction, optimistic by default.
+// The transaction must be finished by Commit or Rollback
+// to release the resources held by it.
+func (t *LSMTree) BeginTxn(options ...TxnOption) *Txn {
+	tx := &Txn{
+		t:       t,
+		writes:  sl.NewSkipList(sl.Comparer(t.cmp.Compare)),
+		reads:   make(map[string]struct{}),
+		timeout: DefaultLockTimeout,
+	}
+	for _, opt := range options {
+		opt(tx)
+	}
+
+	if tx.pessimistic {
+		tx.id = t.locks.nextID()
+		tx.locked = make(map[string]lockMode)
+	} else {
+		tx.snap = t.NewSnapshot()
+	}
+
+	return tx
+}
+
+// Get the value for the key. The key is added to the read set
+// of the transaction or locked with the shared lock.
+func (tx *Txn) Get(key []byte) ([]byte, bool, error) {
+	return tx.get(key, lockShared)
+}
+
+// GetForUpdate gets the value for the key locking it with the exclusive lock,
+// so no other transaction can read or write the key until this one is finished.
+// For optimistic transactions it is the same as Get.
+func (tx *Txn) GetForUpdate(key []byte) ([]byte, bool, error) {
+	return tx.get(key, lockExclusive)
+}
+
+func (tx *Txn) get(key []byte, mode lockMode) ([]byte, bool, error) {
+	if tx.done {
+		return nil, false, ErrTxnDone
+	}
+
+	if err := tx.lock(key, mode); err != nil {
+		return nil, false, err
+	}
+
+	if value, ok := tx.writes.Get(key); ok {
+		val := tx.t.decoder.Decode(value)
+		if val.IsTombstone() {
+			return nil, false, sst.ErrKeyNotFound
+		}
+
+		return val.Value(), true, nil
+	}
+
+	if tx.pessimistic {
+		return tx.t.Get(key)
+	}
+
+	tx.reads[string(key)] = struct{}{}
+
+	return tx.t.defaultFamily.get(key, tx.snap.seq)
+}
+
+// lock takes the lock of the key for the pessimistic transaction.
+func (tx *Txn) lock(key []byte, mode lockMode) error {
+	if !tx.pessimistic || tx.locked[string(key)] >= mode {
+		return nil
+	}
+
+	if err := tx.t.locks.lock(tx.id, string(key), mode, tx.timeout); err != nil {
+		return err
+	}
+	tx.locked[string(key)] = mode
+
+	return nil
+}
+
+// Put the key into the write buffer of the transaction.
+func (tx *Txn) Put(key, value []byte) error {
+	if tx.done {
+		return ErrTxnDone
+	}
+
+	if len(value) == 0 {
+		return ErrValueRequired
+	} else if uint64(len(value)) > MaxValueSize {
+		return ErrValueTooLarge
+	}
+
+	return tx.put(key, tx.t.encoder.Encode(encoder.OpKindSet, value))
+}
+
+// Delete the key in the transaction.
+func (tx *Txn) Delete(key []byte) error {
+	if tx.done {
+		return ErrTxnDone
+	}
+
+	return tx.put(key, tx.t.encoder.Encode(encoder.OpKindDelete, nil))
+}
+
+func (tx *Txn) put(key, value []byte) error {
+	if len(key) == 0 {
+		return ErrKeyRequired
+	} else if len(key) > MaxKeySize {
+		return ErrKeyTooLarge
+	}
+
+	if err := tx.lock(key, lockExclusive); err != nil {
+		return err
+	}
+
+	tx.writes.Put(append([]byte(nil), key...), value)
+
+	return nil
+}
+
+// Commit applies the writes of the transaction as a single atomic batch.
+// The transaction is finished even if the commit fails.
+func (tx *Txn) Commit() error {
+	if tx.done {
+		return ErrTxnDone
+	}
+	defer tx.finish()
+
+	if tx.writes.Size() == 0 {
+		return nil
+	}
+
+	batch := NewWriteBatch()
+	for it := tx.writes.Iterator(); it.HasNext(); {
+		key, value := it.Next()
+		batch.add(nil, key, value)
+	}
+
+	if tx.pessimistic {
+		return tx.t.write(batch, nil, WriteOptions{})
+	}
+
+	return tx.t.write(batch, tx.validate, WriteOptions{})
+}
+
+// Rollback discards the writes of the transaction and releases its locks.
+func (tx *Txn) Rollback() error {
+	if tx.done {
+		return ErrTxnDone
+	}
+	tx.finish()
+
+	return nil
+}
+
+func (tx *Txn) finish() {
+	tx.done = true
+	if tx.pessimistic {
+		keys := make([]string, 0, len(tx.locked))
+		for key := range tx.locked {
+			keys = append(keys, key)
+		}
+		tx.t.locks.unlock(tx.id, keys)
+
+		return
+	}
+
+	tx.t.ReleaseSnapshot(tx.snap)
+}
+
+// validate checks that the keys of the read set were not changed
+// after the start of the transaction. Called under the lock of the tree.
+func (tx *Txn) validate() error {
+	for key := range tx.reads {
+		seq, err := tx.t.defaultFamily.lastSequence([]byte(key))
+		if err != nil {
+			return err
+		}
+		if seq > tx.snap.seq {
+			return ErrTxnConflict
+		}
+	}
+
+	return nil
+}
+
+// lastSequence returns the sequence number of the newest version of the key
+// or of the newest range tombstone containing it, zero if the key was never written.
+func (cf *ColumnFamily) lastSequence(key []byte) (uint64, error) {
+	v := cf.ref()
+	defer v.unref()
+
+	// the key deleted by the range tombstone is changed as well
+	rseq := encoder.CoveringSequence(cf.t.cmp, v.rangeTombstones(), key, encoder.MaxSequence)
+
+	if ikey, _, ok := v.lookup(key, encoder.MaxSequence); ok {
+		return max(encoder.Sequence(ikey), rseq), nil
+	}
+
+	ikey := encoder.MakeInternalKey(key, encoder.MaxSequence, encoder.OpKindSeek)
+	k, _, exists, err := sst.SearchInDiskTables(ikey, v.files.Iterator())
+	if err != nil {
+		return 0, fmt.Errorf("failed to search in disk: %w", err)
+	}
+	if !exists {
+		return rseq, nil
+	}
+
+	return max(encoder.Sequence(k), rseq), nil
+}
@@ -0,0 +1,157 @@
+package lsm
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTxn(t *testing.T) {
+	var dir = "tmp-test-txn"
+	l, err := Open(dir, MemTableThreshold(1<<20))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer l.Shutdown()
+
+	l.Put([]byte("a"), []byte("1"))
+	l.Put([]byte("b"), []byte("1"))
+
+	// read-your-own-writes
+	tx := l.BeginTxn()
+	if v, ok, _ := tx.Get([]byte("a")); !ok || !bytes.Equal(v, []byte("1")) {
+		t.Fatalf("want %s expect %s", "1", v)
+	}
+	tx.Put([]byte("a"), []byte("2"))
+	tx.Delete([]byte("b"))
+	if v, _, _ := tx.Get([]byte("a")); !bytes.Equal(v, []byte("2")) {
+		t.Fatalf("want %s expect %s", "2", v)
+	}
+	if _, ok, _ := tx.Get([]byte("b")); ok {
+		t.Fatalf("deleted key found in the transaction")
+	}
+	if v, _, _ := l.Get([]byte("a")); !bytes.Equal(v, []byte("1")) {
+		t.Fatalf("uncommitted write is visible: %s", v)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if v, _, _ := l.Get([]byte("a")); !bytes.Equal(v, []byte("2")) {
+		t.Fatalf("want %s expect %s", "2", v)
+	}
+	if _, ok, _ := l.Get([]byte("b")); ok {
+		t.Fatalf("deleted key found")
+	}
+	if err := tx.Commit(); !errors.Is(err, ErrTxnDone) {
+		t.Fatalf("want %v expect %v", ErrTxnDone, err)
+	}
+
+	// conflict on the read key
+	tx = l.BeginTxn()
+	tx.Get([]byte("a"))
+	l.Put([]byte("a"), []byte("3"))
+	tx.Put([]byte("c"), []byte("1"))
+	if err := tx.Commit(); !errors.Is(err, ErrTxnConflict) {
+		t.Fatalf("want %v expect %v", ErrTxnConflict, err)
+	}
+	if _, ok, _ := l.Get([]byte("c")); ok {
+		t.Fatalf("write of the conflicted transaction found")
+	}
+
+	// the conflict is detected when the key is already on disk
+	tx = l.BeginTxn()
+	tx.Get([]byte("a"))
+	l.Put([]byte("a"), []byte("4"))
+	if err := l.defaultFamily.flushMemTable(); err != nil {
+		t.Fatal(err)
+	}
+	tx.Put([]byte("c"), []byte("1"))
+	if err := tx.Commit(); !errors.Is(err, ErrTxnConflict) {
+		t.Fatalf("want %v expect %v", ErrTxnConflict, err)
+	}
+
+	// blind writes and rolled back transactions do not conflict
+	tx = l.BeginTxn()
+	other := l.BeginTxn()
+	other.Get([]byte("a"))
+	tx.Put([]byte("a"), []byte("5"))
+	if err := other.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if v, _, _ := l.Get([]byte("a")); !bytes.Equal(v, []byte("5")) {
+		t.Fatalf("want %s expect %s", "5", v)
+	}
+}
+
+func TestTxnGroupConflict(t *testing.T) {
+	var dir = "tmp-test-txn-group"
+	l, err := Open(dir, MemTableThreshold(1<<20))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer l.Shutdown()
+
+	l.Put([]byte("x"), []byte("0"))
+
+	// the parked leader makes the transactions queue behind it
+	l.lock.Lock()
+	leader := &writer{cond: sync.NewCond(&l.lock)}
+	l.writers = append(l.writers, leader)
+	l.lock.Unlock()
+
+	const n = 5
+	var (
+		wg   sync.WaitGroup
+		errs = make(chan error, n)
+	)
+	for i := 0; i < n; i++ {
+		tx := l.BeginTxn()
+		if _, _, err := tx.Get([]byte("x")); err != nil {
+			t.Fatal(err)
+		}
+		tx.Put([]byte("x"), []byte(strconv.Itoa(i+1)))
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- tx.Commit()
+		}()
+	}
+	for {
+		l.lock.Lock()
+		queued := len(l.writers)
+		l.lock.Unlock()
+		if queued == n+1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	l.lock.Lock()
+	l.finish([]*writer{leader})
+	l.lock.Unlock()
+	wg.Wait()
+	close(errs)
+
+	var committed int
+	for err := range errs {
+		switch {
+		case err == nil:
+			committed++
+		case !errors.Is(err, ErrTxnConflict):
+			t.Fatal(err)
+		}
+	}
+	if committed != 1 {
+		t.Fatalf("want %d expect %d", 1, committed)
+	}
+}
@@ -0,0 +1,217 @@
+package lsm
+
+import (
+	"io"
+	"sync"
+
+	"github.com/s-ilyin/lsm-distributed/lsm/encoder"
+	"github.com/s-ilyin/lsm-distributed/lsm/wal"
+)
+
+// OpKind is the kind of the update.
+type OpKind = encoder.OpKind
+
+const (
+	OpDelete      = encoder.OpKindDelete
+	OpPut         = encoder.OpKindSet
+	OpMerge       = encoder.OpKindMerge
+	OpDeleteRange = encoder.OpKindRangeDelete
+)
+
+// Update is the update of the key read from the WAL.
+type Update struct {
+	Family string
+	Kind   OpKind
+	Key    []byte
+	// The value of the put, the merge operand or the end of the deleted range.
+	Value []byte
+	// Expiry time of the put with the ttl in Unix nanoseconds, zero if the value never expires.
+	ExpireAt int64
+}
+
+// UpdateBatch is the batch written by one write, the updates get
+// the sequence numbers starting from Sequence in the order of the batch.
+type UpdateBatch struct {
+	Sequence uint64
+	Updates  []Update
+	// Time of the write in Unix nanoseconds.
+	Time int64
+}
+
+type updatesOptions struct {
+	wait bool
+}
+
+type UpdatesOption func(*updatesOptions)
+
+// WaitForUpdates makes Next of the updates iterator wait for the new updates
+// instead of stopping at the last one written.
+func WaitForUpdates() UpdatesOption {
+	return func(uo *updatesOptions) {
+		uo.wait = true
+	}
+}
+
+// UpdatesIterator iterates over the batches written to the WAL. The writes done
+// with DisableWAL are not seen by the iterator.
+type UpdatesIterator struct {
+	t    *LSMTree
+	wait bool
+
+	// held by Next while reading the WAL
+	lock   sync.Mutex
+	tailer *wal.Tailer
+	batch  UpdateBatch
+	err    error
+
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// GetUpdatesSince returns the iterator over the batches starting from the batch
+// with the sequence number. The segments with the updates are kept only until
+// they are flushed, RegisterConsumer keeps them until the updates are acknowledged.
+// wal.ErrUpdatesNotAvailable is returned if the updates are removed.
+func (t *LSMTree) GetUpdatesSince(seq uint64, options ...UpdatesOption) (*UpdatesIterator, error) {
+	var uo updatesOptions
+	for _, opt := range options {
+		opt(&uo)
+	}
+
+	tailer, err := t.wal.Tail(seq)
+	if err != nil {
+		return nil, err
+	}
+
+	return &UpdatesIterator{t: t, wait: uo.wait, tailer: tailer, closed: make(chan struct{})}, nil
+}
+
+// Next moves the iterator to the next batch and reports whether there is one.
+// With WaitForUpdates it waits for the next write until the iterator is closed
+// or the tree is shut down.
+func (it *UpdatesIterator) Next() bool {
+	it.lock.Lock()
+	defer it.lock.Unlock()
+
+	for it.err == nil {
+		// taken before reading, so the append in the meantime is not missed
+		appended := it.t.wal.Appended()
+		b, err := it.tailer.Next()
+		if err == nil {
+			it.batch = it.t.updateBatch(b)
+			return true
+		}
+		if err != io.EOF {
+			it.err = err
+			return false
+		}
+		if !it.wait {
+			return false
+		}
+
+		it.lock.Unlock()
+		select {
+		case <-appended:
+		case <-it.closed:
+		case <-it.t.ctx.Done():
+		}
+		it.lock.Lock()
+		select {
+		case <-it.closed:
+			return false
+		case <-it.t.ctx.Done():
+			return false
+		default:
+		}
+	}
+
+	return false
+}
+
+// Batch returns the current batch.
+func (it *UpdatesIterator) Batch() UpdateBatch {
+	return it.batch
+}
+
+// Err returns the error stopped the iterator.
+func (it *UpdatesIterator) Err() error {
+	return it.err
+}
+
+// Close closes the iterator, the waiting Next returns false.
+func (it *UpdatesIterator) Close() error {
+	it.closeOnce.Do(func() { close(it.closed) })
+
+	it.lock.Lock()
+	defer it.lock.Unlock()
+
+	return it.tailer.Close()
+}
+
+// updateBatch decodes the entries of the WAL batch.
+func (t *LSMTree) updateBatch(b wal.Batch) UpdateBatch {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	batch := UpdateBatch{Sequence: b.Seq, Updates: make([]Update, 0, len(b.Elems)), Time: b.Time}
+	for idx := range b.Elems {
+		val := t.decoder.Decode(b.Elems[idx].Val)
+		u := Update{
+			Kind:     val.Kind(),
+			Key:      b.Elems[idx].Key,
+			Value:    val.Value(),
+			ExpireAt: val.ExpireAt(),
+		}
+		if cf, ok := t.families[b.Elems[idx].Family]; ok {
+			u.Family = cf.name
+		}
+		batch.Updates = append(batch.Updates, u)
+	}
+
+	return batch
+}
+
+// Consumer is the registered reader of the updates: the WAL segments are kept
+// until the consumer acknowledges their updates, even after the tree is reopened.
+type Consumer struct {
+	t    *LSMTree
+	name string
+}
+
+// RegisterConsumer registers the consumer of the updates or returns the registered one.
+// The new consumer acknowledges the updates written before it is registered.
+func (t *LSMTree) RegisterConsumer(name string) (*Consumer, error) {
+	if _, err := t.wal.Register(name); err != nil {
+		return nil, err
+	}
+
+	return &Consumer{t: t, name: name}, nil
+}
+
+// UnregisterConsumer removes the consumer, the updates are not kept for it any more.
+func (t *LSMTree) UnregisterConsumer(name string) error {
+	return t.wal.Unregister(name)
+}
+
+// Name returns the name of the consumer.
+func (c *Consumer) Name() string {
+	return c.name
+}
+
+// Acked returns the last sequence number acknowledged by the consumer.
+func (c *Consumer) Acked() uint64 {
+	seq, _ := c.t.wal.Acked(c.name)
+
+	return seq
+}
+
+// Ack acknowledges the updates up to the sequence number,
+// so the WAL segments with them can be removed.
+func (c *Consumer) Ack(seq uint64) error {
+	return c.t.wal.Ack(c.name, seq)
+}
+
+// GetUpdates returns the iterator over the batches not acknowledged by the consumer.
+func (c *Consumer) GetUpdates(options ...UpdatesOption) (*UpdatesIterator, error) {
+	return c.t.GetUpdatesSince(c.Acked()+1, options...)
+}
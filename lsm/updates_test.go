@@ -0,0 +1,175 @@
+package lsm
+
+import (
+	"errors"
+	"os"
+	"path"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/s-ilyin/lsm-distributed/lsm/wal"
+)
+
+func TestGetUpdatesSince(t *testing.T) {
+	var dir = "tmp-test-get-updates-since"
+	l, err := Open(dir, MemTableThreshold(1<<20))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c, err := l.RegisterConsumer("index")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l.Put([]byte("a"), []byte("a"))
+	b := NewWriteBatch()
+	b.Delete([]byte("b"))
+	b.DeleteRange([]byte("c"), []byte("d"))
+	l.Write(b)
+	l.Put([]byte("e"), []byte("e"), WriteOptions{DisableWAL: true})
+	l.PutWithTTL([]byte("f"), []byte("f"), time.Hour)
+
+	type update struct {
+		seq  uint64
+		kind OpKind
+		key  string
+		val  string
+	}
+	read := func(it *UpdatesIterator, n int) []update {
+		t.Helper()
+		var updates []update
+		for len(updates) < n && it.Next() {
+			batch := it.Batch()
+			for idx, u := range batch.Updates {
+				if u.Family != DefaultColumnFamily {
+					t.Fatalf("want family %s expect %s", DefaultColumnFamily, u.Family)
+				}
+				updates = append(updates, update{batch.Sequence + uint64(idx), u.Kind, string(u.Key), string(u.Value)})
+			}
+		}
+		if err := it.Err(); err != nil {
+			t.Fatal(err)
+		}
+		return updates
+	}
+
+	it, err := l.GetUpdatesSince(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []update{
+		{1, OpPut, "a", "a"},
+		{2, OpDelete, "b", ""},
+		{3, OpDeleteRange, "c", "d"},
+		// the write without the WAL is not seen
+		{5, OpPut, "f", "f"},
+	}
+	if got := read(it, len(want)+1); len(got) != len(want) {
+		t.Fatalf("want %v expect %v", want, got)
+	} else {
+		for idx := range want {
+			if got[idx].seq != want[idx].seq || got[idx].kind != want[idx].kind || got[idx].key != want[idx].key || got[idx].val != want[idx].val {
+				t.Fatalf("want %v expect %v", want, got)
+			}
+		}
+	}
+	it.Close()
+
+	// the batch with the sequence number is returned whole
+	if it, err = l.GetUpdatesSince(3); err != nil {
+		t.Fatal(err)
+	}
+	if got := read(it, 1); len(got) != 2 || got[0].seq != 2 {
+		t.Fatalf("want the batch from %d expect %v", 2, got)
+	}
+	it.Close()
+
+	// the waiting iterator gets the new writes
+	if it, err = c.GetUpdates(WaitForUpdates()); err != nil {
+		t.Fatal(err)
+	}
+	read(it, 4)
+	done := make(chan []update)
+	go func() {
+		done <- read(it, 1)
+	}()
+	select {
+	case <-done:
+		t.Fatalf("the iterator does not wait for the updates")
+	case <-time.After(50 * time.Millisecond):
+	}
+	l.Put([]byte("g"), []byte("g"))
+	select {
+	case got := <-done:
+		if len(got) != 1 || got[0].key != "g" || got[0].seq != 6 {
+			t.Fatalf("want %s expect %v", "g", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("the update is not received")
+	}
+	// and stops when closed
+	go func() {
+		done <- read(it, 1)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	it.Close()
+	select {
+	case got := <-done:
+		if len(got) != 0 {
+			t.Fatalf("unexpected updates %v", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("the iterator is not stopped by close")
+	}
+
+	// the flushed segments are kept until the consumer acknowledges them
+	segments := func() int {
+		names, err := filepath.Glob(path.Join(dir, "wal", "*.log"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(names)
+	}
+	if err := l.Flush(true); err != nil {
+		t.Fatal(err)
+	}
+	l.Put([]byte("h"), []byte("h"))
+	if n := segments(); n != 2 {
+		t.Fatalf("want %d segments expect %d", 2, n)
+	}
+
+	l.Shutdown()
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if l, err = Open(dir, MemTableThreshold(1<<20)); err != nil {
+		t.Fatal(err)
+	}
+	defer l.Shutdown()
+	if c, err = l.RegisterConsumer("index"); err != nil {
+		t.Fatal(err)
+	}
+	if c.Acked() != 0 {
+		t.Fatalf("want acked %d expect %d", 0, c.Acked())
+	}
+	if it, err = c.GetUpdates(); err != nil {
+		t.Fatal(err)
+	}
+	if got := read(it, 10); len(got) != 6 {
+		t.Fatalf("want %d updates expect %v", 6, got)
+	}
+	it.Close()
+
+	if err := c.Ack(6); err != nil {
+		t.Fatal(err)
+	}
+	if n := segments(); n != 1 {
+		t.Fatalf("want %d segments expect %d", 1, n)
+	}
+	if _, err := l.GetUpdatesSince(1); !errors.Is(err, wal.ErrUpdatesNotAvailable) {
+		t.Fatalf("want %v expect %v", wal.ErrUpdatesNotAvailable, err)
+	}
+}
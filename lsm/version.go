@@ -0,0 +1,77 @@
+package lsm
+
+import (
+	"sync/atomic"
+
+	"github.com/s-ilyin/lsm-distributed/lsm/memtable"
+	"github.com/s-ilyin/lsm-distributed/lsm/sst"
+)
+
+// version is the state of the column family seen by the readers: the MemTables
+// and the files of the levels. A reader takes the current version and releases it
+// when done, so the flush and the compaction install the new versions without
+// waiting for the readers. The replaced files are removed when the last version
+// referring to them is released.
+type version struct {
+	// the MemTable the writes go to and the immutable MemTables
+	// waiting for the flush from the newest to the oldest
+	mem   *memtable.Memtable
+	imm   []*memtable.Memtable
+	files *sst.Version
+	refs  atomic.Int32
+}
+
+// ref returns the current version of the family, it must be released by unref.
+func (cf *ColumnFamily) ref() *version {
+	cf.vlock.Lock()
+	defer cf.vlock.Unlock()
+
+	v := cf.current
+	v.refs.Add(1)
+
+	return v
+}
+
+// install makes the MemTables and the files of the family the current version.
+// Called under the lock of the tree.
+func (cf *ColumnFamily) install() {
+	v := &version{mem: cf.mem, imm: cf.imm, files: cf.fobserver.Version()}
+	v.refs.Store(1)
+	cf.pendingBytes = cf.pendingCompactionBytes()
+
+	cf.vlock.Lock()
+	old := cf.current
+	cf.current = v
+	cf.vlock.Unlock()
+
+	if old != nil {
+		old.unref()
+	}
+	// the writers waiting for the flush or the compaction check the family again
+	cf.t.installed.Broadcast()
+}
+
+func (v *version) unref() {
+	if v.refs.Add(-1) > 0 {
+		return
+	}
+	if err := v.files.Release(); err != nil {
+		logger.Error(err.Error())
+	}
+}
+
+// memtables returns the MemTables of the version from the newest to the oldest.
+func (v *version) memtables() []*memtable.Memtable {
+	return append([]*memtable.Memtable{v.mem}, v.imm...)
+}
+
+// lookup returns the newest version of the key not newer than seq from the MemTables.
+func (v *version) lookup(key []byte, seq uint64) ([]byte, []byte, bool) {
+	for _, mem := range v.memtables() {
+		if ikey, value, ok := mem.Lookup(key, seq); ok {
+			return ikey, value, true
+		}
+	}
+
+	return nil, nil, false
+}
@@ -0,0 +1,123 @@
+package lsm
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/s-ilyin/lsm-distributed/lsm/sst"
+)
+
+func TestConcurrentReads(t *testing.T) {
+	var dir = "tmp-test-concurrent-reads"
+	l, err := Open(dir, MemTableThreshold(1<<10), MergeConfig(MergeSettings{
+		Interval:         10 * time.Millisecond,
+		NumberOfSstFiles: 2,
+		MaxLevels:        4,
+		DataSize:         1,
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	const n = 2000
+	key := func(i int64) []byte { return []byte(fmt.Sprintf("k%05d", i)) }
+
+	// the readers see every written key while the MemTables are flushed
+	// and the files are compacted
+	var (
+		written atomic.Int64
+		wg      sync.WaitGroup
+		errs    = make(chan error, 8)
+	)
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for written.Load() < n {
+				last := written.Load()
+				for i := int64(0); i < last; i += 37 {
+					if v, ok, err := l.Get(key(i)); !ok || !bytes.Equal(v, key(i)) {
+						errs <- fmt.Errorf("key %s: want %s expect %s (%v)", key(i), key(i), v, err)
+						return
+					}
+				}
+
+				it, err := l.NewIterator(nil, nil)
+				if err != nil {
+					errs <- err
+					return
+				}
+				var count int64
+				for ; it.Valid(); it.Next() {
+					if !bytes.Equal(it.Key(), key(count)) {
+						errs <- fmt.Errorf("[iterator] want %s expect %s", key(count), it.Key())
+						break
+					}
+					count++
+				}
+				it.Close()
+				if count < last {
+					errs <- fmt.Errorf("[iterator] want at least %d keys expect %d", last, count)
+					return
+				}
+			}
+		}()
+	}
+
+	for i := int64(0); i < n; i++ {
+		if err := l.Put(key(i), key(i)); err != nil {
+			t.Fatal(err)
+		}
+		written.Add(1)
+
+		if i%500 == 499 {
+			if err := l.defaultFamily.compact(sst.BaseLevel); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+	l.Shutdown()
+
+	// the replaced file is removed when the last reader releases it
+	if err := l.defaultFamily.flushMemTable(); err != nil {
+		t.Fatal(err)
+	}
+	files := l.defaultFamily.fobserver.Level(sst.BaseLevel)
+	if len(files) == 0 {
+		t.Fatalf("no files at level %d", sst.BaseLevel)
+	}
+	name := files[0].Reader.Name()
+
+	it, err := l.NewIterator(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := l.defaultFamily.compact(sst.BaseLevel); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(name); err != nil {
+		t.Fatalf("file %s of the open iterator removed: %v", name, err)
+	}
+	var count int
+	for ; it.Valid(); it.Next() {
+		count++
+	}
+	if count != n {
+		t.Fatalf("want %d keys expect %d", n, count)
+	}
+	it.Close()
+	if _, err := os.Stat(name); !os.IsNotExist(err) {
+		t.Fatalf("file %s not removed: %v", name, err)
+	}
+}
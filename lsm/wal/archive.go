@@ -0,0 +1,232 @@
+package wal
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"time"
+)
+
+// The default archive directory in the directory of the segments.
+const archiveDir = "archive"
+
+// Archive moves the segments removed after the flush to the directory instead of deleting them,
+// the archive directory next to the segments is used if dir is empty. The archived segments
+// older than the ttl are removed, and the oldest ones are removed while the archive is larger
+// than sizeLimit bytes, zero disables the limit.
+func Archive(dir string, ttl time.Duration, sizeLimit int64) Option {
+	return func(w *WAL) {
+		if dir == "" {
+			dir = path.Join(w.root, archiveDir)
+		}
+		w.archive, w.archiveTTL, w.archiveSize = dir, ttl, sizeLimit
+	}
+}
+
+// ArchivePath returns the directory of the archived segments, empty if they are deleted.
+func (w *WAL) ArchivePath() string {
+	return w.archive
+}
+
+// openArchive creates the archive directory and removes the archived segments out of the limits.
+func (w *WAL) openArchive() error {
+	if w.archive == "" {
+		return nil
+	}
+	if err := os.MkdirAll(w.archive, os.FileMode(0777)); err != nil {
+		return err
+	}
+
+	segments, err := listSegments(w.archive)
+	if err != nil {
+		return err
+	}
+	if len(segments) > 0 {
+		w.archived = segments[len(segments)-1].num
+	}
+
+	return w.purgeArchive()
+}
+
+// archiveSegment moves the segment to the archive. Called under the lock of the WAL.
+func (w *WAL) archiveSegment(s segment) error {
+	name := path.Join(w.archive, path.Base(s.name))
+	if err := os.Rename(s.name, name); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		// the archive is on another file system
+		if err := copyFile(s.name, name); err != nil {
+			return fmt.Errorf("failed to archive the segment %s: %w", s.name, err)
+		}
+		if err := os.Remove(s.name); err != nil {
+			return fmt.Errorf("failed to remove the segment %s: %w", s.name, err)
+		}
+	}
+	w.archived = max(w.archived, s.num)
+
+	return nil
+}
+
+// copyFile copies the file keeping its modification time, so the ttl of the archive
+// is counted from the last write to the segment.
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	stat, err := in.Stat()
+	if err != nil {
+		return err
+	}
+
+	tmp := dst + ".tmp"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	if err := os.Chtimes(tmp, stat.ModTime(), stat.ModTime()); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, dst)
+}
+
+// purgeArchive removes the oldest archived segments while they are older than the ttl
+// or the archive is larger than the size limit.
+func (w *WAL) purgeArchive() error {
+	if w.archiveTTL <= 0 && w.archiveSize <= 0 {
+		return nil
+	}
+
+	segments, err := listSegments(w.archive)
+	if err != nil {
+		return err
+	}
+	var (
+		stats = make([]os.FileInfo, len(segments))
+		total int64
+	)
+	for idx, s := range segments {
+		if stats[idx], err = os.Stat(s.name); err != nil {
+			return err
+		}
+		total += stats[idx].Size()
+	}
+
+	for idx, s := range segments {
+		expired := w.archiveTTL > 0 && time.Since(stats[idx].ModTime()) > w.archiveTTL
+		if !expired && (w.archiveSize <= 0 || total <= w.archiveSize) {
+			break
+		}
+		if err := os.Remove(s.name); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove the archived segment %s: %w", s.name, err)
+		}
+		total -= stats[idx].Size()
+	}
+
+	return nil
+}
+
+// Checkpoint writes the index of the WAL to the directory of the copy of the tree,
+// so the copy replays only the records after the flushed sequence number.
+// Returns the flushed sequence number.
+func (w *WAL) Checkpoint(dir string) (uint64, error) {
+	w.lock.RLock()
+	defer w.lock.RUnlock()
+
+	walpath := path.Join(dir, walDir)
+	if err := os.MkdirAll(walpath, os.FileMode(0777)); err != nil {
+		return 0, err
+	}
+	f, err := os.Create(path.Join(walpath, indexNamePath))
+	if err != nil {
+		return 0, err
+	}
+	if _, err := writeSeqNum(w.flushed, f); err != nil {
+		f.Close()
+		return 0, err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return 0, err
+	}
+
+	return w.flushed, f.Close()
+}
+
+// ReplayArchive passes the archived batches with the entries starting from the sequence number
+// to apply in the order they were appended, until apply returns false. The first batch may have
+// the entries before the sequence number. ErrUpdatesNotAvailable is returned if the segment with
+// the sequence number or the segments after it are not in the archive. The torn records at the end
+// of the segments are skipped, the other damaged records fail the replay.
+func ReplayArchive(dir string, seq uint64, apply func(Batch) (bool, error)) error {
+	segments, err := listSegments(dir)
+	if err != nil {
+		return err
+	}
+
+	first := -1
+	for idx, s := range segments {
+		if s.start <= seq {
+			first = idx
+		}
+	}
+	if first < 0 {
+		if len(segments) == 0 {
+			return nil
+		}
+		return fmt.Errorf("%w: sequence %d is not archived", ErrUpdatesNotAvailable, seq)
+	}
+
+	for idx, s := range segments[first:] {
+		if idx > 0 && s.num != segments[first+idx-1].num+1 {
+			return fmt.Errorf("%w: segment %d is not archived", ErrUpdatesNotAvailable, segments[first+idx-1].num+1)
+		}
+
+		bs, err := os.ReadFile(s.name)
+		if err != nil {
+			return err
+		}
+		r := &blockReader{buf: bs[min(segmentHeaderSize, int64(len(bs))):]}
+		for {
+			off := r.offset()
+			payload, err := r.next()
+			if err == io.EOF || errors.Is(err, ErrTornRecord) {
+				break
+			}
+			var b Batch
+			if err == nil {
+				b, err = s.decode(payload)
+			}
+			if err != nil {
+				return fmt.Errorf("segment %s at %d: %w", s.name, segmentHeaderSize+int64(off), err)
+			}
+			if b.Seq+uint64(len(b.Elems)) <= seq {
+				continue
+			}
+
+			ok, err := apply(b)
+			if err != nil || !ok {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,97 @@
+package wal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/s-ilyin/lsm-distributed/lsm/sst"
+)
+
+const (
+	sizeSequence = 8
+	sizeTime     = 8
+)
+
+// Entry is the update of the column family in the batch.
+type Entry struct {
+	Family uint32
+	Key    []byte
+	Val    []byte
+}
+
+var (
+	// ErrTornRecord is returned when the record is cut off at the end of the WAL.
+	ErrTornRecord = errors.New("torn record")
+	// ErrChecksum is returned when the record does not match its checksum.
+	ErrChecksum = errors.New("checksum mismatch")
+	// ErrCorruptedRecord is returned when the record can not be decoded.
+	ErrCorruptedRecord = errors.New("corrupted record")
+)
+
+// encodeBatch encodes the batch as the payload of one WAL record.
+func encodeBatch(b Batch) ([]byte, error) {
+	// payload: [sequence of the first entry][time of the write][number of entries]([column family][encoded entry])+
+	buf := bytes.NewBuffer(make([]byte, 0, sizeBatch(b.Elems)))
+	var encoded [sizeSequence + sizeTime]byte
+	binary.LittleEndian.PutUint64(encoded[:sizeSequence], b.Seq)
+	binary.LittleEndian.PutUint64(encoded[sizeSequence:], uint64(b.Time))
+	buf.Write(encoded[:])
+
+	var varint [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(varint[:], uint64(len(b.Elems)))
+	buf.Write(varint[:n])
+
+	for idx := range b.Elems {
+		n = binary.PutUvarint(varint[:], uint64(b.Elems[idx].Family))
+		buf.Write(varint[:n])
+		if _, err := sst.Encode(buf, b.Elems[idx].Key, b.Elems[idx].Val); err != nil {
+			return nil, err
+		}
+	}
+
+	return buf.Bytes(), nil
+}
+
+// decodeBatch decodes the payload of the WAL record.
+func decodeBatch(payload []byte) (Batch, error) {
+	header := sizeSequence + sizeTime
+	if len(payload) < header {
+		return Batch{}, fmt.Errorf("%w: the record is too short: %d", ErrCorruptedRecord, len(payload))
+	}
+	b := Batch{
+		Seq:  binary.LittleEndian.Uint64(payload[:sizeSequence]),
+		Time: int64(binary.LittleEndian.Uint64(payload[sizeSequence:header])),
+	}
+
+	r := bytes.NewReader(payload[header:])
+	count, err := binary.ReadUvarint(r)
+	if err != nil {
+		return Batch{}, fmt.Errorf("%w: failed to read the number of entries: %v", ErrCorruptedRecord, err)
+	}
+
+	b.Elems = make([]Entry, 0, min(count, uint64(len(payload))))
+	for idx := uint64(0); idx < count; idx++ {
+		family, err := binary.ReadUvarint(r)
+		if err != nil {
+			return Batch{}, fmt.Errorf("%w: failed to read the column family: %v", ErrCorruptedRecord, err)
+		}
+		key, val, err := sst.Decode(r)
+		if err != nil {
+			return Batch{}, fmt.Errorf("%w: failed to read the entry: %v", ErrCorruptedRecord, err)
+		}
+		b.Elems = append(b.Elems, Entry{Family: uint32(family), Key: key, Val: val})
+	}
+
+	return b, nil
+}
+
+func sizeBatch(elems []Entry) int {
+	size := sizeSequence + sizeTime + binary.MaxVarintLen64
+	for idx := range elems {
+		size += 3*binary.MaxVarintLen64 + len(elems[idx].Key) + len(elems[idx].Val)
+	}
+
+	return size
+}
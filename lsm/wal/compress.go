@@ -0,0 +1,135 @@
+package wal
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// FlateID is the id of the compressor returned by NewFlate.
+const FlateID uint32 = 1
+
+var (
+	// ErrCompressorID is returned when registering the compressor with the reserved or the taken id.
+	ErrCompressorID = errors.New("invalid compressor id")
+	// ErrUnknownCompressor is returned when the segment is written by the compressor not registered.
+	ErrUnknownCompressor = errors.New("unknown compressor")
+)
+
+// Compressor compresses the records of the WAL segments. The id of the compressor
+// is recorded in the header of the segment, so the segments written with the other
+// compressors or without compression are read by the compressors registered
+// with RegisterCompressor. The compressor of compress/flate is registered by default.
+type Compressor interface {
+	// ID identifies the compressor in the segment header, zero is the segment without compression.
+	ID() uint32
+	Compress(src []byte) ([]byte, error)
+	Decompress(src []byte) ([]byte, error)
+}
+
+// Compression compresses the records of the new segments with the compressor,
+// the compressor must be registered to read the segments.
+func Compression(c Compressor) Option {
+	return func(w *WAL) {
+		w.compressor = c
+	}
+}
+
+var compressors = struct {
+	sync.RWMutex
+	m map[uint32]Compressor
+}{m: map[uint32]Compressor{FlateID: &flateCompressor{level: flate.DefaultCompression}}}
+
+// RegisterCompressor registers the compressor reading the segments with its id.
+func RegisterCompressor(c Compressor) error {
+	if c.ID() == 0 {
+		return fmt.Errorf("%w: %d is reserved", ErrCompressorID, c.ID())
+	}
+
+	compressors.Lock()
+	defer compressors.Unlock()
+
+	if _, ok := compressors.m[c.ID()]; ok {
+		return fmt.Errorf("%w: %d is registered", ErrCompressorID, c.ID())
+	}
+	compressors.m[c.ID()] = c
+
+	return nil
+}
+
+// lookupCompressor returns the compressor with the id, nil for the segments without compression.
+func lookupCompressor(id uint32) (Compressor, error) {
+	if id == 0 {
+		return nil, nil
+	}
+
+	compressors.RLock()
+	defer compressors.RUnlock()
+
+	c, ok := compressors.m[id]
+	if !ok {
+		return nil, fmt.Errorf("%w: %d", ErrUnknownCompressor, id)
+	}
+
+	return c, nil
+}
+
+// flateCompressor compresses the records with compress/flate,
+// the writers and the readers are reused since they are costly to allocate.
+type flateCompressor struct {
+	level   int
+	writers sync.Pool
+	readers sync.Pool
+}
+
+// NewFlate returns the compressor of compress/flate with the compression level,
+// the segments written with any level are read by the registered one.
+func NewFlate(level int) (Compressor, error) {
+	if level < flate.HuffmanOnly || level > flate.BestCompression {
+		return nil, fmt.Errorf("invalid flate compression level %d", level)
+	}
+
+	return &flateCompressor{level: level}, nil
+}
+
+func (c *flateCompressor) ID() uint32 {
+	return FlateID
+}
+
+func (c *flateCompressor) Compress(src []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	zw, _ := c.writers.Get().(*flate.Writer)
+	if zw == nil {
+		var err error
+		if zw, err = flate.NewWriter(&buf, c.level); err != nil {
+			return nil, err
+		}
+	} else {
+		zw.Reset(&buf)
+	}
+	defer c.writers.Put(zw)
+
+	if _, err := zw.Write(src); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func (c *flateCompressor) Decompress(src []byte) ([]byte, error) {
+	zr, _ := c.readers.Get().(io.ReadCloser)
+	if zr == nil {
+		zr = flate.NewReader(bytes.NewReader(src))
+	} else if err := zr.(flate.Resetter).Reset(bytes.NewReader(src), nil); err != nil {
+		return nil, err
+	}
+	defer c.readers.Put(zr)
+
+	return io.ReadAll(zr)
+}
@@ -0,0 +1,160 @@
+package wal
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+)
+
+// The acknowledged sequence numbers of the consumers: [sequence number] [name] per line.
+const consumersFile = "wal.consumers.db"
+
+var (
+	// ErrConsumerName is returned when registering the consumer with an empty name or a name with spaces.
+	ErrConsumerName = errors.New("invalid consumer name")
+	// ErrUnknownConsumer is returned when acknowledging the updates for the consumer not registered.
+	ErrUnknownConsumer = errors.New("unknown consumer")
+)
+
+// Register registers the consumer of the updates and returns the last sequence number
+// it acknowledged. The new consumer acknowledges the updates before it is registered.
+// The segments are not removed until all registered consumers acknowledge their updates.
+func (w *WAL) Register(name string) (uint64, error) {
+	if name == "" || strings.ContainsAny(name, " \t\r\n") {
+		return 0, ErrConsumerName
+	}
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if seq, ok := w.consumers[name]; ok {
+		return seq, nil
+	}
+	seq := w.Sequence()
+	w.consumers[name] = seq
+	if err := w.saveConsumers(); err != nil {
+		delete(w.consumers, name)
+		return 0, err
+	}
+
+	return seq, nil
+}
+
+// Unregister removes the consumer, its updates are not kept any more.
+func (w *WAL) Unregister(name string) error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	seq, ok := w.consumers[name]
+	if !ok {
+		return ErrUnknownConsumer
+	}
+	delete(w.consumers, name)
+	if err := w.saveConsumers(); err != nil {
+		w.consumers[name] = seq
+		return err
+	}
+
+	return w.removeFlushed()
+}
+
+// Acked returns the last sequence number acknowledged by the consumer.
+func (w *WAL) Acked(name string) (uint64, bool) {
+	w.lock.RLock()
+	defer w.lock.RUnlock()
+
+	seq, ok := w.consumers[name]
+
+	return seq, ok
+}
+
+// Ack acknowledges the updates up to the sequence number for the consumer,
+// the segments acknowledged by all consumers and flushed are removed.
+func (w *WAL) Ack(name string, seq uint64) error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	acked, ok := w.consumers[name]
+	if !ok {
+		return ErrUnknownConsumer
+	}
+	if seq <= acked {
+		return nil
+	}
+	w.consumers[name] = seq
+	if err := w.saveConsumers(); err != nil {
+		w.consumers[name] = acked
+		return err
+	}
+
+	return w.removeFlushed()
+}
+
+// retained returns the last sequence number the segments can be removed up to:
+// it is flushed and acknowledged by all consumers. Called under the lock of the WAL.
+func (w *WAL) retained() uint64 {
+	seq := w.flushed
+	for _, acked := range w.consumers {
+		seq = min(seq, acked)
+	}
+
+	return seq
+}
+
+func (w *WAL) saveConsumers() error {
+	filename := path.Join(w.root, consumersFile)
+	tmp := filename + ".tmp"
+
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+
+	bw := bufio.NewWriter(f)
+	for name, seq := range w.consumers {
+		fmt.Fprintf(bw, "%d %s\n", seq, name)
+	}
+	if err := bw.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, filename)
+}
+
+func loadConsumers(dir string) (map[string]uint64, error) {
+	consumers := make(map[string]uint64)
+
+	f, err := os.Open(path.Join(dir, consumersFile))
+	if os.IsNotExist(err) {
+		return consumers, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var (
+			seq  uint64
+			name string
+		)
+		if _, err := fmt.Sscanf(scanner.Text(), "%d %s", &seq, &name); err != nil {
+			return nil, fmt.Errorf("failed to parse the consumer %q: %w", scanner.Text(), err)
+		}
+		consumers[name] = seq
+	}
+
+	return consumers, scanner.Err()
+}
@@ -0,0 +1,177 @@
+package wal
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+// The segments are the block log: the records are split into
+// the fragments not crossing the blocks, every fragment has its own checksum,
+// so the damaged fragment is skipped up to the next block.
+const (
+	blockSize = 32 << 10
+	// [crc32c of the type and the data uint32][length of the data uint16][type uint8]
+	fragmentHeaderSize = 7
+)
+
+// Types of the fragments.
+const (
+	// the rest of the block is padded with zeros
+	fragmentZero byte = iota
+	fragmentFull
+	fragmentFirst
+	fragmentMiddle
+	fragmentLast
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// appendFragments appends the record split into the fragments to buf.
+// The offset is the position in the current block, it is moved past the record.
+func appendFragments(buf []byte, offset *int, rec []byte) []byte {
+	first := true
+	for {
+		if left := blockSize - *offset; left < fragmentHeaderSize {
+			// the header does not fit, the trailer of the block is padded
+			buf = append(buf, make([]byte, left)...)
+			*offset = 0
+		}
+
+		n := min(len(rec), blockSize-*offset-fragmentHeaderSize)
+		last := n == len(rec)
+		typ := fragmentMiddle
+		switch {
+		case first && last:
+			typ = fragmentFull
+		case first:
+			typ = fragmentFirst
+		case last:
+			typ = fragmentLast
+		}
+
+		var header [fragmentHeaderSize]byte
+		sum := crc32.Update(crc32.Checksum([]byte{typ}, castagnoli), castagnoli, rec[:n])
+		binary.LittleEndian.PutUint32(header[0:4], sum)
+		binary.LittleEndian.PutUint16(header[4:6], uint16(n))
+		header[6] = typ
+		buf = append(buf, header[:]...)
+		buf = append(buf, rec[:n]...)
+
+		*offset += fragmentHeaderSize + n
+		rec = rec[n:]
+		first = false
+		if last {
+			return buf
+		}
+	}
+}
+
+// recordReader reads the payloads of the records of the segment.
+type recordReader interface {
+	// next returns the payload of the next record or io.EOF at the end of the segment.
+	// ErrTornRecord is returned if the segment ends inside the record,
+	// ErrChecksum or ErrCorruptedRecord if the record is damaged.
+	next() ([]byte, error)
+	// skip moves past the damaged record, false if the rest of the segment can not be read.
+	skip() bool
+	// offset returns the position of the next record.
+	offset() int
+	// seek moves to the record at the position.
+	seek(off int)
+}
+
+// blockReader reads the records of the block log.
+type blockReader struct {
+	buf []byte
+	off int
+}
+
+func (r *blockReader) offset() int {
+	return r.off
+}
+
+func (r *blockReader) seek(off int) {
+	r.off = off
+}
+
+func (r *blockReader) next() ([]byte, error) {
+	var (
+		rec      []byte
+		fragment bool
+	)
+	for {
+		if r.off >= len(r.buf) {
+			if fragment {
+				return nil, ErrTornRecord
+			}
+			return nil, io.EOF
+		}
+		left := blockSize - r.off%blockSize
+		if left < fragmentHeaderSize {
+			r.off += left
+			continue
+		}
+		if len(r.buf)-r.off < fragmentHeaderSize {
+			return nil, ErrTornRecord
+		}
+
+		header := r.buf[r.off : r.off+fragmentHeaderSize]
+		sum, n, typ := binary.LittleEndian.Uint32(header[0:4]), int(binary.LittleEndian.Uint16(header[4:6])), header[6]
+		if typ == fragmentZero && n == 0 {
+			// the padding up to the next block
+			r.off += left
+			continue
+		}
+		if fragmentHeaderSize+n > left {
+			return nil, fmt.Errorf("%w: the fragment crosses the block at %d", ErrCorruptedRecord, r.off)
+		}
+		if len(r.buf)-r.off < fragmentHeaderSize+n {
+			return nil, ErrTornRecord
+		}
+		data := r.buf[r.off+fragmentHeaderSize : r.off+fragmentHeaderSize+n]
+		if crc32.Update(crc32.Checksum([]byte{typ}, castagnoli), castagnoli, data) != sum {
+			return nil, fmt.Errorf("%w at %d", ErrChecksum, r.off)
+		}
+
+		switch {
+		case typ == fragmentFull && !fragment:
+			r.off += fragmentHeaderSize + n
+			return data, nil
+		case typ == fragmentFirst && !fragment:
+			rec, fragment = append(rec, data...), true
+		case typ == fragmentMiddle && fragment:
+			rec = append(rec, data...)
+		case typ == fragmentLast && fragment:
+			r.off += fragmentHeaderSize + n
+			return append(rec, data...), nil
+		default:
+			return nil, fmt.Errorf("%w: unexpected fragment %d at %d", ErrCorruptedRecord, typ, r.off)
+		}
+		r.off += fragmentHeaderSize + n
+	}
+}
+
+// skip moves to the next block and past the fragments of the record started before it.
+func (r *blockReader) skip() bool {
+	r.off += blockSize - r.off%blockSize
+	for r.off+fragmentHeaderSize <= len(r.buf) {
+		left := blockSize - r.off%blockSize
+		if left < fragmentHeaderSize {
+			r.off += left
+			continue
+		}
+		n, typ := int(binary.LittleEndian.Uint16(r.buf[r.off+4:r.off+6])), r.buf[r.off+6]
+		if typ == fragmentZero && n == 0 {
+			r.off += left
+			continue
+		}
+		if (typ != fragmentMiddle && typ != fragmentLast) || fragmentHeaderSize+n > left {
+			break
+		}
+		r.off += fragmentHeaderSize + n
+	}
+
+	return r.off < len(r.buf)
+}
@@ -0,0 +1,181 @@
+package wal
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// ErrUpdatesNotAvailable is returned when the segments with the updates are removed.
+var ErrUpdatesNotAvailable = errors.New("updates are not available in the WAL")
+
+// Tailer reads the batches appended to the WAL from the oldest to the newest,
+// including the ones appended after it is created.
+type Tailer struct {
+	w *WAL
+	// the first sequence number not read yet
+	seq uint64
+
+	// the segment being read and its data read so far
+	seg  segment
+	f    *os.File
+	data []byte
+	r    recordReader
+}
+
+// Tail returns the tailer reading the batches starting from the batch with the sequence number.
+// ErrUpdatesNotAvailable is returned if the segment with the sequence number is removed.
+func (w *WAL) Tail(seq uint64) (*Tailer, error) {
+	w.lock.RLock()
+	defer w.lock.RUnlock()
+
+	seq = max(seq, 1)
+	if seq <= w.truncated {
+		return nil, fmt.Errorf("%w: sequence %d", ErrUpdatesNotAvailable, seq)
+	}
+
+	return &Tailer{w: w, seq: seq}, nil
+}
+
+// Next returns the next batch. io.EOF is returned if there are no more batches
+// yet, the call after the next append returns the appended batch.
+func (t *Tailer) Next() (Batch, error) {
+	for {
+		if t.r == nil {
+			ok, err := t.open()
+			if err != nil {
+				return Batch{}, err
+			}
+			if !ok {
+				return Batch{}, io.EOF
+			}
+		}
+
+		off := t.r.offset()
+		payload, err := t.r.next()
+		if err == nil {
+			b, err := t.seg.decode(payload)
+			if err != nil {
+				return Batch{}, fmt.Errorf("segment %s at %d: %w", t.seg.name, segmentHeaderSize+int64(off), err)
+			}
+			if b.Seq+uint64(len(b.Elems)) <= t.seq {
+				continue
+			}
+			t.seq = b.Seq + uint64(len(b.Elems))
+			return b, nil
+		}
+		if err != io.EOF && !errors.Is(err, ErrTornRecord) {
+			return Batch{}, fmt.Errorf("segment %s at %d: %w", t.seg.name, segmentHeaderSize+int64(off), err)
+		}
+
+		// the record is read again with the appended data
+		t.r.seek(off)
+		grown, complete, err := t.read()
+		if err != nil {
+			return Batch{}, err
+		}
+		if grown {
+			continue
+		}
+		if !complete {
+			return Batch{}, io.EOF
+		}
+		// the newer segment is written, the torn tail of this one is left by the crash
+		if err := t.close(); err != nil {
+			return Batch{}, err
+		}
+	}
+}
+
+// open opens the segment following the one read last or the segment with the sequence number.
+// Reports whether there is such segment.
+func (t *Tailer) open() (bool, error) {
+	t.w.lock.RLock()
+	var (
+		seg   segment
+		found bool
+	)
+	for _, s := range t.w.segments {
+		if t.seg.name != "" && s.num <= t.seg.num {
+			continue
+		}
+		if found && s.start > t.seq {
+			break
+		}
+		seg, found = s, true
+	}
+	truncated := t.w.truncated
+	t.w.lock.RUnlock()
+
+	if !found {
+		return false, nil
+	}
+	if seg.start > t.seq && t.seq <= truncated {
+		return false, fmt.Errorf("%w: sequence %d", ErrUpdatesNotAvailable, t.seq)
+	}
+
+	f, err := os.Open(seg.name)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, fmt.Errorf("%w: segment %s is removed", ErrUpdatesNotAvailable, seg.name)
+		}
+		return false, err
+	}
+	t.seg, t.f, t.data = seg, f, nil
+	t.r = &blockReader{}
+	if _, _, err := t.read(); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// read reads the data appended to the segment. Reports whether the data is appended
+// and whether the segment is complete, since the newer segment is written.
+func (t *Tailer) read() (bool, bool, error) {
+	// the appends are written under the lock, so the records are not read partially
+	t.w.lock.RLock()
+	defer t.w.lock.RUnlock()
+
+	n := len(t.data)
+	buf := make([]byte, 64<<10)
+	for {
+		m, err := t.f.ReadAt(buf, segmentHeaderSize+int64(len(t.data)))
+		t.data = append(t.data, buf[:m]...)
+		if err == io.EOF || (err == nil && m == 0) {
+			break
+		}
+		if err != nil {
+			return false, false, err
+		}
+	}
+	if len(t.data) > n {
+		off := t.r.offset()
+		t.r = &blockReader{buf: t.data}
+		t.r.seek(off)
+	}
+
+	complete := false
+	for _, s := range t.w.segments {
+		complete = complete || s.num > t.seg.num
+	}
+
+	return len(t.data) > n, complete, nil
+}
+
+func (t *Tailer) close() error {
+	t.r, t.data = nil, nil
+	if t.f == nil {
+		return nil
+	}
+	err := t.f.Close()
+	t.f = nil
+
+	return err
+}
+
+// Close closes the segment being read.
+func (t *Tailer) Close() error {
+	return t.close()
+}
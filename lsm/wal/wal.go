@@ -3,30 +3,126 @@ package wal
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"path"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
-	"github.com/s-ilyin/lsm-distributed/lsm/memtable"
+	"github.com/s-ilyin/lsm-distributed/lsm/encoder"
 	"github.com/s-ilyin/lsm-distributed/lsm/sst"
 )
 
 const (
 	// WAL имя файла.
 	walDir        = "wal"
-	walFileName   = "wal.db"
 	indexNamePath = "wal.index.db"
+	// The single WAL file of the trees written before the segments,
+	// its records are moved to the segment by MigratePlainKeys.
+	legacyFileName = "wal.db"
+	// The segments are named by their numbers: 000001.log, 000002.log, ...
+	segmentExt = ".log"
+
+	segmentMagic = 0x57414c53 // "WALS"
+	// The records are kept in the blocks of the block log (see log.go).
+	segmentVersion = 1
+	// [magic uint32][version uint32][sequence number of the first record uint64][compressor id uint32]
+	segmentHeaderSize = 20
 )
 
+// ErrSegmentHeader is returned when the header of the segment is not valid.
+var ErrSegmentHeader = errors.New("invalid segment header")
+
+// RecoveryMode defines how Replay treats the damaged records.
+type RecoveryMode int
+
+const (
+	// PointInTime replays the records up to the first damaged one and drops the rest of the WAL,
+	// so the replayed state is the state of the tree at some moment before the crash.
+	PointInTime RecoveryMode = iota
+	// TolerateCorruptedTail drops the damaged records at the end of the segments
+	// left by the crash in the middle of the write, the other damaged records fail the replay.
+	TolerateCorruptedTail
+	// AbsoluteConsistency fails the replay on any damaged record.
+	AbsoluteConsistency
+	// SkipAnyCorrupted skips the damaged records and replays all the others.
+	SkipAnyCorrupted
+)
+
+func (m RecoveryMode) String() string {
+	switch m {
+	case TolerateCorruptedTail:
+		return "tolerate corrupted tail"
+	case AbsoluteConsistency:
+		return "absolute consistency"
+	case SkipAnyCorrupted:
+		return "skip any corrupted"
+	default:
+		return "point in time"
+	}
+}
+
+// RecoveryStats are the records dropped by Replay.
+type RecoveryStats struct {
+	DroppedBytes   int64
+	DroppedRecords int
+}
+
+// WAL is the write-ahead log split into the numbered segments, one per MemTable.
+// The writes go to the last segment, the new segment is started by Rotate when
+// the MemTable is switched. The segment is removed when all its records are flushed.
 type WAL struct {
-	f      *os.File
-	fIdx   *os.File
-	lock   sync.RWMutex
-	fsync  bool
-	seqNum uint64
-	root   string
+	f     *os.File
+	fIdx  *os.File
+	lock  sync.RWMutex
+	fsync bool
+	root  string
+
+	// segments from the oldest to the newest, the writes go to the last one
+	segments []segment
+	// the sequence number starting the next segment, zero if not rotated
+	rotate uint64
+	// the position in the current block of the segment the writes go to
+	block    int
+	recovery RecoveryMode
+
+	// the last sequence numbers acknowledged by the consumers of the updates
+	consumers map[string]uint64
+	// the last sequence number of the removed segments
+	truncated uint64
+	// closed and replaced by every append to wake up the tailers
+	appended chan struct{}
+
+	// the directory the removed segments are moved to, empty if they are deleted,
+	// and the limits of the archived segments
+	archive     string
+	archiveTTL  time.Duration
+	archiveSize int64
+	// the largest number of the archived segments, the new segments get the larger numbers
+	archived uint64
+
+	// compresses the records of the new segments, nil if they are not compressed
+	compressor Compressor
+
+	// seqNum is the last sequence number given to an entry.
+	seqNum atomic.Uint64
+	// flushed is the last sequence number persisted in the SST files.
+	flushed uint64
+}
+
+// segment is the WAL file with the records starting from the sequence number.
+type segment struct {
+	num   uint64
+	start uint64
+	// the id of the compressor of the records, zero if they are not compressed
+	codec uint32
+	name  string
 }
 
 type Option func(*WAL)
@@ -37,6 +133,13 @@ func FileSync(fsync bool) Option {
 	}
 }
 
+// Recovery sets how Replay treats the damaged records, PointInTime by default.
+func Recovery(mode RecoveryMode) Option {
+	return func(w *WAL) {
+		w.recovery = mode
+	}
+}
+
 func NewWAL(dir string, options ...Option) (*WAL, error) {
 	walpath := path.Join(dir, walDir)
 	if _, err := os.Stat(walpath); os.IsNotExist(err) {
@@ -49,42 +152,232 @@ func NewWAL(dir string, options ...Option) (*WAL, error) {
 	if err != nil {
 		return nil, err
 	}
-	f, err := os.OpenFile(path.Join(walpath, walFileName), os.O_CREATE|os.O_RDWR, 0777)
-	if err != nil {
-		return nil, err
-	}
 
 	w := &WAL{
-		f:    f,
-		fIdx: fIdx,
+		fIdx:     fIdx,
+		root:     walpath,
+		appended: make(chan struct{}),
 	}
 	seq, err := readSeqNum(w.fIdx)
 	if err != nil {
 		return nil, err
 	}
+	if w.segments, err = listSegments(walpath); err != nil {
+		return nil, err
+	}
+	if w.consumers, err = loadConsumers(walpath); err != nil {
+		return nil, err
+	}
 
 	for _, opt := range options {
 		opt(w)
 	}
+	if w.compressor != nil {
+		if _, err := lookupCompressor(w.compressor.ID()); err != nil {
+			return nil, err
+		}
+	}
+	if err := w.openArchive(); err != nil {
+		return nil, err
+	}
+	w.flushed = seq
 	w.SetSequence(seq)
-
-	w.root = walpath
+	// the segments before the first one are removed only after the flush
+	w.truncated = seq
+	if len(w.segments) > 0 {
+		w.truncated = max(w.segments[0].start, 1) - 1
+	}
 
 	return w, nil
 }
 
+// listSegments returns the segments of the directory from the oldest to the newest.
+func listSegments(dir string) ([]segment, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var segments []segment
+	for _, e := range entries {
+		name := e.Name()
+		if !strings.HasSuffix(name, segmentExt) {
+			continue
+		}
+		num, err := strconv.ParseUint(strings.TrimSuffix(name, segmentExt), 10, 64)
+		if err != nil {
+			continue
+		}
+
+		s, err := readSegmentHeader(path.Join(dir, name))
+		if errors.Is(err, ErrSegmentHeader) {
+			// the segment is cut off before the first record
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		// the segment of the unknown compressor is not treated as damaged
+		if _, err := lookupCompressor(s.codec); err != nil {
+			return nil, fmt.Errorf("segment %s: %w", name, err)
+		}
+		s.num, s.name = num, path.Join(dir, name)
+		segments = append(segments, s)
+	}
+	sort.Slice(segments, func(i, j int) bool {
+		return segments[i].num < segments[j].num
+	})
+
+	return segments, nil
+}
+
+func readSegmentHeader(name string) (segment, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return segment{}, err
+	}
+	defer f.Close()
+
+	var header [segmentHeaderSize]byte
+	n, err := io.ReadFull(f, header[:])
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return segment{}, err
+	}
+
+	s, err := decodeSegmentHeader(header[:n])
+	if err != nil {
+		return segment{}, fmt.Errorf("%s: %w", name, err)
+	}
+
+	return s, nil
+}
+
+// decodeSegmentHeader returns the sequence number of the first record and the compressor of the segment.
+func decodeSegmentHeader(header []byte) (segment, error) {
+	if len(header) < segmentHeaderSize {
+		return segment{}, fmt.Errorf("%w: the header is too short", ErrSegmentHeader)
+	}
+	if binary.LittleEndian.Uint32(header[0:4]) != segmentMagic {
+		return segment{}, fmt.Errorf("%w: bad magic", ErrSegmentHeader)
+	}
+	if v := binary.LittleEndian.Uint32(header[4:8]); v != segmentVersion {
+		return segment{}, fmt.Errorf("%w: unsupported version %d", ErrSegmentHeader, v)
+	}
+
+	return segment{start: binary.LittleEndian.Uint64(header[8:16]), codec: binary.LittleEndian.Uint32(header[16:20])}, nil
+}
+
+// Path returns the directory of the segments.
 func (w *WAL) Path() string {
-	return path.Join(w.root, walFileName)
+	return w.root
 }
 
+// Name returns the name of the segment the writes go to.
 func (w *WAL) Name() string {
+	w.lock.RLock()
+	defer w.lock.RUnlock()
+
+	if w.f == nil {
+		return ""
+	}
+
 	return w.f.Name()
 }
 
-func (w *WAL) Close() error {
-	if err := w.f.Close(); err != nil {
+// Empty reports whether the segments have no records.
+func (w *WAL) Empty() (bool, error) {
+	w.lock.RLock()
+	defer w.lock.RUnlock()
+
+	for _, s := range w.segments {
+		stat, err := os.Stat(s.name)
+		if err != nil {
+			return false, err
+		}
+		if stat.Size() > segmentHeaderSize {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+// MigratePlainKeys rewrites the legacy WAL file of the first format: the user keys with the values
+// one after another without the checksums and the sequence numbers. The records are appended
+// to the new segment as one batch with the sequence numbers starting from seq in the order
+// of the file, the legacy file is removed after the segment is synced.
+func (w *WAL) MigratePlainKeys(seq uint64) error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	legacy := path.Join(w.root, legacyFileName)
+	bs, err := os.ReadFile(legacy)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
 		return err
 	}
+	if len(bs) == 0 {
+		return os.Remove(legacy)
+	}
+
+	var (
+		elems []Entry
+		r     = bytes.NewReader(bs)
+	)
+	for r.Len() > 0 {
+		key, val, err := sst.Decode(r)
+		if err != nil {
+			return fmt.Errorf("failed to read the legacy WAL file %s: %w", legacy, err)
+		}
+		elems = append(elems, Entry{Key: key, Val: val})
+	}
+	rec, err := encodeBatch(Batch{Seq: seq, Elems: elems, Time: time.Now().UnixNano()})
+	if err != nil {
+		return fmt.Errorf("failed to encode the batch: %w", err)
+	}
+	if w.compressor != nil {
+		if rec, err = w.compressor.Compress(rec); err != nil {
+			return fmt.Errorf("failed to compress the batch: %w", err)
+		}
+	}
+
+	if err := w.newSegment(seq); err != nil {
+		return err
+	}
+	if _, err := w.f.Write(appendFragments(nil, &w.block, rec)); err != nil {
+		return fmt.Errorf("failed to write to the file: %w", err)
+	}
+	if err := w.f.Sync(); err != nil {
+		return fmt.Errorf("failed to sync the file: %w", err)
+	}
+	w.truncated = max(w.truncated, seq-1)
+
+	return os.Remove(legacy)
+}
+
+// decode decodes the payload of the record of the segment.
+func (s segment) decode(payload []byte) (Batch, error) {
+	c, err := lookupCompressor(s.codec)
+	if err != nil {
+		return Batch{}, err
+	}
+	if c != nil {
+		if payload, err = c.Decompress(payload); err != nil {
+			return Batch{}, fmt.Errorf("%w: failed to decompress: %v", ErrCorruptedRecord, err)
+		}
+	}
+
+	return decodeBatch(payload)
+}
+
+func (w *WAL) Close() error {
+	if w.f != nil {
+		if err := w.f.Close(); err != nil {
+			return err
+		}
+	}
 
 	if err := w.fIdx.Close(); err != nil {
 		return err
@@ -93,43 +386,128 @@ func (w *WAL) Close() error {
 	return nil
 }
 
-// clearWAL closes the current file and open the new file in the truncate mode.
-func (w *WAL) Clear() error {
+// Rotate starts the new segment with the sequence number of its first record:
+// the segment is created by the first append of the sequence number not less than start,
+// so the records appended in the meantime stay in the current segment.
+func (w *WAL) Rotate(start uint64) {
 	w.lock.Lock()
 	defer w.lock.Unlock()
-	walPath := path.Join(w.root, walFileName)
 
-	if err := w.f.Close(); err != nil {
-		return fmt.Errorf("failed to close the WAL file %s: %w", walPath, err)
+	w.rotate = max(w.rotate, start)
+}
+
+// newSegment creates the next segment starting from the sequence number.
+// Called under the lock of the WAL.
+func (w *WAL) newSegment(start uint64) error {
+	num := w.archived + 1
+	if len(w.segments) > 0 {
+		num = max(num, w.segments[len(w.segments)-1].num+1)
 	}
+	name := path.Join(w.root, fmt.Sprintf("%06d%s", num, segmentExt))
 
-	wal, err := os.OpenFile(walPath, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0777)
+	f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND, 0777)
 	if err != nil {
-		return fmt.Errorf("failed to open the file %s: %w", walPath, err)
+		return fmt.Errorf("failed to create the segment %s: %w", name, err)
+	}
+	var codec uint32
+	if w.compressor != nil {
+		codec = w.compressor.ID()
+	}
+	var header [segmentHeaderSize]byte
+	binary.LittleEndian.PutUint32(header[0:4], segmentMagic)
+	binary.LittleEndian.PutUint32(header[4:8], segmentVersion)
+	binary.LittleEndian.PutUint64(header[8:16], start)
+	binary.LittleEndian.PutUint32(header[16:20], codec)
+	if _, err := f.Write(header[:]); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write the header of the segment %s: %w", name, err)
 	}
-	w.f = wal
 
-	return nil
+	if w.f != nil {
+		// the records of the previous segment are synced before the writes go on
+		if err := w.f.Sync(); err != nil {
+			f.Close()
+			return fmt.Errorf("failed to sync the file: %w", err)
+		}
+		if err := w.f.Close(); err != nil {
+			f.Close()
+			return fmt.Errorf("failed to close the file: %w", err)
+		}
+	}
+	w.f = f
+	w.block = 0
+	w.segments = append(w.segments, segment{num: num, start: start, codec: codec, name: name})
+
+	return w.removeFlushed()
 }
 
-func (w *WAL) UpSequence() error {
-	w.seqNum += 1
-	_, err := writeSeqNum(w.seqNum, w.fIdx)
-	if err != nil {
+// MarkFlushed persists the last sequence number written to the SST files
+// and removes the segments with all records flushed.
+func (w *WAL) MarkFlushed(seq uint64) error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if seq <= w.flushed {
+		return nil
+	}
+
+	if _, err := writeSeqNum(seq, w.fIdx); err != nil {
+		return err
+	}
+	// the segments are removed only after the sequence number is durable
+	if err := w.fIdx.Sync(); err != nil {
 		return err
 	}
+	w.flushed = seq
+
+	return w.removeFlushed()
+}
 
-	//log.Println("[debug] write seqnum", w.seqNum)
+// removeFlushed removes the segments followed by the segment starting not after
+// the flushed sequence number acknowledged by the consumers, the segments are moved
+// to the archive if it is set. Called under the lock of the WAL.
+func (w *WAL) removeFlushed() error {
+	n, retained := 0, w.retained()
+	for n+1 < len(w.segments) && w.segments[n+1].start <= retained+1 {
+		if w.archive != "" {
+			if err := w.archiveSegment(w.segments[n]); err != nil {
+				return err
+			}
+		} else if err := os.Remove(w.segments[n].name); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove the segment %s: %w", w.segments[n].name, err)
+		}
+		w.truncated = max(w.truncated, w.segments[n+1].start-1)
+		n++
+	}
+	w.segments = w.segments[n:]
+	if n > 0 && w.archive != "" {
+		return w.purgeArchive()
+	}
 
 	return nil
 }
 
+// Flushed returns the last sequence number persisted in the SST files.
+func (w *WAL) Flushed() uint64 {
+	w.lock.RLock()
+	defer w.lock.RUnlock()
+
+	return w.flushed
+}
+
+// SetSequence sets the last used sequence number, if it is greater than the current one.
 func (w *WAL) SetSequence(n uint64) {
-	w.seqNum = n
+	for {
+		cur := w.seqNum.Load()
+		if n <= cur || w.seqNum.CompareAndSwap(cur, n) {
+			return
+		}
+	}
 }
 
+// Sequence returns the last used sequence number.
 func (w *WAL) Sequence() uint64 {
-	return w.seqNum
+	return w.seqNum.Load()
 }
 
 func writeSeqNum(seq uint64, fidx io.WriterAt) (int, error) {
@@ -153,50 +531,232 @@ func readSeqNum(fidx io.ReaderAt) (uint64, error) {
 	return binary.LittleEndian.Uint64(decoded[:]), nil
 }
 
-// Write appends entry to the WAL file.
-func (w *WAL) Append(key []byte, value []byte) error {
+// Append appends a single entry of the default column family with the sequence number to the WAL file.
+func (w *WAL) Append(seq uint64, key []byte, value []byte) error {
+	return w.AppendBatch(seq, []Entry{{Key: key, Val: value}})
+}
+
+// AppendBatch appends the entries to the WAL file as one record,
+// so they are either all replayed by Replay or not replayed at all.
+// The entries get sequence numbers seq, seq+1, ... in the order of the batch.
+func (w *WAL) AppendBatch(seq uint64, elems []Entry) error {
+	return w.AppendGroup([]Batch{{Seq: seq, Elems: elems}}, false)
+}
+
+// Batch is the entries appended as one record with the sequence number of the first entry.
+type Batch struct {
+	Seq   uint64
+	Elems []Entry
+	// Time of the append in Unix nanoseconds, set by AppendGroup if it is zero.
+	Time int64
+}
+
+// AppendGroup appends every batch as its own record with one write
+// and at most one sync of the file for the whole group.
+// The file is synced if sync is set or the WAL is opened with FileSync.
+// The batches of the group must be ordered by the sequence numbers.
+func (w *WAL) AppendGroup(batches []Batch, sync bool) error {
+	if len(batches) == 0 {
+		return nil
+	}
+
+	// the records are encoded and compressed before the lock is taken,
+	// the compressor of the WAL is the compressor of every segment it starts
+	var (
+		recs = make([][]byte, 0, len(batches))
+		now  = time.Now().UnixNano()
+	)
+	for _, b := range batches {
+		if b.Time == 0 {
+			b.Time = now
+		}
+		rec, err := encodeBatch(b)
+		if err != nil {
+			return fmt.Errorf("failed to encode the batch: %w", err)
+		}
+		if w.compressor != nil {
+			if rec, err = w.compressor.Compress(rec); err != nil {
+				return fmt.Errorf("failed to compress the batch: %w", err)
+			}
+		}
+		recs = append(recs, rec)
+	}
+
 	w.lock.Lock()
 	defer w.lock.Unlock()
-	// for safety, since the file is open in read-write mode
-	// if _, err := w.f.Seek(0, io.SeekEnd); err != nil {
-	// 	return fmt.Errorf("failed to seek to the end: %w", err)
-	// }
 
-	if _, err := sst.Encode(w.f, key, value); err != nil {
-		return fmt.Errorf("failed to encode and write to the file: %w", err)
+	if w.f == nil || (w.rotate != 0 && batches[0].Seq >= w.rotate) {
+		if err := w.newSegment(batches[0].Seq); err != nil {
+			return err
+		}
+		w.rotate = 0
+	}
+
+	var buf []byte
+	for _, rec := range recs {
+		buf = appendFragments(buf, &w.block, rec)
+	}
+
+	if _, err := w.f.Write(buf); err != nil {
+		return fmt.Errorf("failed to write to the file: %w", err)
 	}
 
-	if w.fsync {
+	if w.fsync || sync {
 		if err := w.f.Sync(); err != nil {
 			return fmt.Errorf("failed to sync the file: %w", err)
 		}
 	}
+	close(w.appended)
+	w.appended = make(chan struct{})
 
 	return nil
 }
 
-// loadMemTable loads MemTable from the WAL file.
-func (w *WAL) LoadMem() (*memtable.Memtable, error) {
-	// for safety, since the file is open in read-write mode
-	// if _, err := w.f.Seek(0, io.SeekStart); err != nil {
-	// 	return nil, fmt.Errorf("failed to seek to the beginning: %w", err)
-	// }
+// Appended returns the channel closed by the next append.
+func (w *WAL) Appended() <-chan struct{} {
+	w.lock.RLock()
+	defer w.lock.RUnlock()
 
-	bs, err := io.ReadAll(w.f)
-	if err != nil {
-		return nil, err
+	return w.appended
+}
+
+// Sync syncs the WAL file to the disk.
+func (w *WAL) Sync() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if w.f == nil {
+		return nil
 	}
-	buf := bytes.NewReader(bs)
-	mem := memtable.NewMem()
-	for {
-		key, value, err := sst.Decode(buf)
-		if err != nil && err != io.EOF {
-			return nil, fmt.Errorf("failed to read: %w", err)
+	if err := w.f.Sync(); err != nil {
+		return fmt.Errorf("failed to sync the file: %w", err)
+	}
+
+	return nil
+}
+
+// Replay passes the entries not flushed to the SST files to apply with their
+// column families and internal keys. The segments with all records flushed
+// are skipped, the damaged records are treated by the recovery mode.
+// The sequence counter is moved to the last replayed entry.
+// Returns the records dropped by the recovery mode.
+func (w *WAL) Replay(apply func(family uint32, ikey, val []byte)) (RecoveryStats, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	var stats RecoveryStats
+	for idx, s := range w.segments {
+		if idx+1 < len(w.segments) && w.segments[idx+1].start <= w.flushed+1 {
+			continue
 		}
-		if err == io.EOF {
-			return mem, nil
+
+		bs, err := os.ReadFile(s.name)
+		if err != nil {
+			return stats, err
+		}
+		data := bs[min(segmentHeaderSize, int64(len(bs))):]
+		r := &blockReader{buf: data}
+		for {
+			off := r.offset()
+			payload, err := r.next()
+			if err == io.EOF {
+				break
+			}
+			// the reader is moved past the record decoded with an error
+			framed := err == nil
+			var b Batch
+			if err == nil {
+				b, err = s.decode(payload)
+			}
+			if err != nil {
+				err = fmt.Errorf("segment %s at %d: %w", s.name, segmentHeaderSize+int64(off), err)
+				if w.recovery == AbsoluteConsistency {
+					return stats, err
+				}
+				if w.recovery == SkipAnyCorrupted && (framed || r.skip()) {
+					stats.DroppedBytes += int64(r.offset() - off)
+					stats.DroppedRecords++
+					continue
+				}
+
+				valid, damaged := 0, 0
+				if framed || r.skip() {
+					valid, damaged = countRecords(s, r)
+				}
+				if w.recovery == TolerateCorruptedTail && valid > 0 {
+					return stats, err
+				}
+				stats.DroppedBytes += int64(len(data) - off)
+				stats.DroppedRecords += 1 + valid + damaged
+
+				if w.recovery == PointInTime {
+					return stats, w.truncate(idx, segmentHeaderSize+int64(off), &stats)
+				}
+				break
+			}
+
+			for idx := range b.Elems {
+				if b.Seq+uint64(idx) <= w.flushed {
+					continue
+				}
+				kind := encoder.KindOf(b.Elems[idx].Val)
+				apply(b.Elems[idx].Family, encoder.MakeInternalKey(b.Elems[idx].Key, b.Seq+uint64(idx), kind), b.Elems[idx].Val)
+			}
+			if len(b.Elems) > 0 {
+				w.SetSequence(b.Seq + uint64(len(b.Elems)) - 1)
+			}
+		}
+	}
+
+	return stats, nil
+}
+
+// truncate drops the records of the segment starting from the offset and the segments after it,
+// so the records written after the recovery are not dropped by the next one.
+// Called under the lock of the WAL.
+func (w *WAL) truncate(idx int, offset int64, stats *RecoveryStats) error {
+	for _, s := range w.segments[idx+1:] {
+		bs, err := os.ReadFile(s.name)
+		if err != nil {
+			return err
 		}
+		data := bs[min(segmentHeaderSize, int64(len(bs))):]
+		valid, damaged := countRecords(s, &blockReader{buf: data})
+		stats.DroppedBytes += int64(len(data))
+		stats.DroppedRecords += valid + damaged
 
-		mem.Put(key, value)
+		if err := os.Remove(s.name); err != nil {
+			return fmt.Errorf("failed to remove the segment %s: %w", s.name, err)
+		}
+	}
+	w.segments = w.segments[:idx+1]
+
+	if err := os.Truncate(w.segments[idx].name, offset); err != nil {
+		return fmt.Errorf("failed to truncate the segment %s: %w", w.segments[idx].name, err)
+	}
+
+	return nil
+}
+
+// countRecords counts the valid and the damaged records left in the segment.
+func countRecords(s segment, r recordReader) (int, int) {
+	var valid, damaged int
+	for {
+		payload, err := r.next()
+		if err == io.EOF {
+			return valid, damaged
+		}
+		if err == nil {
+			if _, err := s.decode(payload); err == nil {
+				valid++
+				continue
+			}
+			damaged++
+			continue
+		}
+		damaged++
+		if !r.skip() {
+			return valid, damaged
+		}
 	}
 }
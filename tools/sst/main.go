@@ -8,6 +8,7 @@ import (
 
 	"github.com/go-faker/faker/v4"
 	"github.com/google/uuid"
+	"github.com/s-ilyin/lsm-distributed/lsm/encoder"
 	"github.com/s-ilyin/lsm-distributed/lsm/memtable"
 	"github.com/s-ilyin/lsm-distributed/lsm/sst"
 )
@@ -44,12 +45,14 @@ func main() {
 		}
 		mem := memtable.NewMem()
 		var limit float64
+		var seq uint64
 		var maxLimit = float64(1 * (1 << 10 * 1 << 10 * 1 << 10)) // 1Gi
 		for limit < maxLimit {
 
 			key := []byte(uuid.NewString())
 			val := []byte(faker.Word() + faker.Word() + faker.Word() + faker.Word() + faker.Word() + faker.Word())
-			mem.Put(key[:], val)
+			seq++
+			mem.Put(encoder.MakeInternalKey(key, seq, encoder.OpKindSet), val)
 
 			limit += float64(len(key) + len(val) + (2 * binary.MaxVarintLen64))
 		}
@@ -62,7 +65,7 @@ func main() {
 		}
 		mem.Clear()
 
-		if err := wr.AddIdxBlock(10); err != nil {
+		if err := wr.AddIdxBlock(seq); err != nil {
 			panic(err)
 		}
 		if err := wr.Close(); err != nil {